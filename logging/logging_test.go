@@ -0,0 +1,134 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testLogger(format string) (*Logger, *bytes.Buffer, *time.Time) {
+	var buf bytes.Buffer
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	l, _ := New(&buf, "nudger", format, Info)
+	l.Now = func() time.Time { return now }
+	return l, &buf, &now
+}
+
+func TestParseLine(t *testing.T) {
+	level, component, msg, fields := ParseLine("[error] trace=9f86d081884c7d65 PollJSON: example.org: HTTP 500\n")
+	if level != Error || component != "PollJSON" || msg != "example.org: HTTP 500" || fields["request_id"] != "9f86d081884c7d65" {
+		t.Errorf("Expected the line's parts, got %s, %q, %q, %+v\n", level, component, msg, fields)
+	}
+	level, component, msg, _ = ParseLine("[info]: Not posting to Slack\n")
+	if level != Info || component != "" || msg != "Not posting to Slack" {
+		t.Errorf("Expected an info line without a component, got %s, %q, %q\n", level, component, msg)
+	}
+	if level, _, msg, _ := ParseLine("nudgers gonna nudge"); level != Info || msg != "nudgers gonna nudge" {
+		t.Errorf("Expected a line without a level to be info, got %s, %q\n", level, msg)
+	}
+}
+
+func TestFormats(t *testing.T) {
+	fields := Fields{"check": "example.org", "request_id": "abc", "source": "http_json"}
+
+	l, buf, _ := testLogger("text")
+	l.Log(Error, "PollJSON", "HTTP 500", fields)
+	if buf.String() != "2026/10/19 12:00:00 [error] request_id=abc check=example.org source=http_json PollJSON: HTTP 500\n" {
+		t.Errorf("Unexpected text line %q\n", buf.String())
+	}
+
+	l, buf, _ = testLogger("logfmt")
+	l.Log(Error, "PollJSON", "HTTP 500", fields)
+	if buf.String() != `ts=2026-10-19T12:00:00Z level=error app=nudger component=PollJSON request_id=abc check=example.org source=http_json msg="HTTP 500"`+"\n" {
+		t.Errorf("Unexpected logfmt line %q\n", buf.String())
+	}
+
+	l, buf, _ = testLogger("json")
+	l.Log(Error, "PollJSON", "HTTP 500", fields)
+	var line map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if line["level"] != "error" || line["component"] != "PollJSON" || line["check"] != "example.org" || line["msg"] != "HTTP 500" || line["app"] != "nudger" {
+		t.Errorf("Unexpected JSON line %+v\n", line)
+	}
+
+	if _, err := New(buf, "nudger", "xml", Info); err == nil {
+		t.Errorf("Expected an error for an unknown format\n")
+	}
+}
+
+func TestLevels(t *testing.T) {
+	l, buf, _ := testLogger("text")
+	l.Write([]byte("[debug] Dispatch: metric\n"))
+	l.Write([]byte("[info] Main: tick\n"))
+	if strings.Contains(buf.String(), "Dispatch") || !strings.Contains(buf.String(), "Main: tick") {
+		t.Errorf("Expected debug lines to be filtered at info, got %q\n", buf.String())
+	}
+	buf.Reset()
+	l.SetLevel(Debug)
+	l.Write([]byte("[debug] Dispatch: metric\n"))
+	if !strings.Contains(buf.String(), "[debug] Dispatch: metric") {
+		t.Errorf("Expected debug lines at debug, got %q\n", buf.String())
+	}
+}
+
+func TestRepeatedErrorsLimited(t *testing.T) {
+	l, buf, now := testLogger("logfmt")
+	for i := 0; i < 8; i++ {
+		l.Log(Error, "PollNR", "HTTP 401", Fields{"check": "app 123"})
+	}
+	l.Log(Error, "PollNR", "HTTP 401", Fields{"check": "app 456"})
+	if n := strings.Count(buf.String(), "\n"); n != 6 {
+		t.Errorf("Expected 5 repeats and another check's error, got %d lines\n", n)
+	}
+
+	buf.Reset()
+	*now = now.Add(time.Minute)
+	l.Log(Error, "PollNR", "HTTP 401", Fields{"check": "app 123"})
+	if !strings.Contains(buf.String(), "suppressed=3") {
+		t.Errorf("Expected the count of suppressed repeats, got %q\n", buf.String())
+	}
+}
+
+func TestWithFields(t *testing.T) {
+	ctx := WithFields(context.Background(), Fields{"check": "example.org"})
+	ctx = WithFields(ctx, Fields{"source": "tcp"})
+	if fields := FieldsFrom(ctx); fields["check"] != "example.org" || fields["source"] != "tcp" {
+		t.Errorf("Expected fields to be merged, got %+v\n", fields)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	l, _, _ := testLogger("text")
+	handler := l.Handler()
+
+	req := httptest.NewRequest("PUT", "/debug/loglevel", strings.NewReader("debug"))
+	req.RemoteAddr = "127.0.0.1:1234"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != 200 || l.Level() != Debug {
+		t.Errorf("Expected the level to change to debug, got %d and %s\n", w.Code, l.Level())
+	}
+
+	req = httptest.NewRequest("PUT", "/debug/loglevel?level=loud", nil)
+	req.RemoteAddr = "127.0.0.1:1234"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown level, got %d\n", w.Code)
+	}
+
+	req = httptest.NewRequest("PUT", "/debug/loglevel?level=error", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden || l.Level() != Debug {
+		t.Errorf("Expected requests from elsewhere to be forbidden, got %d\n", w.Code)
+	}
+}
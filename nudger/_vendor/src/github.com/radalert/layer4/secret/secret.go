@@ -0,0 +1,103 @@
+// Package secret loads credentials from the environment or mounted files, and
+// keeps them out of logs.
+//
+// It's vendored into each project that uses it, at
+// _vendor/src/github.com/radalert/layer4/secret. Copy it over again after
+// changing it.
+package secret
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// redacted is what a secret prints as.
+const redacted = "[redacted]"
+
+// Secret is a credential. It prints as [redacted] with every fmt verb,
+// including when it's a field of a struct printed with %+v or %#v, so it can't
+// end up in logs by accident. Reveal returns the value itself, to use it.
+//
+// Secrets are encoded to and decoded from JSON as their values, as that's how
+// they travel to the services that need them, so don't log JSON with secrets
+// in it.
+type Secret struct {
+	value string
+}
+
+// New wraps a value as a secret.
+func New(value string) Secret {
+	return Secret{value: value}
+}
+
+// Reveal returns the secret's value.
+func (s Secret) Reveal() string {
+	return s.value
+}
+
+// IsZero is whether the secret is empty.
+func (s Secret) IsZero() bool {
+	return s.value == ""
+}
+
+// Equal compares the secret to a value in constant time.
+func (s Secret) Equal(value string) bool {
+	return subtle.ConstantTimeCompare([]byte(s.value), []byte(value)) == 1
+}
+
+func (s Secret) String() string {
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return `secret.Secret("` + redacted + `")`
+}
+
+func (s Secret) Format(f fmt.State, verb rune) {
+	if verb == 'v' && f.Flag('#') {
+		fmt.Fprint(f, s.GoString())
+		return
+	}
+	fmt.Fprint(f, redacted)
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.value)
+}
+
+func (s *Secret) UnmarshalJSON(b []byte) error {
+	return json.Unmarshal(b, &s.value)
+}
+
+// Load loads the secret called name from the file named by the environment
+// variable name_FILE, e.g. a mounted Docker or Kubernetes secret, or else from
+// the environment variable name itself. It's an error if neither is set, so
+// there's no falling back on a default credential.
+func Load(name string) (Secret, error) {
+	s, err := Optional(name)
+	if err == nil && s.IsZero() {
+		err = fmt.Errorf("%s isn't set: set it, or set %s_FILE to a file holding it", name, name)
+	}
+	return s, err
+}
+
+// Optional loads the secret called name like Load, but returns an empty secret
+// if it isn't set.
+func Optional(name string) (Secret, error) {
+	if path := os.Getenv(name + "_FILE"); path != "" {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return Secret{}, fmt.Errorf("couldn't read %s from %s_FILE: %s", name, name, err)
+		}
+		value := strings.TrimRight(string(b), "\r\n")
+		if value == "" {
+			return Secret{}, fmt.Errorf("%s_FILE %s is empty", name, path)
+		}
+		return New(value), nil
+	}
+	return New(os.Getenv(name)), nil
+}
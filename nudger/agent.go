@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/radalert/layer4/secret"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hostSnapshot is a reading of the cumulative counters in /proc, which are
+// turned into rates by comparing consecutive snapshots.
+type hostSnapshot struct {
+	time time.Time
+	cpu  []float64
+	net  map[string][]float64
+	disk map[string][]float64
+}
+
+// HostAgent reads host metrics from /proc (or a stand-in at ProcRoot) and
+// tags them with the hostname.
+type HostAgent struct {
+	ProcRoot string
+	Hostname string
+	ApiKey   secret.Secret
+	previous *hostSnapshot
+}
+
+func NewHostAgent(procRoot string, apikey secret.Secret) *HostAgent {
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Printf("[error] NewHostAgent: couldn't get hostname: %s\n", err)
+		hostname = "localhost"
+	}
+	return &HostAgent{ProcRoot: procRoot, Hostname: hostname, ApiKey: apikey}
+}
+
+// readFields returns the whitespace separated fields of each line in a file
+// under the proc root.
+func (a *HostAgent) readFields(name string) ([][]string, error) {
+	f, err := os.Open(filepath.Join(a.ProcRoot, name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	lines := [][]string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, strings.Fields(scanner.Text()))
+	}
+	return lines, scanner.Err()
+}
+
+func parseFloats(fields []string) []float64 {
+	values := make([]float64, len(fields))
+	for i, f := range fields {
+		values[i], _ = strconv.ParseFloat(f, 64)
+	}
+	return values
+}
+
+func (a *HostAgent) snapshot() (*hostSnapshot, error) {
+	s := &hostSnapshot{time: time.Now(), net: map[string][]float64{}, disk: map[string][]float64{}}
+
+	stat, err := a.readFields("stat")
+	if err != nil {
+		return nil, err
+	}
+	for _, fields := range stat {
+		if len(fields) > 4 && fields[0] == "cpu" {
+			s.cpu = parseFloats(fields[1:])
+		}
+	}
+	if s.cpu == nil {
+		return nil, fmt.Errorf("no cpu line in stat")
+	}
+
+	netdev, err := a.readFields("net/dev")
+	if err != nil {
+		return nil, err
+	}
+	for _, fields := range netdev {
+		// "eth0: 1234 ..." or, with a large first counter, "eth0:1234 ..."
+		if len(fields) == 0 || !strings.Contains(fields[0], ":") {
+			continue
+		}
+		parts := strings.SplitN(fields[0], ":", 2)
+		if parts[1] != "" {
+			fields = append([]string{parts[0]}, append([]string{parts[1]}, fields[1:]...)...)
+		} else {
+			fields = append([]string{parts[0]}, fields[1:]...)
+		}
+		if len(fields) < 17 || fields[0] == "lo" {
+			continue
+		}
+		s.net[fields[0]] = parseFloats(fields[1:])
+	}
+
+	diskstats, err := a.readFields("diskstats")
+	if err != nil {
+		return nil, err
+	}
+	for _, fields := range diskstats {
+		if len(fields) < 14 {
+			continue
+		}
+		name := fields[2]
+		if strings.HasPrefix(name, "loop") || strings.HasPrefix(name, "ram") {
+			continue
+		}
+		s.disk[name] = parseFloats(fields[3:])
+	}
+	return s, nil
+}
+
+// Collect reads /proc, returning load and memory metrics, and CPU, network
+// and disk rates since the previous collection. The first collection only
+// returns load and memory, as there's nothing to compare it to.
+func (a *HostAgent) Collect() ([]Metric, error) {
+	metrics := []Metric{}
+	emit := func(name string, value float64) {
+		metrics = append(metrics, Metric{
+			ApiKey: a.ApiKey,
+			Check:  a.Hostname + ": " + name,
+			Metric: value,
+			TTL:    400,
+			Tags:   []string{a.Hostname},
+		})
+	}
+
+	loadavg, err := a.readFields("loadavg")
+	if err != nil {
+		return nil, err
+	}
+	if len(loadavg) == 0 || len(loadavg[0]) < 3 {
+		return nil, fmt.Errorf("malformed loadavg")
+	}
+	load := parseFloats(loadavg[0][:3])
+	emit("load 1m", load[0])
+	emit("load 5m", load[1])
+	emit("load 15m", load[2])
+
+	meminfo, err := a.readFields("meminfo")
+	if err != nil {
+		return nil, err
+	}
+	mem := map[string]float64{}
+	for _, fields := range meminfo {
+		if len(fields) >= 2 {
+			mem[strings.TrimSuffix(fields[0], ":")], _ = strconv.ParseFloat(fields[1], 64)
+		}
+	}
+	if mem["MemTotal"] > 0 {
+		available, ok := mem["MemAvailable"]
+		if !ok {
+			// Kernels before 3.14 don't estimate available memory.
+			available = mem["MemFree"] + mem["Buffers"] + mem["Cached"]
+		}
+		emit("memory available MB", available/1024)
+		emit("memory used percent", 100*(mem["MemTotal"]-available)/mem["MemTotal"])
+	}
+	if mem["SwapTotal"] > 0 {
+		emit("swap used percent", 100*(mem["SwapTotal"]-mem["SwapFree"])/mem["SwapTotal"])
+	}
+
+	current, err := a.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	previous := a.previous
+	a.previous = current
+	if previous == nil {
+		return metrics, nil
+	}
+	elapsed := current.time.Sub(previous.time).Seconds()
+	if elapsed <= 0 {
+		return metrics, nil
+	}
+
+	// user nice system idle iowait irq softirq steal
+	if len(current.cpu) >= 8 && len(previous.cpu) >= 8 {
+		delta := make([]float64, 8)
+		total := 0.0
+		for i := range delta {
+			delta[i] = current.cpu[i] - previous.cpu[i]
+			total += delta[i]
+		}
+		if total > 0 {
+			emit("cpu user percent", 100*(delta[0]+delta[1])/total)
+			emit("cpu system percent", 100*(delta[2]+delta[5]+delta[6])/total)
+			emit("cpu iowait percent", 100*delta[4]/total)
+			emit("cpu steal percent", 100*delta[7]/total)
+			emit("cpu idle percent", 100*delta[3]/total)
+		}
+	}
+
+	rate := func(now, before float64) float64 {
+		if now < before {
+			// The counter wrapped or was reset.
+			return 0
+		}
+		return (now - before) / elapsed
+	}
+
+	// receive: bytes packets errs drop fifo frame compressed multicast, then
+	// transmit: bytes packets errs drop ...
+	for iface, now := range current.net {
+		before, ok := previous.net[iface]
+		if !ok {
+			continue
+		}
+		emit(iface+" rx bytes per second", rate(now[0], before[0]))
+		emit(iface+" tx bytes per second", rate(now[8], before[8]))
+		emit(iface+" errors per second", rate(now[2]+now[10], before[2]+before[10]))
+	}
+
+	// reads merged sectors ms, writes merged sectors ms, in progress, io ms
+	for device, now := range current.disk {
+		before, ok := previous.disk[device]
+		if !ok {
+			continue
+		}
+		emit(device+" reads per second", rate(now[0], before[0]))
+		emit(device+" writes per second", rate(now[4], before[4]))
+		emit(device+" read bytes per second", rate(now[2], before[2])*512)
+		emit(device+" write bytes per second", rate(now[6], before[6])*512)
+		emit(device+" utilisation percent", rate(now[9], before[9])/10)
+	}
+
+	return metrics, nil
+}
+
+// RunAgent collects host metrics every interval, until ctx is cancelled.
+func RunAgent(ctx context.Context, config Config, metrics chan Metric) {
+	agent := NewHostAgent(config.ProcRoot, config.AgentApiKey)
+	log.Printf("[info] RunAgent: collecting metrics for %s from %s\n", agent.Hostname, agent.ProcRoot)
+
+	tick := time.NewTicker(config.Interval).C
+	for {
+		collected, err := agent.Collect()
+		if err != nil {
+			log.Printf("[error] RunAgent: %s\n", err)
+		}
+		for _, m := range collected {
+			metrics <- m
+		}
+		select {
+		case <-tick:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
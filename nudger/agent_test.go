@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"github.com/radalert/layer4/secret"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeProc writes a stand-in procfs, with counters scaled by n.
+func writeProc(t *testing.T, root string, n int) {
+	files := map[string]string{
+		"stat": fmt.Sprintf("cpu  %d 0 %d %d %d 0 0 0 0 0\ncpu0 1 2 3 4 5 6 7 8 9 10\n", 20*n, 10*n, 60*n, 10*n),
+		"meminfo": "MemTotal:        1000000 kB\nMemFree:          100000 kB\nMemAvailable:     250000 kB\n" +
+			"SwapTotal:        200000 kB\nSwapFree:         150000 kB\n",
+		"loadavg": "0.41 0.32 0.18 2/73 8444\n",
+		"net/dev": "Inter-|   Receive |  Transmit\n face |bytes packets errs|bytes packets errs\n" +
+			"    lo: 999999 1 0 0 0 0 0 0 999999 1 0 0 0 0 0 0\n" +
+			fmt.Sprintf("  eth0:%d 10 %d 0 0 0 0 0 %d 10 0 0 0 0 0 0\n", 10000*n, n, 5000*n),
+		"diskstats": fmt.Sprintf("   7       0 loop0 1 0 0 0 0 0 0 0 0 0 0\n   8       0 sda %d 0 %d 0 %d 0 %d 0 0 %d 0\n", 100*n, 800*n, 50*n, 400*n, 5000*n),
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Couldn't write %s: %s\n", path, err)
+		}
+	}
+}
+
+func TestHostAgent(t *testing.T) {
+	root, err := ioutil.TempDir("", "nudger")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s\n", err)
+	}
+	defer os.RemoveAll(root)
+
+	agent := &HostAgent{ProcRoot: root, Hostname: "web1", ApiKey: secret.New("def")}
+	writeProc(t, root, 1)
+	first, err := agent.Collect()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if len(first) != 6 {
+		t.Errorf("Expected only load and memory metrics on first collection, got %+v\n", first)
+	}
+	if first[0].Tags[0] != "web1" || first[0].ApiKey.Reveal() != "def" {
+		t.Errorf("Expected metrics tagged with hostname, got %+v\n", first[0])
+	}
+
+	// Pretend the first snapshot was taken 10 seconds ago.
+	agent.previous.time = agent.previous.time.Add(-10 * time.Second)
+	writeProc(t, root, 2)
+	second, err := agent.Collect()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	results := map[string]float64{}
+	for _, m := range second {
+		results[m.Check] = m.Metric
+	}
+
+	expected := map[string]float64{
+		"web1: load 1m":                    0.41,
+		"web1: memory available MB":        250000.0 / 1024,
+		"web1: memory used percent":        75,
+		"web1: swap used percent":          25,
+		"web1: cpu user percent":           20,
+		"web1: cpu system percent":         10,
+		"web1: cpu idle percent":           60,
+		"web1: cpu iowait percent":         10,
+		"web1: eth0 rx bytes per second":   1000,
+		"web1: eth0 tx bytes per second":   500,
+		"web1: eth0 errors per second":     0.1,
+		"web1: sda reads per second":       10,
+		"web1: sda writes per second":      5,
+		"web1: sda read bytes per second":  800 * 512 / 10,
+		"web1: sda write bytes per second": 400 * 512 / 10,
+		"web1: sda utilisation percent":    50,
+	}
+	for name, value := range expected {
+		// Allow for the real time taken between collections.
+		if got, ok := results[name]; !ok || math.Abs(got-value) > 0.01+value/1000 {
+			t.Errorf("Expected %s to be %f, got %f\n", name, value, got)
+		}
+	}
+	for name := range results {
+		if name == "web1: lo rx bytes per second" || name == "web1: loop0 reads per second" {
+			t.Errorf("Expected loopback devices to be skipped, got %s\n", name)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// windowAggregates are what a window can be rolled up into.
+var windowAggregates = map[string]bool{
+	"mean": true, "min": true, "max": true, "sum": true, "count": true,
+	"p50": true, "p95": true, "p99": true,
+}
+
+// WindowRule rolls up the metrics for checks matching Pattern over windows
+// of Window, so high-frequency sources are submitted to Pacemaker once a
+// window instead of point by point.
+//
+// Pattern is matched against the whole check name, where "*" matches
+// anything, e.g. "web*: requests". Windows are aligned to the wall clock, so
+// a window of "1m" runs from the start of one minute to the start of the
+// next. Each of Aggregates is submitted as a check of its own, named like
+// "web1: requests: p95", unless there's only one, which keeps the check's
+// name. Aggregates default to mean.
+//
+// Points go in the window their timestamp falls in, if their source gives
+// them one, or else the window they arrive in. A window is flushed Lateness
+// after it ends, so points that arrive a little late still count; points
+// for windows that have already been flushed are dropped.
+type WindowRule struct {
+	Pattern    string   `json:"pattern"`
+	Window     string   `json:"window"`
+	Lateness   string   `json:"lateness"`
+	Aggregates []string `json:"aggregates"`
+
+	pattern  *regexp.Regexp
+	window   time.Duration
+	lateness time.Duration
+}
+
+// compile parses the rule's pattern and durations, and checks its
+// aggregates.
+func (r *WindowRule) compile() error {
+	parts := strings.Split(r.Pattern, "*")
+	for i, p := range parts {
+		parts[i] = regexp.QuoteMeta(p)
+	}
+	pattern, err := regexp.Compile("^" + strings.Join(parts, ".*") + "$")
+	if err != nil {
+		return err
+	}
+	r.pattern = pattern
+
+	r.window, err = time.ParseDuration(r.Window)
+	if err != nil || r.window < time.Second {
+		return fmt.Errorf("window for %q must be at least 1s, got %q", r.Pattern, r.Window)
+	}
+	if r.Lateness != "" {
+		r.lateness, err = time.ParseDuration(r.Lateness)
+		if err != nil || r.lateness < 0 {
+			return fmt.Errorf("bad lateness for %q: %q", r.Pattern, r.Lateness)
+		}
+	}
+	if len(r.Aggregates) == 0 {
+		r.Aggregates = []string{"mean"}
+	}
+	for _, a := range r.Aggregates {
+		if !windowAggregates[a] {
+			return fmt.Errorf("unknown aggregate %q for %q", a, r.Pattern)
+		}
+	}
+	return nil
+}
+
+// LoadWindowRules reads a JSON list of window rules from filename.
+func LoadWindowRules(filename string) ([]WindowRule, error) {
+	body, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var rules []WindowRule
+	err = json.Unmarshal(body, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode %s: %s", filename, err)
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return nil, fmt.Errorf("%s: %s", filename, err)
+		}
+	}
+	return rules, nil
+}
+
+type windowKey struct {
+	apikey string
+	check  string
+	start  time.Time
+}
+
+type window struct {
+	rule  *WindowRule
+	end   time.Time
+	last  Metric
+	count int
+	sum   float64
+	min   float64
+	max   float64
+	// values are only kept when the rule has percentiles.
+	values []float64
+}
+
+func (w *window) add(m Metric) {
+	if w.count == 0 || m.Metric < w.min {
+		w.min = m.Metric
+	}
+	if w.count == 0 || m.Metric > w.max {
+		w.max = m.Metric
+	}
+	w.count++
+	w.sum += m.Metric
+	w.last = m
+	for _, a := range w.rule.Aggregates {
+		if strings.HasPrefix(a, "p") {
+			w.values = append(w.values, m.Metric)
+			break
+		}
+	}
+}
+
+// metrics returns what the window is rolled up into. They're good for at
+// least two windows, so one missed flush doesn't expire them.
+func (w *window) metrics() []Metric {
+	sort.Float64s(w.values)
+	ttl := w.last.TTL
+	if min := int(2 * w.rule.window.Seconds()); ttl < min {
+		ttl = min
+	}
+	metrics := []Metric{}
+	for _, a := range w.rule.Aggregates {
+		value := 0.0
+		switch a {
+		case "mean":
+			value = w.sum / float64(w.count)
+		case "min":
+			value = w.min
+		case "max":
+			value = w.max
+		case "sum":
+			value = w.sum
+		case "count":
+			value = float64(w.count)
+		case "p50", "p95", "p99":
+			p, _ := strconv.ParseFloat(a[1:], 64)
+			value = percentile(w.values, p)
+		}
+		check := w.last.Check
+		if len(w.rule.Aggregates) > 1 {
+			check += ": " + a
+		}
+		metrics = append(metrics, Metric{ApiKey: w.last.ApiKey, Check: check, Metric: value, TTL: ttl, Tags: w.last.Tags})
+	}
+	return metrics
+}
+
+// WindowAggregator rolls up the metrics that match its rules into windows,
+// for Dispatch. It isn't safe for concurrent use, as only Dispatch uses it.
+type WindowAggregator struct {
+	Rules []WindowRule
+
+	// now is the time, which tests can stop.
+	now        func() time.Time
+	windows    map[windowKey]*window
+	late       int
+	lastLogged time.Time
+}
+
+// NewWindowAggregator creates an aggregator for rules, or returns nil if
+// there aren't any.
+func NewWindowAggregator(rules []WindowRule) *WindowAggregator {
+	if len(rules) == 0 {
+		return nil
+	}
+	return &WindowAggregator{Rules: rules, now: time.Now, windows: map[windowKey]*window{}}
+}
+
+// Add puts a metric in its window, if a rule matches its check, and returns
+// whether it did, or dropped it for being too late. Metrics it returns false
+// for should be dispatched as they are.
+func (a *WindowAggregator) Add(m Metric) bool {
+	if a == nil {
+		return false
+	}
+	var rule *WindowRule
+	for i := range a.Rules {
+		if a.Rules[i].pattern.MatchString(m.Check) {
+			rule = &a.Rules[i]
+			break
+		}
+	}
+	if rule == nil {
+		return false
+	}
+
+	now := a.now()
+	at := m.at
+	if at.IsZero() || at.After(now) {
+		at = now
+	}
+	start := at.Truncate(rule.window)
+	end := start.Add(rule.window)
+	if !now.Before(end.Add(rule.lateness)) {
+		a.late++
+		Stats.WindowLate()
+		if now.Sub(a.lastLogged) > time.Second*10 {
+			a.lastLogged = now
+			log.Printf("[info] WindowAggregator: dropped point for %q from %s, after its window closed (%d late points so far)\n", m.Check, at.Format(time.RFC3339), a.late)
+		}
+		return true
+	}
+
+	key := windowKey{apikey: m.ApiKey.Reveal(), check: m.Check, start: start}
+	w, ok := a.windows[key]
+	if !ok {
+		w = &window{rule: rule, end: end}
+		a.windows[key] = w
+	}
+	w.add(m)
+	return true
+}
+
+// Late returns how many points have been dropped for arriving after their
+// window was flushed.
+func (a *WindowAggregator) Late() int {
+	if a == nil {
+		return 0
+	}
+	return a.late
+}
+
+// Flush returns the metrics for windows that have closed, i.e. whose
+// lateness has passed, and forgets them.
+func (a *WindowAggregator) Flush() []Metric {
+	if a == nil {
+		return nil
+	}
+	now := a.now()
+	return a.flush(func(w *window) bool {
+		return !now.Before(w.end.Add(w.rule.lateness))
+	})
+}
+
+// FlushAll returns the metrics for every window, including those still
+// open, for shutdown.
+func (a *WindowAggregator) FlushAll() []Metric {
+	if a == nil {
+		return nil
+	}
+	return a.flush(func(w *window) bool { return true })
+}
+
+func (a *WindowAggregator) flush(closed func(*window) bool) []Metric {
+	keys := []windowKey{}
+	for key, w := range a.windows {
+		if closed(w) {
+			keys = append(keys, key)
+		}
+	}
+	// Oldest first, then by check, so windows are submitted in order.
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].start.Equal(keys[j].start) {
+			return keys[i].start.Before(keys[j].start)
+		}
+		return keys[i].check < keys[j].check
+	})
+	metrics := []Metric{}
+	for _, key := range keys {
+		metrics = append(metrics, a.windows[key].metrics()...)
+		delete(a.windows, key)
+	}
+	return metrics
+}
+
+// windowFlushInterval is how often Dispatch flushes windows that have
+// closed.
+const windowFlushInterval = time.Second
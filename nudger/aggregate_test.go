@@ -0,0 +1,167 @@
+package main
+
+import (
+	"github.com/radalert/layer4/pacemaker"
+	"github.com/radalert/layer4/secret"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stoppedAggregator creates an aggregator for rules whose clock is stopped at
+// *now.
+func stoppedAggregator(t *testing.T, now *time.Time, rules ...WindowRule) *WindowAggregator {
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			t.Fatalf("Unexpected error: %s\n", err)
+		}
+	}
+	a := NewWindowAggregator(rules)
+	a.now = func() time.Time { return *now }
+	return a
+}
+
+func TestWindowAggregator(t *testing.T) {
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	now := start.Add(20 * time.Second)
+	a := stoppedAggregator(t, &now, WindowRule{
+		Pattern:    "web*: requests",
+		Window:     "1m",
+		Lateness:   "10s",
+		Aggregates: []string{"mean", "min", "max", "sum", "count", "p50", "p95", "p99"},
+	})
+
+	if a.Add(Metric{Check: "db1: queries", Metric: 1}) {
+		t.Errorf("Expected metrics no rule matches to be left alone\n")
+	}
+	for i := 1; i <= 100; i++ {
+		m := Metric{ApiKey: secret.New("def"), Check: "web1: requests", Metric: float64(i), TTL: 400, at: start.Add(time.Duration(i%60) * time.Second)}
+		if !a.Add(m) {
+			t.Fatalf("Expected the metric to be added to a window\n")
+		}
+	}
+
+	// The window ends at 12:01, but points for it are accepted until 12:01:10.
+	now = start.Add(time.Minute + 5*time.Second)
+	a.Add(Metric{ApiKey: secret.New("def"), Check: "web1: requests", Metric: 1000, TTL: 400, at: start.Add(59 * time.Second)})
+	if metrics := a.Flush(); len(metrics) != 0 {
+		t.Errorf("Expected nothing until the window's lateness passes, got %+v\n", metrics)
+	}
+
+	now = start.Add(time.Minute + 10*time.Second)
+	metrics := a.Flush()
+	expected := map[string]float64{
+		"web1: requests: mean":  float64(5050+1000) / 101,
+		"web1: requests: min":   1,
+		"web1: requests: max":   1000,
+		"web1: requests: sum":   5050 + 1000,
+		"web1: requests: count": 101,
+		"web1: requests: p50":   51,
+		"web1: requests: p95":   96,
+		"web1: requests: p99":   100,
+	}
+	if len(metrics) != len(expected) {
+		t.Fatalf("Expected %d metrics, got %+v\n", len(expected), metrics)
+	}
+	for _, m := range metrics {
+		if value, ok := expected[m.Check]; !ok || m.Metric != value {
+			t.Errorf("Expected %s to be %g, got %g\n", m.Check, value, m.Metric)
+		}
+		if m.ApiKey.Reveal() != "def" || m.TTL != 400 {
+			t.Errorf("Expected the points' API key and TTL, got %+v\n", m)
+		}
+	}
+
+	// The window has been flushed, so points for it are dropped.
+	if !a.Add(Metric{Check: "web1: requests", Metric: 1, at: start.Add(30 * time.Second)}) || a.Late() != 1 {
+		t.Errorf("Expected the late point to be dropped, got %d late\n", a.Late())
+	}
+	if metrics := a.FlushAll(); len(metrics) != 0 {
+		t.Errorf("Expected no windows left, got %+v\n", metrics)
+	}
+}
+
+func TestWindowAlignment(t *testing.T) {
+	boundary := time.Date(2026, 10, 19, 12, 5, 0, 0, time.UTC)
+	now := boundary.Add(-time.Second)
+	a := stoppedAggregator(t, &now, WindowRule{Pattern: "*", Window: "5m"})
+
+	// Points without timestamps go in the window they arrive in, as do
+	// points from the future.
+	a.Add(Metric{Check: "queue", Metric: 1, at: boundary.Add(-time.Nanosecond)})
+	a.Add(Metric{Check: "queue", Metric: 3})
+	a.Add(Metric{Check: "queue", Metric: 5, at: boundary.Add(time.Hour)})
+
+	now = boundary
+	a.Add(Metric{Check: "queue", Metric: 7, at: boundary})
+	a.Add(Metric{Check: "queue", Metric: 9})
+	metrics := a.Flush()
+	if len(metrics) != 1 || metrics[0].Check != "queue" || metrics[0].Metric != 3 || metrics[0].TTL != 600 {
+		t.Errorf("Expected the window ending at 12:05 with the check's own name, got %+v\n", metrics)
+	}
+	if metrics := a.Flush(); len(metrics) != 0 {
+		t.Errorf("Expected the window from 12:05 to still be open, got %+v\n", metrics)
+	}
+	now = boundary.Add(5 * time.Minute)
+	if metrics := a.Flush(); len(metrics) != 1 || metrics[0].Metric != 8 {
+		t.Errorf("Expected the mean of the window from 12:05, got %+v\n", metrics)
+	}
+}
+
+func TestLoadWindowRules(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nudger")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "windows.json")
+
+	ioutil.WriteFile(path, []byte(`[{"pattern": "*: latency", "window": "30s", "lateness": "5s", "aggregates": ["p99"]}]`), 0644)
+	rules, err := LoadWindowRules(path)
+	if err != nil || len(rules) != 1 || rules[0].window != 30*time.Second || rules[0].lateness != 5*time.Second {
+		t.Errorf("Expected the rule to be loaded, got %+v and %v\n", rules, err)
+	}
+
+	invalid := map[string]string{
+		`[{"pattern": "*", "window": "100ms"}]`:                        "at least 1s",
+		`[{"pattern": "*", "window": "1m", "lateness": "soon"}]`:       "bad lateness",
+		`[{"pattern": "*", "window": "1m", "aggregates": ["median"]}]`: "unknown aggregate",
+	}
+	for content, expected := range invalid {
+		ioutil.WriteFile(path, []byte(content), 0644)
+		if _, err := LoadWindowRules(path); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q for %s, got %v\n", expected, content, err)
+		}
+	}
+}
+
+func TestDrainFlushesWindows(t *testing.T) {
+	server := pacemaker.NewFakeServer()
+	defer server.Close()
+
+	metrics := make(chan Metric, 10)
+	for i := 1; i <= 4; i++ {
+		metrics <- Metric{ApiKey: secret.New("def"), Check: "web1: requests", Metric: float64(i), TTL: 400}
+	}
+	metrics <- Metric{ApiKey: secret.New("def"), Check: "deploys", Metric: 1, TTL: 400}
+	finished := make(chan struct{})
+	close(finished)
+
+	now := time.Now()
+	aggregator := stoppedAggregator(t, &now, WindowRule{Pattern: "web*", Window: "1h", Aggregates: []string{"sum"}})
+	config := Config{Pacemaker: server.URL}
+	summary := drainQueue(config, NewPacemakerClient(config), nullEvents{}, aggregator, metrics, finished, 5*time.Second)
+
+	submitted := server.Metrics()
+	if summary.Dispatched != 2 || len(submitted) != 2 {
+		t.Fatalf("Expected the open window and the other metric to be dispatched, got %s and %+v\n", summary, submitted)
+	}
+	for _, m := range submitted {
+		if m.Check == "web1: requests" && m.Metric != 10 {
+			t.Errorf("Expected the sum of the window, got %+v\n", m)
+		}
+	}
+}
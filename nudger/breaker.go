@@ -0,0 +1,348 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BreakerState is the state of a circuit breaker.
+type BreakerState int
+
+const (
+	// BreakerClosed lets requests through.
+	BreakerClosed BreakerState = iota
+	// BreakerOpen refuses requests until its cooldown has passed.
+	BreakerOpen
+	// BreakerHalfOpen lets one trial request through, which closes the
+	// breaker if it succeeds, or opens it again for longer if it fails.
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half_open"
+	}
+	return "closed"
+}
+
+func (s BreakerState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+// Breaker is a circuit breaker for an endpoint, or for a credential used
+// with one.
+type Breaker struct {
+	Scope     string       `json:"scope"`
+	Key       string       `json:"key"`
+	State     BreakerState `json:"state"`
+	Failures  int          `json:"failures"`
+	LastError string       `json:"last_error,omitempty"`
+	OpenedAt  time.Time    `json:"opened_at,omitempty"`
+	RetryAt   time.Time    `json:"retry_at,omitempty"`
+	Refused   uint64       `json:"refused"`
+	// Checks are the checks whose requests have failed or been refused
+	// since the breaker last closed.
+	Checks []string `json:"checks,omitempty"`
+
+	cooldown time.Duration
+	trial    bool
+}
+
+// breakerChecks is how many checks a breaker reports as affected.
+const breakerChecks = 20
+
+func (b *Breaker) affects(check string) {
+	if check == "" || len(b.Checks) >= breakerChecks {
+		return
+	}
+	for _, c := range b.Checks {
+		if c == check {
+			return
+		}
+	}
+	b.Checks = append(b.Checks, check)
+}
+
+// BreakerSet is a circuit breaker for every endpoint sources make requests
+// to, and for every credential they use with each, so that a check with a
+// bad API key or an endpoint that's down isn't retried every interval.
+//
+// It's an http.RoundTripper for sources' HTTP clients. Errors connecting,
+// 5xx and 429 responses count against the endpoint's breaker, and 401 and 403
+// responses against the credential's. After Failures in a row a breaker
+// opens, and requests are refused for Cooldown. Then one trial request is let
+// through: if it fails, the breaker opens again for twice as long, up to
+// MaxCooldown.
+type BreakerSet struct {
+	sync.Mutex
+	Failures    int
+	Cooldown    time.Duration
+	MaxCooldown time.Duration
+	Next        http.RoundTripper
+	Now         func() time.Time
+	breakers    map[string]*Breaker
+}
+
+var Breakers = NewBreakerSet(5, 5*time.Minute, time.Hour)
+
+func NewBreakerSet(failures int, cooldown time.Duration, maxCooldown time.Duration) *BreakerSet {
+	return &BreakerSet{
+		Failures:    failures,
+		Cooldown:    cooldown,
+		MaxCooldown: maxCooldown,
+		Next:        http.DefaultTransport,
+		Now:         time.Now,
+		breakers:    map[string]*Breaker{},
+	}
+}
+
+type breakerCheckKey struct{}
+
+// WithBreakerCheck records in ctx which check requests made with it are for,
+// so breakers can report the checks they affect.
+func WithBreakerCheck(ctx context.Context, check string) context.Context {
+	return context.WithValue(ctx, breakerCheckKey{}, check)
+}
+
+// isCredential is whether a header, query parameter or field called name
+// looks like it holds a credential.
+func isCredential(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"auth", "key", "token", "secret", "password"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// credentialKey identifies the credentials a request carries, without
+// revealing them, or returns "" if it doesn't carry any.
+func credentialKey(req *http.Request) string {
+	credentials := []string{}
+	for name, values := range req.Header {
+		if isCredential(name) {
+			credentials = append(credentials, name+"="+strings.Join(values, ","))
+		}
+	}
+	for name, values := range req.URL.Query() {
+		if isCredential(name) {
+			credentials = append(credentials, "?"+name+"="+strings.Join(values, ","))
+		}
+	}
+	if len(credentials) == 0 {
+		return ""
+	}
+	sort.Strings(credentials)
+	sum := sha1.Sum([]byte(strings.Join(credentials, "\n")))
+	return fmt.Sprintf("%s/%x", req.URL.Host, sum[:4])
+}
+
+func (s *BreakerSet) breaker(scope string, key string) *Breaker {
+	b, ok := s.breakers[scope+" "+key]
+	if !ok {
+		b = &Breaker{Scope: scope, Key: key, cooldown: s.Cooldown}
+		s.breakers[scope+" "+key] = b
+	}
+	return b
+}
+
+// allow returns an error if a breaker refuses a request, and otherwise lets
+// it through, as the trial request if the breaker's cooldown has passed.
+func (s *BreakerSet) allow(b *Breaker, check string, now time.Time) error {
+	switch b.State {
+	case BreakerOpen:
+		if now.Before(b.RetryAt) {
+			break
+		}
+		b.State = BreakerHalfOpen
+		fallthrough
+	case BreakerHalfOpen:
+		if b.trial {
+			break
+		}
+		b.trial = true
+		return nil
+	default:
+		return nil
+	}
+	b.Refused++
+	b.affects(check)
+	return fmt.Errorf("circuit open for %s %s until %s, after: %s", b.Scope, b.Key, b.RetryAt.Format(time.RFC3339), b.LastError)
+}
+
+// release gives up a breaker's trial request without a result, e.g. because
+// it was cancelled, or another breaker refused it.
+func (s *BreakerSet) release(b *Breaker) {
+	b.trial = false
+}
+
+func (s *BreakerSet) succeeded(b *Breaker) {
+	if b.State != BreakerClosed {
+		log.Printf("[info] Breaker: closed for %s %s\n", b.Scope, b.Key)
+	}
+	b.State = BreakerClosed
+	b.Failures = 0
+	b.Checks = nil
+	b.cooldown = s.Cooldown
+	b.trial = false
+}
+
+func (s *BreakerSet) failed(b *Breaker, check string, reason string, now time.Time) {
+	b.Failures++
+	b.LastError = reason
+	b.affects(check)
+	switch {
+	case b.State == BreakerHalfOpen:
+		b.cooldown *= 2
+		if b.cooldown > s.MaxCooldown {
+			b.cooldown = s.MaxCooldown
+		}
+	case b.State == BreakerClosed && b.Failures >= s.Failures:
+		b.OpenedAt = now
+	default:
+		return
+	}
+	b.State = BreakerOpen
+	b.RetryAt = now.Add(b.cooldown)
+	b.trial = false
+	log.Printf("[error] Breaker: opened for %s %s after %d failures, until %s: %s\n", b.Scope, b.Key, b.Failures, b.RetryAt.Format(time.RFC3339), reason)
+}
+
+// RoundTrip makes a request through the breakers for its endpoint and
+// credentials.
+func (s *BreakerSet) RoundTrip(req *http.Request) (*http.Response, error) {
+	check, _ := req.Context().Value(breakerCheckKey{}).(string)
+	breakers := []*Breaker{}
+	s.Lock()
+	endpoint := s.breaker("endpoint", req.URL.Host)
+	breakers = append(breakers, endpoint)
+	var credential *Breaker
+	if key := credentialKey(req); key != "" {
+		credential = s.breaker("credential", key)
+		breakers = append(breakers, credential)
+	}
+	now := s.Now()
+	for i, b := range breakers {
+		if err := s.allow(b, check, now); err != nil {
+			for _, allowed := range breakers[:i] {
+				s.release(allowed)
+			}
+			s.Unlock()
+			return nil, err
+		}
+	}
+	s.Unlock()
+
+	resp, err := s.Next.RoundTrip(req)
+
+	s.Lock()
+	defer s.Unlock()
+	now = s.Now()
+	switch {
+	case err != nil && req.Context().Err() == context.Canceled:
+		// The caller gave up, which says nothing about the endpoint. Timeouts,
+		// including the client's, are the endpoint's fault.
+		for _, b := range breakers {
+			s.release(b)
+		}
+	case err != nil:
+		s.failed(endpoint, check, err.Error(), now)
+		if credential != nil {
+			s.release(credential)
+		}
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		s.failed(endpoint, check, fmt.Sprintf("HTTP %d", resp.StatusCode), now)
+		if credential != nil {
+			s.release(credential)
+		}
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		s.succeeded(endpoint)
+		if credential != nil {
+			s.failed(credential, check, fmt.Sprintf("HTTP %d", resp.StatusCode), now)
+		}
+	default:
+		for _, b := range breakers {
+			s.succeeded(b)
+		}
+	}
+	return resp, err
+}
+
+// Breakers returns a copy of every breaker, sorted by scope and key.
+func (s *BreakerSet) Breakers() []Breaker {
+	s.Lock()
+	defer s.Unlock()
+	breakers := []Breaker{}
+	for _, b := range s.breakers {
+		copied := *b
+		copied.Checks = append([]string(nil), b.Checks...)
+		breakers = append(breakers, copied)
+	}
+	sort.Slice(breakers, func(i, j int) bool {
+		if breakers[i].Scope != breakers[j].Scope {
+			return breakers[i].Scope < breakers[j].Scope
+		}
+		return breakers[i].Key < breakers[j].Key
+	})
+	return breakers
+}
+
+// WritePrometheus writes how many breakers are in each state, and how many
+// requests they've refused, in the Prometheus text format.
+func (s *BreakerSet) WritePrometheus(w io.Writer) {
+	states := map[BreakerState]int{}
+	var refused uint64
+	for _, b := range s.Breakers() {
+		states[b.State]++
+		refused += b.Refused
+	}
+	fmt.Fprintf(w, "# HELP nudger_breakers Circuit breakers for sources' endpoints and credentials, by state.\n")
+	fmt.Fprintf(w, "# TYPE nudger_breakers gauge\n")
+	for _, state := range []BreakerState{BreakerClosed, BreakerOpen, BreakerHalfOpen} {
+		fmt.Fprintf(w, "nudger_breakers{state=%q} %d\n", state, states[state])
+	}
+	fmt.Fprintf(w, "# HELP nudger_breaker_refused_total Requests refused by open circuit breakers.\n")
+	fmt.Fprintf(w, "# TYPE nudger_breaker_refused_total counter\n")
+	fmt.Fprintf(w, "nudger_breaker_refused_total %d\n", refused)
+}
+
+// breakersHandler serves the state of every breaker that isn't closed, or
+// of every breaker with ?all=1. Like the /debug pages, it's only served to
+// requests from localhost, as breakers name the checks they affect.
+func breakersHandler(breakers *BreakerSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		all := r.URL.Query().Get("all") != ""
+		shown := []Breaker{}
+		for _, b := range breakers.Breakers() {
+			if all || b.State != BreakerClosed {
+				shown = append(shown, b)
+			}
+		}
+		body, err := json.MarshalIndent(shown, "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// breakerClient returns a client whose requests go through breakers, and a
+// clock that the breakers use.
+func breakerClient(breakers *BreakerSet) (*http.Client, *time.Time) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	breakers.Now = func() time.Time { return now }
+	return &http.Client{Timeout: time.Second * 5, Transport: breakers}, &now
+}
+
+func TestBreakerOpensOnEndpointFailures(t *testing.T) {
+	requests := 0
+	failing := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if failing {
+			http.Error(w, "oops", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	breakers := NewBreakerSet(3, time.Minute, 3*time.Minute)
+	client, now := breakerClient(breakers)
+	get := func() error {
+		req, _ := http.NewRequestWithContext(WithBreakerCheck(context.Background(), "example"), "GET", server.URL, nil)
+		resp, err := client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	for i := 0; i < 5; i++ {
+		get()
+	}
+	if requests != 3 {
+		t.Errorf("Expected requests to stop after 3 failures, got %d\n", requests)
+	}
+	err := get()
+	if err == nil || !strings.Contains(err.Error(), "circuit open for endpoint") {
+		t.Errorf("Expected the request to be refused, got %v\n", err)
+	}
+	b := breakers.Breakers()[0]
+	if b.State != BreakerOpen || b.Refused != 3 || len(b.Checks) != 1 || b.Checks[0] != "example" {
+		t.Errorf("Expected an open breaker affecting the check, got %+v\n", b)
+	}
+
+	// After the cooldown, a trial request fails and the cooldown doubles.
+	*now = now.Add(time.Minute)
+	get()
+	if requests != 4 {
+		t.Errorf("Expected a trial request after the cooldown, got %d requests\n", requests)
+	}
+	*now = now.Add(time.Minute)
+	get()
+	if requests != 4 || breakers.Breakers()[0].RetryAt != now.Add(time.Minute) {
+		t.Errorf("Expected the cooldown to double, got %+v after %d requests\n", breakers.Breakers()[0], requests)
+	}
+
+	// A successful trial closes it.
+	failing = false
+	*now = now.Add(time.Minute)
+	if err := get(); err != nil {
+		t.Errorf("Unexpected error: %s\n", err)
+	}
+	get()
+	if requests != 6 || breakers.Breakers()[0].State != BreakerClosed {
+		t.Errorf("Expected the breaker to close, got %+v after %d requests\n", breakers.Breakers()[0], requests)
+	}
+}
+
+func TestBreakerPerCredential(t *testing.T) {
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-Api-Key")
+		requests[key]++
+		if key != "good" {
+			http.Error(w, "invalid API key", http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	breakers := NewBreakerSet(2, time.Minute, time.Hour)
+	client, _ := breakerClient(breakers)
+	get := func(key string) {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		req.Header.Set("X-Api-Key", key)
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		get("bad")
+		get("good")
+	}
+	if requests["bad"] != 2 || requests["good"] != 4 {
+		t.Errorf("Expected only the bad key's requests to stop, got %+v\n", requests)
+	}
+
+	open := map[string]int{}
+	for _, b := range breakers.Breakers() {
+		if strings.Contains(b.Key, "bad") || strings.Contains(b.Key, "good") {
+			t.Errorf("Expected credentials not to appear in breaker keys, got %s\n", b.Key)
+		}
+		if b.State == BreakerOpen {
+			open[b.Scope]++
+		}
+	}
+	if open["endpoint"] != 0 || open["credential"] != 1 {
+		t.Errorf("Expected just the bad credential's breaker to open, got %+v\n", breakers.Breakers())
+	}
+}
+
+func TestCredentialKey(t *testing.T) {
+	req, _ := http.NewRequest("GET", "https://example.org/metrics?api_key=abc&page=2", nil)
+	withKey := credentialKey(req)
+	req.URL, _ = url.Parse("https://example.org/metrics?page=2")
+	if withKey == "" || credentialKey(req) != "" {
+		t.Errorf("Expected a key only with credentials, got %q and %q\n", withKey, credentialKey(req))
+	}
+	req.SetBasicAuth("user", "password")
+	if key := credentialKey(req); !strings.HasPrefix(key, "example.org/") {
+		t.Errorf("Expected basic auth to be a credential for example.org, got %q\n", key)
+	}
+}
+
+func TestBreakerOpensOnTimeouts(t *testing.T) {
+	hung := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-hung:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(hung)
+
+	breakers := NewBreakerSet(3, time.Minute, 3*time.Minute)
+	client, _ := breakerClient(breakers)
+	client.Timeout = 20 * time.Millisecond
+	for i := 0; i < 6; i++ {
+		if resp, err := client.Get(server.URL); err == nil {
+			resp.Body.Close()
+		}
+	}
+	if b := breakers.Breakers()[0]; b.State != BreakerOpen || b.Refused != 3 {
+		t.Errorf("Expected timeouts to open the breaker, got %+v\n", b)
+	}
+
+	// Requests the caller cancels don't count against the endpoint.
+	breakers = NewBreakerSet(3, time.Minute, 3*time.Minute)
+	client, _ = breakerClient(breakers)
+	for i := 0; i < 6; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+		time.AfterFunc(10*time.Millisecond, cancel)
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+	if b := breakers.Breakers()[0]; b.State != BreakerClosed || b.Failures != 0 {
+		t.Errorf("Expected cancelled requests not to count, got %+v\n", b)
+	}
+}
+
+func TestBreakersHandlerOnlyForLocalhost(t *testing.T) {
+	handler := breakersHandler(NewBreakerSet(3, time.Minute, 3*time.Minute))
+	for addr, expected := range map[string]int{"192.0.2.1:1234": http.StatusForbidden, "127.0.0.1:1234": http.StatusOK, "[::1]:1234": http.StatusOK} {
+		r := httptest.NewRequest("GET", "/breakers", nil)
+		r.RemoteAddr = addr
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Code != expected {
+			t.Errorf("Expected %d for %s, got %d\n", expected, addr, w.Code)
+		}
+	}
+}
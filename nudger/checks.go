@@ -0,0 +1,517 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/radalert/layer4/secret"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// errCursorExpired is returned when the changes feed no longer has changes
+// since our cursor, and every check has to be fetched again.
+var errCursorExpired = errors.New("changes cursor expired")
+
+// checksPage is a page of the checks list as last fetched, kept so it can be
+// fetched conditionally next time.
+type checksPage struct {
+	ETag         string
+	LastModified string
+	Checks       []Check
+	Next         string
+	Cursor       string
+}
+
+// CheckChange is an entry in the changes feed: a check that's been created or
+// updated, or deleted.
+type CheckChange struct {
+	ID      string `json:"id"`
+	Deleted bool   `json:"deleted"`
+	Check   Check  `json:"check"`
+}
+
+// CheckChanges is a response from the changes feed.
+type CheckChanges struct {
+	Cursor  string        `json:"cursor"`
+	Changes []CheckChange `json:"changes"`
+}
+
+// ChecksFetcher fetches the checks to poll from the console API, without
+// downloading them again when they haven't changed.
+//
+// The checks list is fetched conditionally, with the ETag and Last-Modified
+// of each page, following Link rel="next" headers to the next page. If
+// config.Changes is set and the list came with an X-Changes-Cursor header,
+// later fetches only ask the changes feed for what's changed since the
+// cursor, until the feed says the cursor has expired.
+type ChecksFetcher struct {
+	Config Config
+	pages  map[string]checksPage
+	checks []Check
+	cursor string
+}
+
+func NewChecksFetcher(config Config) *ChecksFetcher {
+	return &ChecksFetcher{Config: config, pages: map[string]checksPage{}}
+}
+
+// Fetch returns the checks, and whether they've changed since the last fetch.
+func (f *ChecksFetcher) Fetch(ctx context.Context) ([]Check, bool, error) {
+	if f.Config.Changes != "" && f.cursor != "" {
+		changed, err := f.fetchChanges(ctx)
+		if err == nil {
+			return f.checks, changed, nil
+		}
+		if err != errCursorExpired {
+			return nil, false, err
+		}
+		Logf(ctx, "[info] FetchChecks: %s, fetching every check\n", err)
+		f.cursor = ""
+	}
+	return f.fetchAll(ctx)
+}
+
+func (f *ChecksFetcher) fetchAll(ctx context.Context) ([]Check, bool, error) {
+	pages := map[string]checksPage{}
+	checks := []Check{}
+	changed := f.checks == nil || len(f.pages) == 0
+	cursor := ""
+	for next := f.Config.Api; next != ""; {
+		if _, ok := pages[next]; ok {
+			return nil, false, fmt.Errorf("pages of checks loop back to %s", next)
+		}
+		page, modified, err := f.fetchPage(ctx, next)
+		if err != nil {
+			return nil, false, err
+		}
+		changed = changed || modified
+		pages[next] = page
+		checks = append(checks, page.Checks...)
+		if page.Cursor != "" {
+			cursor = page.Cursor
+		}
+		next = page.Next
+	}
+	// A page that's gone away changes the list too.
+	changed = changed || len(pages) != len(f.pages)
+
+	f.pages = pages
+	f.cursor = cursor
+	if changed {
+		f.checks = checks
+	}
+	return f.checks, changed, nil
+}
+
+// fetchPage fetches a page of the checks list, returning the copy from last
+// time if it hasn't been modified.
+func (f *ChecksFetcher) fetchPage(ctx context.Context, page string) (checksPage, bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", page, nil)
+	if err != nil {
+		return checksPage{}, false, fmt.Errorf("new request: %s", err)
+	}
+	req.SetBasicAuth(f.Config.MasterApiKey.Reveal(), "")
+	cached, ok := f.pages[page]
+	if ok && cached.ETag != "" {
+		req.Header.Set("If-None-Match", cached.ETag)
+	}
+	if ok && cached.LastModified != "" {
+		req.Header.Set("If-Modified-Since", cached.LastModified)
+	}
+
+	Tracef(ctx, "GET %s", page)
+	client := &http.Client{Timeout: f.Config.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return checksPage{}, false, fmt.Errorf("client do: %s", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		Tracef(ctx, "HTTP 304, not modified")
+		if !ok {
+			return checksPage{}, false, fmt.Errorf("HTTP 304 from %s, with no copy to reuse", page)
+		}
+		return cached, false, nil
+	default:
+		return checksPage{}, false, responseError(resp)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return checksPage{}, false, fmt.Errorf("couldn't read body: %s", err)
+	}
+	Tracef(ctx, "HTTP %d, %d bytes", resp.StatusCode, len(body))
+
+	fetched := checksPage{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Next:         nextLink(resp),
+		Cursor:       resp.Header.Get("X-Changes-Cursor"),
+	}
+	if err := json.Unmarshal(body, &fetched.Checks); err != nil {
+		return checksPage{}, false, fmt.Errorf("couldn't decode checks: %s: response body: %s", err, truncate(string(body), 512))
+	}
+	return fetched, true, nil
+}
+
+// fetchChanges applies the changes since the cursor to the checks, returning
+// whether there were any.
+func (f *ChecksFetcher) fetchChanges(ctx context.Context) (bool, error) {
+	feed, err := url.Parse(f.Config.Changes)
+	if err != nil {
+		return false, fmt.Errorf("couldn't parse changes feed URL: %s", err)
+	}
+	query := feed.Query()
+	query.Set("since", f.cursor)
+	feed.RawQuery = query.Encode()
+
+	changes := []CheckChange{}
+	cursor := f.cursor
+	seen := map[string]bool{}
+	for next := feed.String(); next != ""; {
+		if seen[next] {
+			return false, fmt.Errorf("pages of changes loop back to %s", next)
+		}
+		seen[next] = true
+		req, err := http.NewRequestWithContext(ctx, "GET", next, nil)
+		if err != nil {
+			return false, fmt.Errorf("new request: %s", err)
+		}
+		req.SetBasicAuth(f.Config.MasterApiKey.Reveal(), "")
+
+		Tracef(ctx, "GET %s", next)
+		client := &http.Client{Timeout: f.Config.Timeout}
+		resp, err := client.Do(req)
+		if err != nil {
+			return false, fmt.Errorf("client do: %s", err)
+		}
+		page, err := decodeChanges(resp)
+		resp.Body.Close()
+		if err != nil {
+			return false, err
+		}
+		changes = append(changes, page.Changes...)
+		if page.Cursor != "" {
+			cursor = page.Cursor
+		}
+		next = nextLink(resp)
+	}
+
+	f.cursor = cursor
+	if len(changes) == 0 {
+		return false, nil
+	}
+	Tracef(ctx, "applying %d changes", len(changes))
+	f.checks = ApplyCheckChanges(f.checks, changes)
+	// The pages no longer match the checks, so don't reuse them.
+	f.pages = map[string]checksPage{}
+	return true, nil
+}
+
+func decodeChanges(resp *http.Response) (CheckChanges, error) {
+	var changes CheckChanges
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		return changes, errCursorExpired
+	default:
+		return changes, responseError(resp)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return changes, fmt.Errorf("couldn't read body: %s", err)
+	}
+	if err := json.Unmarshal(body, &changes); err != nil {
+		return changes, fmt.Errorf("couldn't decode changes: %s: response body: %s", err, truncate(string(body), 512))
+	}
+	return changes, nil
+}
+
+// ApplyCheckChanges returns checks with changes applied, by check ID. The
+// checks passed in are left as they are, as they may still be being polled.
+func ApplyCheckChanges(checks []Check, changes []CheckChange) []Check {
+	applied := make([]Check, len(checks))
+	copy(applied, checks)
+	for _, change := range changes {
+		i := 0
+		for i < len(applied) && applied[i].ID != change.ID {
+			i++
+		}
+		switch {
+		case change.Deleted && i < len(applied):
+			applied = append(applied[:i], applied[i+1:]...)
+		case change.Deleted:
+		case i < len(applied):
+			change.Check.ID = change.ID
+			applied[i] = change.Check
+		default:
+			change.Check.ID = change.ID
+			applied = append(applied, change.Check)
+		}
+	}
+	return applied
+}
+
+// nextLink returns the URL of the next page from a response's Link headers,
+// or "" if it's the last page.
+func nextLink(resp *http.Response) string {
+	for _, header := range resp.Header.Values("Link") {
+		for _, link := range strings.Split(header, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.TrimSpace(parts[0])
+			if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+				continue
+			}
+			for _, param := range parts[1:] {
+				name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+				if !ok || strings.ToLower(name) != "rel" {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(value, `"`)) {
+					if strings.ToLower(rel) != "next" {
+						continue
+					}
+					next, err := resp.Request.URL.Parse(target[1 : len(target)-1])
+					if err != nil {
+						return ""
+					}
+					return next.String()
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// responseError describes an unexpected response, without trying to decode it.
+func responseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("HTTP %d from %s: %s", resp.StatusCode, resp.Request.URL, strings.TrimSpace(string(body)))
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// CheckSet is the checks nudger polls, shared between fetching them, pushes
+// from the console, and polling.
+type CheckSet struct {
+	sync.RWMutex
+	checks []Check
+}
+
+// All returns the checks. The slice returned isn't changed afterwards, so it
+// can be polled while the set is updated.
+func (s *CheckSet) All() []Check {
+	s.RLock()
+	defer s.RUnlock()
+	return s.checks
+}
+
+// Replace replaces every check, e.g. with a fresh fetch from the console.
+func (s *CheckSet) Replace(checks []Check) {
+	s.Lock()
+	defer s.Unlock()
+	s.checks = checks
+}
+
+// Apply applies changes to the checks by ID, returning how many checks there
+// are afterwards.
+func (s *CheckSet) Apply(changes []CheckChange) int {
+	s.Lock()
+	defer s.Unlock()
+	s.checks = ApplyCheckChanges(s.checks, changes)
+	return len(s.checks)
+}
+
+// CheckEvent is a check being created, updated or deleted in the console,
+// pushed to nudger's /checks/events.
+type CheckEvent struct {
+	Event string `json:"event"`
+	ID    string `json:"id"`
+	Check Check  `json:"check"`
+}
+
+// checkEventsHandler applies check events pushed by the console to checks,
+// authenticated with apikey. The body is a single event, or a list of them.
+// PollChecks still fetches every check each interval, which puts right any
+// event that's missed or arrives out of order.
+func checkEventsHandler(checks *CheckSet, apikey secret.Secret) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key, _, _ := r.BasicAuth(); !apikey.Equal(key) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 10<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var events []CheckEvent
+		if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+			err = json.Unmarshal(body, &events)
+		} else {
+			events = make([]CheckEvent, 1)
+			err = json.Unmarshal(body, &events[0])
+		}
+		if err != nil {
+			http.Error(w, fmt.Sprintf("couldn't decode events: %s", err), http.StatusBadRequest)
+			return
+		}
+
+		changes := []CheckChange{}
+		for _, e := range events {
+			if e.ID == "" {
+				http.Error(w, "event without an id", http.StatusBadRequest)
+				return
+			}
+			switch e.Event {
+			case "create", "update":
+				changes = append(changes, CheckChange{ID: e.ID, Check: e.Check})
+			case "delete":
+				changes = append(changes, CheckChange{ID: e.ID, Deleted: true})
+			default:
+				http.Error(w, fmt.Sprintf("unknown event %q for check %s", e.Event, e.ID), http.StatusBadRequest)
+				return
+			}
+		}
+		n := checks.Apply(changes)
+		log.Printf("[info] CheckEvents: applied %d events, %d checks\n", len(changes), n)
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// Validate returns an error describing everything wrong with a check's
+// configuration, or nil if its source has what it needs to poll it.
+func (c Check) Validate() error {
+	problems := []string{}
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+	validURL := func() {
+		u, err := url.Parse(c.URL)
+		if c.URL == "" {
+			problem("no url")
+		} else if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problem("url %q isn't an http or https URL", c.URL)
+		}
+	}
+	validAddress := func() {
+		if _, port, err := net.SplitHostPort(c.Address); err != nil || port == "" {
+			problem("address %q isn't a host:port", c.Address)
+		}
+	}
+
+	if _, ok := sources[c.Type]; !ok {
+		problem("unknown type %q", c.Type)
+	}
+	if c.ApiKey.IsZero() {
+		problem("no api_key")
+	}
+	if c.Timeout < 0 {
+		problem("timeout %g is negative", c.Timeout)
+	}
+	switch c.Type {
+	case "", "new_relic":
+		if c.NRAppId <= 0 {
+			problem("no nr_app_id")
+		}
+		if c.NRApiKey.IsZero() {
+			problem("no nr_api_key")
+		}
+	case "http_json":
+		validURL()
+		if len(c.Paths) == 0 {
+			problem("no paths")
+		}
+		for _, p := range c.Paths {
+			if _, err := parsePath(p.Path); err != nil {
+				problem("path %q: %s", p.Path, err)
+			}
+			if p.Metric == "" {
+				problem("path %q has no metric", p.Path)
+			}
+		}
+	case "http_probe":
+		validURL()
+		for _, e := range c.Expect {
+			if strings.TrimSpace(e) == "" {
+				problem("expect %q would match any body", e)
+			}
+		}
+	case "prometheus":
+		validURL()
+		for _, s := range c.Series {
+			if _, err := ParsePromSelector(s); err != nil {
+				problem("series %q: %s", s, err)
+			}
+		}
+		for _, q := range c.Quantiles {
+			if q <= 0 || q >= 1 {
+				problem("quantile %g isn't between 0 and 1", q)
+			}
+		}
+	case "tcp", "tls":
+		validAddress()
+	case "dns":
+		if c.Hostname == "" {
+			problem("no hostname")
+		}
+	case "log":
+		if c.File == "" {
+			problem("no file")
+		}
+		if len(c.Patterns) == 0 {
+			problem("no patterns")
+		}
+		for _, p := range c.Patterns {
+			if _, err := regexp.Compile(p.Regexp); err != nil {
+				problem("pattern %q: %s", p.Regexp, err)
+			}
+			if p.Metric == "" {
+				problem("pattern %q has no metric", p.Regexp)
+			}
+		}
+	case "sql":
+		if c.Name == "" {
+			problem("no name")
+		}
+		if c.Driver == "" {
+			problem("no driver")
+		} else if !sqlDriverRegistered(c.Driver) {
+			problem("unknown driver %q, expected one of %s", c.Driver, strings.Join(sql.Drivers(), ", "))
+		}
+		if c.DSN == "" {
+			problem("no dsn")
+		}
+		if err := CheckReadOnlyQuery(c.Query); err != nil {
+			problem("query: %s", err)
+		}
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
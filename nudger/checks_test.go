@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/radalert/layer4/secret"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchChecksConditionally(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		json.NewEncoder(w).Encode([]Check{Check{Type: "tcp", Address: "example.com:80"}})
+	}))
+	defer server.Close()
+
+	fetcher := NewChecksFetcher(Config{Api: server.URL, Timeout: 5 * time.Second})
+	checks, changed, err := fetcher.Fetch(context.Background())
+	if err != nil || !changed || len(checks) != 1 {
+		t.Fatalf("Expected 1 check on first fetch, got %+v, %t, %v\n", checks, changed, err)
+	}
+	checks, changed, err = fetcher.Fetch(context.Background())
+	if err != nil || changed || len(checks) != 1 || checks[0].Address != "example.com:80" {
+		t.Errorf("Expected unchanged checks after 304, got %+v, %t, %v\n", checks, changed, err)
+	}
+	if requests != 2 {
+		t.Errorf("Expected 2 requests, got %d\n", requests)
+	}
+}
+
+func TestFetchChecksPaginated(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("page") {
+		case "":
+			w.Header().Set("Link", `</checks?page=2>; rel="next", </checks?page=2>; rel="last"`)
+			json.NewEncoder(w).Encode([]Check{Check{Address: "one:80"}})
+		case "2":
+			json.NewEncoder(w).Encode([]Check{Check{Address: "two:80"}, Check{Address: "three:80"}})
+		}
+	}))
+	defer server.Close()
+
+	fetcher := NewChecksFetcher(Config{Api: server.URL + "/checks", Timeout: 5 * time.Second})
+	checks, _, err := fetcher.Fetch(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if len(checks) != 3 || checks[0].Address != "one:80" || checks[2].Address != "three:80" {
+		t.Errorf("Expected checks from both pages, got %+v\n", checks)
+	}
+}
+
+func TestFetchChecksErrorResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte("<html><body>Bad Gateway</body></html>"))
+	}))
+	defer server.Close()
+
+	fetcher := NewChecksFetcher(Config{Api: server.URL, Timeout: 5 * time.Second})
+	_, _, err := fetcher.Fetch(context.Background())
+	if err == nil || !strings.HasPrefix(err.Error(), "HTTP 502") {
+		t.Errorf("Expected an HTTP 502 error, got %v\n", err)
+	}
+}
+
+func TestFetchChecksChanges(t *testing.T) {
+	full := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/checks":
+			full++
+			w.Header().Set("X-Changes-Cursor", "c1")
+			json.NewEncoder(w).Encode([]Check{
+				Check{ID: "1", Address: "one:80"},
+				Check{ID: "2", Address: "two:80"},
+			})
+		case "/changes":
+			switch r.URL.Query().Get("since") {
+			case "c1":
+				json.NewEncoder(w).Encode(CheckChanges{Cursor: "c2", Changes: []CheckChange{
+					CheckChange{ID: "1", Deleted: true},
+					CheckChange{ID: "2", Check: Check{Address: "two:443"}},
+					CheckChange{ID: "3", Check: Check{Address: "three:80"}},
+				}})
+			case "c2":
+				json.NewEncoder(w).Encode(CheckChanges{Cursor: "c2"})
+			default:
+				w.WriteHeader(http.StatusGone)
+			}
+		}
+	}))
+	defer server.Close()
+
+	fetcher := NewChecksFetcher(Config{Api: server.URL + "/checks", Changes: server.URL + "/changes", Timeout: 5 * time.Second})
+	if _, _, err := fetcher.Fetch(context.Background()); err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	checks, changed, err := fetcher.Fetch(context.Background())
+	if err != nil || !changed {
+		t.Fatalf("Expected changes, got %t, %v\n", changed, err)
+	}
+	if len(checks) != 2 || checks[0].ID != "2" || checks[0].Address != "two:443" || checks[1].ID != "3" {
+		t.Errorf("Expected changes to be applied, got %+v\n", checks)
+	}
+	if _, changed, _ := fetcher.Fetch(context.Background()); changed {
+		t.Errorf("Expected no changes since c2\n")
+	}
+
+	// An expired cursor falls back to fetching every check.
+	fetcher.cursor = "c0"
+	checks, changed, err = fetcher.Fetch(context.Background())
+	if err != nil || !changed || len(checks) != 2 || checks[0].ID != "1" || full != 2 {
+		t.Errorf("Expected every check fetched again, got %+v, %t, %v after %d fetches\n", checks, changed, err, full)
+	}
+}
+
+func TestCheckEvents(t *testing.T) {
+	checks := &CheckSet{}
+	checks.Replace([]Check{Check{ID: "1", Address: "one:80"}, Check{ID: "2", Address: "two:80"}})
+	before := checks.All()
+	server := httptest.NewServer(checkEventsHandler(checks, secret.New("r4d4l3rt")))
+	defer server.Close()
+
+	post := func(apikey string, body string) int {
+		req, _ := http.NewRequest("POST", server.URL, strings.NewReader(body))
+		req.SetBasicAuth(apikey, "")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Unexpected error: %s\n", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := post("wrong", `{"event": "delete", "id": "1"}`); code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 with the wrong API key, got %d\n", code)
+	}
+	if code := post("r4d4l3rt", `{"event": "rename", "id": "1"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown event, got %d\n", code)
+	}
+	if len(checks.All()) != 2 {
+		t.Errorf("Expected rejected events not to be applied, got %+v\n", checks.All())
+	}
+
+	if code := post("r4d4l3rt", `{"event": "create", "id": "3", "check": {"type": "tcp", "address": "three:80"}}`); code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d\n", code)
+	}
+	code := post("r4d4l3rt", `[
+		{"event": "delete", "id": "1"},
+		{"event": "update", "id": "2", "check": {"type": "tcp", "address": "two:443"}}
+	]`)
+	if code != http.StatusNoContent {
+		t.Errorf("Expected 204, got %d\n", code)
+	}
+
+	after := checks.All()
+	if len(after) != 2 || after[0].Address != "two:443" || after[1].ID != "3" || after[1].Address != "three:80" {
+		t.Errorf("Expected events to be applied, got %+v\n", after)
+	}
+	if len(before) != 2 || before[0].ID != "1" {
+		t.Errorf("Expected checks being polled to be left as they were, got %+v\n", before)
+	}
+}
+
+func TestCheckValidate(t *testing.T) {
+	key := secret.New("def")
+	valid := []Check{
+		Check{NRAppId: 123, NRApiKey: secret.New("abc"), ApiKey: key},
+		Check{Type: "http_json", URL: "https://example.org/stats", Paths: []JSONPath{JSONPath{Path: "stats.requests", Metric: "requests"}}, ApiKey: key},
+		Check{Type: "http_probe", URL: "https://example.org/health", Expect: []string{"ok"}, ApiKey: key},
+		Check{Type: "prometheus", URL: "http://localhost:9100/metrics", Series: []string{`http_requests_total{code="500"}`}, Quantiles: []float64{0.99}, ApiKey: key},
+		Check{Type: "tcp", Address: "example.org:443", ApiKey: key},
+		Check{Type: "log", File: "/var/log/app.log", Patterns: []LogPattern{LogPattern{Regexp: "ERROR", Metric: "errors"}}, ApiKey: key},
+		Check{Type: "sql", Name: "orders", Driver: "postgres", DSN: "orders", Query: "SELECT count(*) FROM orders", ApiKey: key},
+	}
+	for _, c := range valid {
+		if err := c.Validate(); err != nil {
+			t.Errorf("Expected %s check to be valid, got %s\n", c.Type, err)
+		}
+	}
+
+	invalid := map[string]Check{
+		"no api_key":           Check{Type: "tcp", Address: "example.org:443"},
+		"no nr_app_id":         Check{NRApiKey: secret.New("abc"), ApiKey: key},
+		"unknown type":         Check{Type: "ftp", ApiKey: key},
+		"isn't an http":        Check{Type: "http_probe", URL: "example.org", ApiKey: key},
+		"would match any body": Check{Type: "http_probe", URL: "https://example.org", Expect: []string{"ok", " "}, ApiKey: key},
+		"between 0 and 1":      Check{Type: "prometheus", URL: "https://example.org", Quantiles: []float64{99}, ApiKey: key},
+		"path \"queues[x]\"":   Check{Type: "http_json", URL: "https://example.org", Paths: []JSONPath{JSONPath{Path: "queues[x]", Metric: "depth"}}, ApiKey: key},
+		"isn't a host:port":    Check{Type: "tls", Address: "example.org", ApiKey: key},
+		"pattern \"(\"":        Check{Type: "log", File: "/var/log/app.log", Patterns: []LogPattern{LogPattern{Regexp: "(", Metric: "errors"}}, ApiKey: key},
+		"only SELECT queries":  Check{Type: "sql", Name: "orders", Driver: "postgres", DSN: "orders", Query: "DELETE FROM orders", ApiKey: key},
+	}
+	for expected, c := range invalid {
+		if err := c.Validate(); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected %q, got %v\n", expected, err)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/radalert/layer4/secret"
+	"gopkg.in/alecthomas/kingpin.v1"
+	"io"
+	"io/ioutil"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Commands for operators, instead of polling checks. Flags like --api and
+// --pacemaker go before the command, e.g. nudger --pacemaker=... send ...
+var (
+	checksCommand = kingpin.Command("checks", "Fetch checks from the console's API.")
+	checksAction  = checksCommand.Arg("action", "What to do with them: list.").Required().Enum("list")
+
+	pollCommand = kingpin.Command("poll", "Poll a check once, and print the metrics it would send to Pacemaker.")
+	pollCheck   = pollCommand.Flag("check", "ID of the check to poll, or its URL, address, hostname, file or name.").Required().String()
+	pollFile    = pollCommand.Flag("file", "Checks file to find the check in, instead of fetching checks from the console.").String()
+	pollSend    = pollCommand.Flag("send", "Send the metrics to Pacemaker too.").Bool()
+
+	validateCommand = kingpin.Command("validate", "Validate a checks file.")
+	validateFile    = validateCommand.Arg("file", "Checks file: a JSON list of checks, like the console's API returns.").Required().String()
+
+	sendCommand = kingpin.Command("send", "Submit a metric to Pacemaker, with the API key in METRIC_APIKEY.")
+	sendCheck   = sendCommand.Flag("check", "Check to submit the metric for.").Required().String()
+	sendValue   = sendCommand.Flag("metric", "Value of the metric.").Required().Float()
+	sendTTL     = sendCommand.Flag("ttl", "Seconds the metric is good for.").Default("400").Int()
+	sendTags    = sendCommand.Flag("tag", "Tag for the metric (repeatable).").Strings()
+)
+
+// RunCommand runs an operator's command, writing what it finds to out.
+func RunCommand(command string, config Config, out io.Writer) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	switch command {
+	case "checks":
+		return ListChecks(ctx, config, out)
+	case "poll":
+		return PollOnce(ctx, config, out, *pollCheck, *pollFile, *pollSend)
+	case "validate":
+		return ValidateChecksFile(out, *validateFile)
+	case "send":
+		apikey, err := secret.Load("METRIC_APIKEY")
+		if err != nil {
+			return err
+		}
+		metric := Metric{ApiKey: apikey, Check: *sendCheck, Metric: *sendValue, TTL: *sendTTL, Tags: *sendTags}
+		return SendMetric(ctx, config, out, metric)
+	}
+	return fmt.Errorf("unknown command %q", command)
+}
+
+// loadChecks reads checks from a checks file, or else fetches them from the
+// console's API, with the API key in APIKEY.
+func loadChecks(ctx context.Context, config Config, file string) ([]Check, error) {
+	if file != "" {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		checks := []Check{}
+		if err := json.Unmarshal(b, &checks); err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		return checks, nil
+	}
+	if config.MasterApiKey.IsZero() {
+		apikey, err := secret.Load("APIKEY")
+		if err != nil {
+			return nil, err
+		}
+		config.MasterApiKey = apikey
+	}
+	checks, _, err := NewChecksFetcher(config).Fetch(ctx)
+	return checks, err
+}
+
+// ListChecks prints the checks the console's API returns.
+func ListChecks(ctx context.Context, config Config, out io.Writer) error {
+	checks, err := loadChecks(ctx, config, "")
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tTARGET\tTAGS")
+	for _, c := range checks {
+		source := c.Type
+		if source == "" {
+			source = "new_relic"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", c.ID, source, checkTarget(c), strings.Join(c.Tags, ","))
+	}
+	w.Flush()
+	fmt.Fprintf(out, "%d checks\n", len(checks))
+	return nil
+}
+
+// findCheck finds the check with an ID, or failing that, the only check for
+// a target.
+func findCheck(checks []Check, id string) (Check, error) {
+	matched := []Check{}
+	for _, c := range checks {
+		if c.ID != "" && c.ID == id {
+			return c, nil
+		}
+		if checkTarget(c) == id {
+			matched = append(matched, c)
+		}
+	}
+	switch len(matched) {
+	case 0:
+		return Check{}, fmt.Errorf("no check %s", id)
+	case 1:
+		return matched[0], nil
+	}
+	return Check{}, fmt.Errorf("%d checks for %s, so use an ID", len(matched), id)
+}
+
+// PollOnce polls a check once, and prints the metrics it emits, submitting
+// them to Pacemaker too if send is set. Sources that report changes since
+// their last poll have nothing to compare with, so they emit less than
+// they would while running.
+func PollOnce(ctx context.Context, config Config, out io.Writer, id string, file string, send bool) error {
+	checks, err := loadChecks(ctx, config, file)
+	if err != nil {
+		return err
+	}
+	check, err := findCheck(checks, id)
+	if err != nil {
+		return err
+	}
+	if err := check.Validate(); err != nil {
+		return fmt.Errorf("check %s: %s", id, err)
+	}
+
+	metrics := make(chan Metric)
+	polled := []Metric{}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for m := range metrics {
+			polled = append(polled, m)
+		}
+	}()
+	Poll(ctx, check, metrics)
+	close(metrics)
+	<-done
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tMETRIC\tTTL\tTAGS")
+	for _, m := range polled {
+		fmt.Fprintf(w, "%s\t%g\t%d\t%s\n", m.Check, m.Metric, m.TTL, strings.Join(m.Tags, ","))
+	}
+	w.Flush()
+	if len(polled) == 0 {
+		return fmt.Errorf("polling %s emitted no metrics", checkTarget(check))
+	}
+	if !send {
+		return nil
+	}
+	client := NewPacemakerClient(config)
+	for _, m := range polled {
+		if err := client.SubmitMetric(ctx, m.submission()); err != nil {
+			return fmt.Errorf("sending %s: %s", m.Check, err)
+		}
+	}
+	fmt.Fprintf(out, "sent %d metrics to %s\n", len(polled), config.Pacemaker)
+	return nil
+}
+
+// ValidateChecksFile prints what's wrong with each check in a checks file,
+// and returns an error if anything is.
+func ValidateChecksFile(out io.Writer, file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.DisallowUnknownFields()
+	checks := []Check{}
+	if err := decoder.Decode(&checks); err != nil {
+		return fmt.Errorf("%s: %s", file, err)
+	}
+
+	invalid := 0
+	ids := map[string]int{}
+	for i, c := range checks {
+		name := fmt.Sprintf("check %d (%s)", i+1, checkTarget(c))
+		if c.ID != "" {
+			name = fmt.Sprintf("check %d (%s)", i+1, c.ID)
+			if first, ok := ids[c.ID]; ok {
+				fmt.Fprintf(out, "%s: same ID as check %d\n", name, first)
+				invalid++
+				continue
+			}
+			ids[c.ID] = i + 1
+		}
+		if err := c.Validate(); err != nil {
+			fmt.Fprintf(out, "%s: %s\n", name, err)
+			invalid++
+		}
+	}
+	if invalid > 0 {
+		return fmt.Errorf("%d of %d checks in %s are invalid", invalid, len(checks), file)
+	}
+	fmt.Fprintf(out, "%d checks in %s are valid\n", len(checks), file)
+	return nil
+}
+
+// SendMetric submits a metric to Pacemaker.
+func SendMetric(ctx context.Context, config Config, out io.Writer, metric Metric) error {
+	if err := NewPacemakerClient(config).SubmitMetric(ctx, metric.submission()); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "sent %s = %g to %s\n", metric.Check, metric.Metric, config.Pacemaker)
+	return nil
+}
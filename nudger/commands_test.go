@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/radalert/layer4/pacemaker"
+	"github.com/radalert/layer4/secret"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeChecksFile(t *testing.T, dir string, content string) string {
+	path := filepath.Join(dir, "checks.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatalf("Couldn't write checks file: %s\n", err)
+	}
+	return path
+}
+
+func TestValidateChecksFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nudger")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var out bytes.Buffer
+	path := writeChecksFile(t, dir, `[{"id": "a", "type": "tcp", "address": "example.org:443", "api_key": "def"}]`)
+	if err := ValidateChecksFile(&out, path); err != nil || !strings.Contains(out.String(), "1 checks") {
+		t.Errorf("Expected the file to be valid, got %v and %q\n", err, out.String())
+	}
+
+	out.Reset()
+	path = writeChecksFile(t, dir, `[
+		{"id": "a", "type": "tcp", "address": "example.org:443", "api_key": "def"},
+		{"id": "a", "type": "tcp", "address": "example.org:80", "api_key": "def"},
+		{"id": "b", "type": "dns", "api_key": "def"}
+	]`)
+	err = ValidateChecksFile(&out, path)
+	if err == nil || !strings.Contains(err.Error(), "2 of 3") {
+		t.Errorf("Expected 2 invalid checks, got %v\n", err)
+	}
+	if !strings.Contains(out.String(), "check 2 (a): same ID as check 1") || !strings.Contains(out.String(), "check 3 (b): no hostname") {
+		t.Errorf("Expected the problems with each check, got %q\n", out.String())
+	}
+
+	// Misspelt fields are caught, rather than ignored.
+	path = writeChecksFile(t, dir, `[{"type": "tcp", "adress": "example.org:443", "api_key": "def"}]`)
+	if err := ValidateChecksFile(&out, path); err == nil || !strings.Contains(err.Error(), "adress") {
+		t.Errorf("Expected the unknown field to be an error, got %v\n", err)
+	}
+}
+
+func TestPollOnce(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"stats": {"requests": 100}}`))
+	}))
+	defer source.Close()
+	server := pacemaker.NewFakeServer()
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "nudger")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeChecksFile(t, dir, `[{"id": "stats", "type": "http_json", "url": "`+source.URL+`", "paths": [{"path": "stats.requests", "metric": "requests"}], "api_key": "def"}]`)
+
+	var out bytes.Buffer
+	config := Config{Pacemaker: server.URL}
+	if err := PollOnce(context.Background(), config, &out, "stats", path, false); err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if !strings.Contains(out.String(), "requests  100     400") || len(server.Metrics()) != 0 {
+		t.Errorf("Expected the metric to be printed but not sent, got %q\n", out.String())
+	}
+
+	out.Reset()
+	if err := PollOnce(context.Background(), config, &out, source.URL, path, true); err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if metrics := server.Metrics(); len(metrics) != 1 || metrics[0].Metric != 100 || metrics[0].ApiKey.Reveal() != "def" {
+		t.Errorf("Expected the metric to be sent, got %+v\n", metrics)
+	}
+
+	if err := PollOnce(context.Background(), config, &out, "missing", path, false); err == nil {
+		t.Errorf("Expected an error polling a check that doesn't exist\n")
+	}
+}
+
+func TestListChecks(t *testing.T) {
+	api := MockApi()
+	defer api.Close()
+
+	var out bytes.Buffer
+	config := Config{Api: api.URL, MasterApiKey: secret.New("r4d4l3rt"), Timeout: 5 * time.Second}
+	if err := ListChecks(context.Background(), config, &out); err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if !strings.Contains(out.String(), "new_relic  app 123") || !strings.HasSuffix(out.String(), "3 checks\n") {
+		t.Errorf("Expected the checks to be listed, got %q\n", out.String())
+	}
+	if strings.Contains(out.String(), "abc") {
+		t.Errorf("Expected no credentials to be listed, got %q\n", out.String())
+	}
+}
+
+func TestSendMetric(t *testing.T) {
+	server := pacemaker.NewFakeServer()
+	defer server.Close()
+
+	var out bytes.Buffer
+	metric := Metric{ApiKey: secret.New("def"), Check: "deploys", Metric: 1, TTL: 400, Tags: []string{"manual"}}
+	if err := SendMetric(context.Background(), Config{Pacemaker: server.URL}, &out, metric); err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if metrics := server.Metrics(); len(metrics) != 1 || metrics[0].Check != "deploys" || metrics[0].Tags[0] != "manual" {
+		t.Errorf("Expected the metric to be sent, got %+v\n", metrics)
+	}
+}
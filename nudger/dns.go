@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dnsAnswers remembers the last answers seen for each DNS check, so changes
+// in answers between polls can be detected.
+var dnsAnswers = struct {
+	sync.Mutex
+	answers map[string]string
+}{answers: map[string]string{}}
+
+// PruneDNSAnswers forgets the answers remembered for checks that aren't in
+// checks, e.g. after a check is deleted or changed.
+func PruneDNSAnswers(checks []Check) {
+	keys := map[string]bool{}
+	for _, check := range checks {
+		if check.Type == "dns" {
+			keys[check.Key()] = true
+		}
+	}
+	dnsAnswers.Lock()
+	defer dnsAnswers.Unlock()
+	for key := range dnsAnswers.answers {
+		if !keys[key] {
+			delete(dnsAnswers.answers, key)
+		}
+	}
+}
+
+// newResolver returns a resolver that queries address (host:port), or the
+// system resolver when address is empty.
+func newResolver(address string) *net.Resolver {
+	if address == "" {
+		return net.DefaultResolver
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "53")
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{}
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// Resolve looks up records of the given type (A, AAAA, CNAME or MX) for
+// hostname, returning the answers in a stable order.
+func Resolve(ctx context.Context, resolver *net.Resolver, hostname string, record string) ([]string, error) {
+	answers := []string{}
+
+	switch strings.ToUpper(record) {
+	case "", "A", "AAAA":
+		network := "ip4"
+		if strings.ToUpper(record) == "AAAA" {
+			network = "ip6"
+		}
+		ips, err := resolver.LookupIP(ctx, network, hostname)
+		if err != nil {
+			return nil, err
+		}
+		for _, ip := range ips {
+			answers = append(answers, ip.String())
+		}
+	case "CNAME":
+		cname, err := resolver.LookupCNAME(ctx, hostname)
+		if err != nil {
+			return nil, err
+		}
+		answers = append(answers, cname)
+	case "MX":
+		mxs, err := resolver.LookupMX(ctx, hostname)
+		if err != nil {
+			return nil, err
+		}
+		for _, mx := range mxs {
+			answers = append(answers, fmt.Sprintf("%d %s", mx.Pref, mx.Host))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported record type %q", record)
+	}
+
+	sort.Strings(answers)
+	return answers, nil
+}
+
+// PollDNS resolves a check's hostname against its resolver, and emits the
+// resolution time in milliseconds, the number of answers, and whether the
+// answers changed since the last poll (1) or not (0).
+func PollDNS(ctx context.Context, check Check, metrics chan Metric) {
+	record := strings.ToUpper(check.Record)
+	if record == "" {
+		record = "A"
+	}
+	emit := func(name string, value float64) {
+		metrics <- Metric{
+			ApiKey: check.ApiKey,
+			Check:  check.Hostname + " " + record + ": " + name,
+			Metric: value,
+			TTL:    400,
+			Tags:   check.Tags,
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second*5)
+	defer cancel()
+
+	start := time.Now()
+	answers, err := Resolve(ctx, newResolver(check.Resolver), check.Hostname, record)
+	elapsed := time.Since(start)
+	if err != nil {
+		Logf(ctx, "[error] PollDNS: %s %s: %s\n", check.Hostname, record, err)
+		return
+	}
+
+	key := check.Key()
+	current := strings.Join(answers, ",")
+	dnsAnswers.Lock()
+	previous, seen := dnsAnswers.answers[key]
+	dnsAnswers.answers[key] = current
+	dnsAnswers.Unlock()
+
+	changed := 0.0
+	if seen && previous != current {
+		Logf(ctx, "[info] PollDNS: %s %s: answers changed from %q to %q\n", check.Hostname, record, previous, current)
+		changed = 1
+	}
+
+	emit("resolution time", float64(elapsed)/float64(time.Millisecond))
+	emit("answers", float64(len(answers)))
+	emit("answer changed", changed)
+}
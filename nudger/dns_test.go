@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+)
+
+// mockDNS is a stand-in DNS server that answers A queries from a table.
+type mockDNS struct {
+	sync.Mutex
+	conn    net.PacketConn
+	records map[string][]net.IP
+}
+
+func newMockDNS(t *testing.T) *mockDNS {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %s\n", err)
+	}
+	m := &mockDNS{conn: conn, records: map[string][]net.IP{}}
+	go m.serve()
+	return m
+}
+
+func (m *mockDNS) set(name string, ips ...string) {
+	m.Lock()
+	defer m.Unlock()
+	m.records[name] = nil
+	for _, ip := range ips {
+		m.records[name] = append(m.records[name], net.ParseIP(ip).To4())
+	}
+}
+
+func (m *mockDNS) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := m.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if n < 12 {
+			continue
+		}
+		query := buf[:n]
+
+		// Decode the question name, which starts straight after the header.
+		labels := []string{}
+		i := 12
+		for i < n && query[i] != 0 {
+			length := int(query[i])
+			labels = append(labels, string(query[i+1:i+1+length]))
+			i += length + 1
+		}
+		questionEnd := i + 5 // the terminating zero, QTYPE and QCLASS
+		qtype := binary.BigEndian.Uint16(query[i+1:])
+		name := ""
+		for _, l := range labels {
+			name += l + "."
+		}
+
+		m.Lock()
+		ips := m.records[name]
+		m.Unlock()
+		if qtype != 1 {
+			ips = nil
+		}
+
+		resp := make([]byte, 12, 512)
+		copy(resp, query[:2])
+		binary.BigEndian.PutUint16(resp[2:], 0x8180) // response, recursion desired and available
+		binary.BigEndian.PutUint16(resp[4:], 1)
+		binary.BigEndian.PutUint16(resp[6:], uint16(len(ips)))
+		resp = append(resp, query[12:questionEnd]...)
+		for _, ip := range ips {
+			rr := []byte{0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4}
+			resp = append(resp, rr...)
+			resp = append(resp, ip...)
+		}
+		m.conn.WriteTo(resp, addr)
+	}
+}
+
+func TestPollDNS(t *testing.T) {
+	server := newMockDNS(t)
+	defer server.conn.Close()
+	server.set("nudger.test.", "10.0.0.1", "10.0.0.2")
+
+	check := Check{Type: "dns", Hostname: "nudger.test", Record: "A", Resolver: server.conn.LocalAddr().String()}
+	metrics := make(chan Metric, 10)
+
+	Poll(context.Background(), check, metrics)
+	results := collect(metrics)
+	if _, ok := results["nudger.test A: resolution time"]; !ok {
+		t.Errorf("Expected resolution time metric, got %+v\n", results)
+	}
+	if answers := results["nudger.test A: answers"]; answers != 2 {
+		t.Errorf("Expected 2 answers, got %f\n", answers)
+	}
+	if changed := results["nudger.test A: answer changed"]; changed != 0 {
+		t.Errorf("Expected answers not to have changed on first poll, got %f\n", changed)
+	}
+
+	Poll(context.Background(), check, metrics)
+	results = collect(metrics)
+	if changed := results["nudger.test A: answer changed"]; changed != 0 {
+		t.Errorf("Expected answers not to have changed, got %f\n", changed)
+	}
+
+	server.set("nudger.test.", "10.0.0.3")
+	Poll(context.Background(), check, metrics)
+	results = collect(metrics)
+	if answers := results["nudger.test A: answers"]; answers != 1 {
+		t.Errorf("Expected 1 answer, got %f\n", answers)
+	}
+	if changed := results["nudger.test A: answer changed"]; changed != 1 {
+		t.Errorf("Expected answers to have changed, got %f\n", changed)
+	}
+
+	// Answers for checks that are gone are forgotten.
+	PollCycle(context.Background(), []Check{}, metrics)
+	dnsAnswers.Lock()
+	_, ok := dnsAnswers.answers[check.Key()]
+	dnsAnswers.Unlock()
+	if ok {
+		t.Errorf("Expected the deleted check's answers to be forgotten\n")
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Exchange is a request made to a source or to Pacemaker, and the response
+// it got, as recorded in a fixture. Bodies that are JSON are kept as JSON, so
+// fixtures are readable, and everything that looks like a credential is
+// redacted.
+type Exchange struct {
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+type RecordedRequest struct {
+	Method string          `json:"method"`
+	URL    string          `json:"url"`
+	JSON   json.RawMessage `json:"json,omitempty"`
+	Body   string          `json:"body,omitempty"`
+}
+
+type RecordedResponse struct {
+	StatusCode int             `json:"status"`
+	Header     http.Header     `json:"header,omitempty"`
+	JSON       json.RawMessage `json:"json,omitempty"`
+	Body       string          `json:"body,omitempty"`
+}
+
+// redacted replaces credentials in fixtures.
+const redacted = "[redacted]"
+
+// redactURL returns u with the values of query parameters that look like
+// credentials redacted, and the rest sorted, so it's the same every time.
+func redactURL(u *url.URL) string {
+	redactedURL := *u
+	redactedURL.User = nil
+	query := u.Query()
+	for name := range query {
+		if isCredential(name) {
+			query.Set(name, redacted)
+		}
+	}
+	redactedURL.RawQuery = query.Encode()
+	return redactedURL.String()
+}
+
+// redactJSON redacts the values of fields that look like credentials,
+// however deeply nested.
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			if isCredential(k) {
+				v[k] = redacted
+			} else {
+				v[k] = redactJSON(value)
+			}
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redactJSON(value)
+		}
+	}
+	return v
+}
+
+// recordBody returns a body as redacted JSON, if it's JSON, or else as it is.
+func recordBody(body []byte) (json.RawMessage, string) {
+	var v interface{}
+	if len(bytes.TrimSpace(body)) == 0 || json.Unmarshal(body, &v) != nil {
+		return nil, string(body)
+	}
+	b, err := json.MarshalIndent(redactJSON(v), "", "  ")
+	if err != nil {
+		return nil, string(body)
+	}
+	return b, ""
+}
+
+// readBody reads a request or response body, and replaces it with a copy so
+// it can be read again.
+func readBody(body *io.ReadCloser) ([]byte, error) {
+	if *body == nil || *body == http.NoBody {
+		return nil, nil
+	}
+	b, err := ioutil.ReadAll(*body)
+	(*body).Close()
+	*body = ioutil.NopCloser(bytes.NewReader(b))
+	return b, err
+}
+
+// Recorder records the requests made through the transports it wraps, and
+// their responses, as fixtures in Dir, one file per exchange.
+type Recorder struct {
+	Dir string
+
+	mu  sync.Mutex
+	seq int
+}
+
+// Recording is the recorder that requests to sources and Pacemaker are made
+// through, with --record.
+var Recording *Recorder
+
+// NewRecorder creates a recorder adding fixtures to dir, after any that are
+// already there.
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	existing, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	return &Recorder{Dir: dir, seq: len(existing)}, nil
+}
+
+// Wrap returns a transport that makes requests with next, recording them.
+func (r *Recorder) Wrap(next http.RoundTripper) http.RoundTripper {
+	return &recordingTransport{recorder: r, next: next}
+}
+
+type recordingTransport struct {
+	recorder *Recorder
+	next     http.RoundTripper
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	respBody, err := readBody(&resp.Body)
+	if err != nil {
+		return resp, err
+	}
+
+	exchange := Exchange{
+		Request:  RecordedRequest{Method: req.Method, URL: redactURL(req.URL)},
+		Response: RecordedResponse{StatusCode: resp.StatusCode, Header: http.Header{}},
+	}
+	exchange.Request.JSON, exchange.Request.Body = recordBody(reqBody)
+	exchange.Response.JSON, exchange.Response.Body = recordBody(respBody)
+	for name, values := range resp.Header {
+		switch {
+		case isCredential(name), name == "Set-Cookie", name == "Date", name == "Content-Length":
+		default:
+			exchange.Response.Header[name] = values
+		}
+	}
+	if err := t.recorder.save(exchange); err != nil {
+		log.Printf("[error] Recorder: %s\n", err)
+	}
+	return resp, nil
+}
+
+var unsafeName = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+func (r *Recorder) save(exchange Exchange) error {
+	b, err := json.MarshalIndent(exchange, "", "  ")
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.seq++
+	seq := r.seq
+	r.mu.Unlock()
+
+	host := "request"
+	if u, err := url.Parse(exchange.Request.URL); err == nil {
+		host = unsafeName.ReplaceAllString(u.Host, "_")
+	}
+	name := fmt.Sprintf("%04d-%s-%s.json", seq, strings.ToLower(exchange.Request.Method), host)
+	return ioutil.WriteFile(filepath.Join(r.Dir, name), append(b, '\n'), 0644)
+}
+
+// Replayer is a transport that serves the responses recorded in fixtures,
+// without touching the network, and keeps the requests made through it.
+// Requests are matched to fixtures by method and URL. If a request was
+// recorded more than once, the responses are served in the order they were
+// recorded, and the last one from then on.
+type Replayer struct {
+	mu        sync.Mutex
+	exchanges []Exchange
+	byRequest map[string][]Exchange
+	served    map[string]int
+	requests  []RecordedRequest
+}
+
+// LoadReplayer loads the fixtures in dir.
+func LoadReplayer(dir string) (*Replayer, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no fixtures in %s", dir)
+	}
+	sort.Strings(paths)
+	r := &Replayer{byRequest: map[string][]Exchange{}, served: map[string]int{}}
+	for _, path := range paths {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var exchange Exchange
+		if err := json.Unmarshal(b, &exchange); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		r.exchanges = append(r.exchanges, exchange)
+		key := exchange.Request.Method + " " + exchange.Request.URL
+		r.byRequest[key] = append(r.byRequest[key], exchange)
+	}
+	return r, nil
+}
+
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, err := readBody(&req.Body)
+	if err != nil {
+		return nil, err
+	}
+	request := RecordedRequest{Method: req.Method, URL: redactURL(req.URL)}
+	request.JSON, request.Body = recordBody(body)
+	key := request.Method + " " + request.URL
+
+	r.mu.Lock()
+	r.requests = append(r.requests, request)
+	recorded := r.byRequest[key]
+	i := r.served[key]
+	if i < len(recorded)-1 {
+		r.served[key]++
+	}
+	r.mu.Unlock()
+	if len(recorded) == 0 {
+		return nil, fmt.Errorf("replay: nothing recorded for %s", key)
+	}
+
+	response := recorded[i].Response
+	respBody := []byte(response.Body)
+	if len(response.JSON) > 0 {
+		respBody = response.JSON
+	}
+	header := http.Header{}
+	for name, values := range response.Header {
+		header[name] = values
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", response.StatusCode, http.StatusText(response.StatusCode)),
+		StatusCode:    response.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(bytes.NewReader(respBody)),
+		ContentLength: int64(len(respBody)),
+		Request:       req,
+	}, nil
+}
+
+// Recorded returns the recorded requests to url, e.g. submissions to
+// Pacemaker, in the order they were recorded.
+func (r *Replayer) Recorded(method string, url string) []RecordedRequest {
+	requests := []RecordedRequest{}
+	for _, exchange := range r.exchanges {
+		if exchange.Request.Method == method && exchange.Request.URL == url {
+			requests = append(requests, exchange.Request)
+		}
+	}
+	return requests
+}
+
+// Requests returns the requests made to url while replaying, redacted like
+// recorded ones, in the order they were made.
+func (r *Replayer) Requests(method string, url string) []RecordedRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	requests := []RecordedRequest{}
+	for _, request := range r.requests {
+		if request.Method == method && request.URL == url {
+			requests = append(requests, request)
+		}
+	}
+	return requests
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/radalert/layer4/pacemaker"
+	"github.com/radalert/layer4/secret"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// replayPolls polls checks against the fixtures in dir, and dispatches what
+// they emit to the Pacemaker at pacemakerURL, also replayed from the fixtures.
+func replayPolls(t *testing.T, dir string, pacemakerURL string, checks ...Check) *Replayer {
+	replayer, err := LoadReplayer(dir)
+	if err != nil {
+		t.Fatalf("Couldn't load fixtures: %s\n", err)
+	}
+	defer func(b *BreakerSet) { Breakers = b }(Breakers)
+	Breakers = NewBreakerSet(5, time.Minute, time.Hour)
+	Breakers.Next = replayer
+
+	client := NewPacemakerClient(Config{Pacemaker: pacemakerURL})
+	client.HTTP.Transport = replayer
+	metrics := make(chan Metric, 100)
+	for _, check := range checks {
+		Poll(context.Background(), check, metrics)
+	}
+	close(metrics)
+	for m := range metrics {
+		if err := dispatchTraced(context.Background(), client, nullEvents{}, m); err != nil {
+			t.Errorf("Unexpected error dispatching %s: %s\n", m.Check, err)
+		}
+	}
+	return replayer
+}
+
+// submissions returns the JSON of metrics submitted to Pacemaker, sorted, as
+// polls might have been recorded in any order.
+func submissions(requests []RecordedRequest) []string {
+	submitted := []string{}
+	for _, r := range requests {
+		var v interface{}
+		json.Unmarshal(r.JSON, &v)
+		b, _ := json.Marshal(v)
+		submitted = append(submitted, string(b))
+	}
+	sort.Strings(submitted)
+	return submitted
+}
+
+// assertReplayed checks that replaying submitted what was recorded being
+// submitted to Pacemaker.
+func assertReplayed(t *testing.T, replayer *Replayer, pacemakerURL string) {
+	recorded := submissions(replayer.Recorded("POST", pacemakerURL))
+	replayed := submissions(replayer.Requests("POST", pacemakerURL))
+	if len(recorded) == 0 || strings.Join(recorded, "\n") != strings.Join(replayed, "\n") {
+		t.Errorf("Expected the recorded submissions:\n%s\ngot:\n%s\n", strings.Join(recorded, "\n"), strings.Join(replayed, "\n"))
+	}
+}
+
+func TestReplayNewRelic(t *testing.T) {
+	check := Check{
+		NRAppId:  1234567,
+		NRApiKey: secret.New("nr-key"),
+		ApiKey:   secret.New("def"),
+		Tags:     []string{"storefront", "production"},
+	}
+	pacemakerURL := "http://130.211.158.50:7223"
+	replayer := replayPolls(t, filepath.Join("testdata", "fixtures", "new_relic"), pacemakerURL, check)
+	assertReplayed(t, replayer, pacemakerURL)
+
+	submitted := replayer.Requests("POST", pacemakerURL)
+	if len(submitted) != 3 || !strings.Contains(string(submitted[0].JSON), `"Storefront: response time"`) {
+		t.Errorf("Expected the app's response time, throughput and error rate, got %+v\n", submitted)
+	}
+}
+
+func TestRecordThenReplay(t *testing.T) {
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("token") != "sekrit" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"stats": {"requests": 100, "queue": 3}, "password": "hunter2"}`))
+	}))
+	server := pacemaker.NewFakeServer()
+
+	dir, err := ioutil.TempDir("", "nudger")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	recorder, err := NewRecorder(dir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	defer func(b *BreakerSet) { Breakers = b }(Breakers)
+	Breakers = NewBreakerSet(5, time.Minute, time.Hour)
+	Breakers.Next = recorder.Wrap(Breakers.Next)
+	Recording = recorder
+	defer func() { Recording = nil }()
+
+	check := Check{
+		Type:   "http_json",
+		URL:    source.URL + "/stats?token=sekrit",
+		ApiKey: secret.New("def"),
+		Paths: []JSONPath{
+			JSONPath{Path: "stats.requests", Metric: "requests"},
+			JSONPath{Path: "stats.queue", Metric: "queue"},
+		},
+	}
+	metrics := make(chan Metric, 10)
+	Poll(context.Background(), check, metrics)
+	close(metrics)
+	client := NewPacemakerClient(Config{Pacemaker: server.URL})
+	for m := range metrics {
+		if err := dispatchTraced(context.Background(), client, nullEvents{}, m); err != nil {
+			t.Errorf("Unexpected error dispatching %s: %s\n", m.Check, err)
+		}
+	}
+	Recording = nil
+	source.Close()
+	server.Close()
+
+	paths, _ := filepath.Glob(filepath.Join(dir, "*.json"))
+	if len(paths) != 3 {
+		t.Fatalf("Expected the poll and 2 submissions to be recorded, got %v\n", paths)
+	}
+	for _, path := range paths {
+		b, _ := ioutil.ReadFile(path)
+		for _, credential := range []string{"sekrit", "hunter2", "def"} {
+			if strings.Contains(string(b), credential) {
+				t.Errorf("Expected credentials to be redacted, found %s in %s\n", credential, b)
+			}
+		}
+	}
+
+	// The source and Pacemaker are gone, so this only works if replaying
+	// doesn't touch the network.
+	replayer := replayPolls(t, dir, server.URL, check)
+	assertReplayed(t, replayer, server.URL)
+	if replayed := replayer.Requests("POST", server.URL); len(replayed) != 2 {
+		t.Errorf("Expected 2 submissions replayed, got %+v\n", replayed)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/radalert/layer4/secret"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GraphiteRule maps dotted Graphite metric paths onto Rad Alert checks.
+//
+// Pattern is matched against a path segment by segment, where "*" matches
+// any one segment. The segments matched by each "*" can be referred to in
+// Check and Tags as $1, $2 and so on, e.g. a pattern of "servers.*.cpu.*"
+// with a check of "$1: cpu $2" maps "servers.web1.cpu.idle" to "web1: cpu
+// idle".
+type GraphiteRule struct {
+	Pattern string        `json:"pattern"`
+	Check   string        `json:"check"`
+	ApiKey  secret.Secret `json:"api_key"`
+	Tags    []string      `json:"tags"`
+}
+
+// Match returns the metric for path if the rule matches it.
+func (r GraphiteRule) Match(path string, value float64) (Metric, bool) {
+	pattern := strings.Split(r.Pattern, ".")
+	segments := strings.Split(path, ".")
+	if len(pattern) != len(segments) {
+		return Metric{}, false
+	}
+
+	captures := []string{}
+	for i, p := range pattern {
+		switch {
+		case p == "*":
+			captures = append(captures, segments[i])
+		case p != segments[i]:
+			return Metric{}, false
+		}
+	}
+
+	expand := func(s string) string {
+		// Replace from the highest capture down, so $1 doesn't clobber $10.
+		for i := len(captures); i > 0; i-- {
+			s = strings.Replace(s, "$"+strconv.Itoa(i), captures[i-1], -1)
+		}
+		return s
+	}
+
+	m := Metric{ApiKey: r.ApiKey, Check: expand(r.Check), Metric: value, TTL: 400}
+	if m.Check == "" {
+		m.Check = path
+	}
+	for _, tag := range r.Tags {
+		m.Tags = append(m.Tags, expand(tag))
+	}
+	return m, true
+}
+
+// LoadGraphiteRules reads a JSON list of rules from a file.
+func LoadGraphiteRules(filename string) ([]GraphiteRule, error) {
+	body, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var rules []GraphiteRule
+	err = json.Unmarshal(body, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't decode %s: %s", filename, err)
+	}
+	return rules, nil
+}
+
+// GraphiteReceiver maps received Graphite metrics with rules, and emits them.
+// Paths that no rule matches are counted, and a sample of them is logged so
+// operators can write rules for them.
+type GraphiteReceiver struct {
+	Rules   []GraphiteRule
+	Metrics chan Metric
+
+	mutex      sync.Mutex
+	unmapped   int
+	lastLogged time.Time
+}
+
+// Unmapped returns how many paths have been received that no rule matched.
+func (g *GraphiteReceiver) Unmapped() int {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.unmapped
+}
+
+// Receive maps a single Graphite path and value to a metric.
+func (g *GraphiteReceiver) Receive(path string, value float64) {
+	g.ReceiveAt(path, value, time.Time{})
+}
+
+// ReceiveAt maps a single Graphite path and value measured at a time to a
+// metric.
+func (g *GraphiteReceiver) ReceiveAt(path string, value float64, at time.Time) {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return
+	}
+	for _, rule := range g.Rules {
+		if m, ok := rule.Match(path, value); ok {
+			m.at = at
+			g.Metrics <- m
+			return
+		}
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.unmapped++
+	if time.Since(g.lastLogged) > time.Second*10 {
+		g.lastLogged = time.Now()
+		log.Printf("[info] GraphiteReceiver: no rule for %q (%d unmapped paths so far)\n", path, g.unmapped)
+	}
+}
+
+// ServePlaintext reads "path value timestamp" lines from conn until it closes.
+func (g *GraphiteReceiver) ServePlaintext(conn io.Reader) {
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			log.Printf("[error] GraphiteReceiver: malformed line %q\n", scanner.Text())
+			continue
+		}
+		value, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			log.Printf("[error] GraphiteReceiver: bad value in %q: %s\n", scanner.Text(), err)
+			continue
+		}
+		// Timestamps of -1 mean now, as they do to carbon.
+		at := time.Time{}
+		if len(fields) > 2 {
+			if ts, err := strconv.ParseFloat(fields[2], 64); err == nil && ts > 0 {
+				at = time.Unix(0, int64(ts*1e9))
+			}
+		}
+		g.ReceiveAt(fields[0], value, at)
+	}
+}
+
+// ServePickle reads length prefixed pickled lists of (path, (timestamp,
+// value)) tuples from conn until it closes, as sent by carbon-relay.
+func (g *GraphiteReceiver) ServePickle(conn io.Reader) {
+	for {
+		var length uint32
+		err := binary.Read(conn, binary.BigEndian, &length)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("[error] GraphiteReceiver: reading pickle length: %s\n", err)
+			}
+			return
+		}
+		if length > 1<<24 {
+			log.Printf("[error] GraphiteReceiver: pickle of %d bytes is too big\n", length)
+			return
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(conn, payload)
+		if err != nil {
+			log.Printf("[error] GraphiteReceiver: reading pickle: %s\n", err)
+			return
+		}
+
+		decoded, err := Unpickle(payload)
+		if err != nil {
+			log.Printf("[error] GraphiteReceiver: %s\n", err)
+			continue
+		}
+		datapoints, ok := decoded.([]interface{})
+		if !ok {
+			log.Printf("[error] GraphiteReceiver: expected pickled list, got %T\n", decoded)
+			continue
+		}
+		for _, d := range datapoints {
+			path, value, at, err := pickledDatapoint(d)
+			if err != nil {
+				log.Printf("[error] GraphiteReceiver: %s\n", err)
+				continue
+			}
+			g.ReceiveAt(path, value, at)
+		}
+	}
+}
+
+// pickledDatapoint returns the path, value and timestamp of a pickled
+// datapoint. Timestamps that aren't positive numbers are zero, meaning now.
+func pickledDatapoint(d interface{}) (string, float64, time.Time, error) {
+	outer, ok := d.([]interface{})
+	if !ok || len(outer) != 2 {
+		return "", 0, time.Time{}, fmt.Errorf("expected (path, (timestamp, value)), got %v", d)
+	}
+	path, ok := outer[0].(string)
+	if !ok {
+		return "", 0, time.Time{}, fmt.Errorf("expected string path, got %v", outer[0])
+	}
+	inner, ok := outer[1].([]interface{})
+	if !ok || len(inner) != 2 {
+		return "", 0, time.Time{}, fmt.Errorf("expected (timestamp, value) for %s, got %v", path, outer[1])
+	}
+	at := time.Time{}
+	if ts, err := pickledNumber(inner[0]); err == nil && ts > 0 {
+		at = time.Unix(0, int64(ts*1e9))
+	}
+	value, err := pickledNumber(inner[1])
+	if err != nil {
+		return "", 0, time.Time{}, fmt.Errorf("expected numeric value for %s, got %v", path, inner[1])
+	}
+	return path, value, at, nil
+}
+
+func pickledNumber(v interface{}) (float64, error) {
+	switch v := v.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case string:
+		return strconv.ParseFloat(v, 64)
+	}
+	return 0, fmt.Errorf("%v isn't a number", v)
+}
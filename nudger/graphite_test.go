@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/radalert/layer4/secret"
+	"strings"
+	"testing"
+)
+
+// Graphite datapoints as pickled by Python 2 and 3:
+//
+//	[('servers.web1.cpu.idle', (1434972584, 97.5)),
+//	 ('servers.web2.cpu.user', (1434972584, 3)),
+//	 ('unmapped.path', (1434972584, 1.0))]
+var pickledDatapoints = map[string]string{
+	"protocol 0": "(lp0\x0a(Vservers.web1.cpu.idle\x0ap1\x0a(I1434972584\x0aF97.5\x0atp2\x0atp3\x0aa(Vservers.web2.cpu.user\x0ap4\x0a(I1434972584\x0aI3\x0atp5\x0atp6\x0aa(Vunmapped.path\x0ap7\x0a(I1434972584\x0aF1.0\x0atp8\x0atp9\x0aa.",
+	"protocol 2": "\x80\x02]q\x00(X\x15\x00\x00\x00servers.web1.cpu.idleq\x01J\xa8\xf1\x87UG@X`\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x15\x00\x00\x00servers.web2.cpu.userq\x04J\xa8\xf1\x87UK\x03\x86q\x05\x86q\x06X\x0d\x00\x00\x00unmapped.pathq\x07J\xa8\xf1\x87UG?\xf0\x00\x00\x00\x00\x00\x00\x86q\x08\x86q\x09e.",
+	"protocol 4": "\x80\x04\x95t\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x15servers.web1.cpu.idle\x94J\xa8\xf1\x87UG@X`\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x15servers.web2.cpu.user\x94J\xa8\xf1\x87UK\x03\x86\x94\x86\x94\x8c\x0dunmapped.path\x94J\xa8\xf1\x87UG?\xf0\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94e.",
+}
+
+var graphiteRules = []GraphiteRule{
+	GraphiteRule{Pattern: "servers.*.cpu.*", Check: "$1: cpu $2", ApiKey: secret.New("def"), Tags: []string{"$1", "cpu"}},
+}
+
+func TestGraphiteRuleMatch(t *testing.T) {
+	m, ok := graphiteRules[0].Match("servers.web1.cpu.idle", 97.5)
+	if !ok {
+		t.Fatalf("Expected rule to match\n")
+	}
+	if m.Check != "web1: cpu idle" || m.ApiKey.Reveal() != "def" || m.Metric != 97.5 || strings.Join(m.Tags, ",") != "web1,cpu" {
+		t.Errorf("Unexpected metric: %+v\n", m)
+	}
+
+	for _, path := range []string{"servers.web1.cpu", "servers.web1.memory.free", "servers.web1.cpu.idle.total"} {
+		if _, ok := graphiteRules[0].Match(path, 1); ok {
+			t.Errorf("Expected rule not to match %q\n", path)
+		}
+	}
+}
+
+func TestGraphitePlaintext(t *testing.T) {
+	metrics := make(chan Metric, 10)
+	g := &GraphiteReceiver{Rules: graphiteRules, Metrics: metrics}
+	input := "servers.web1.cpu.idle 97.5 1434972584\nservers.web1.cpu.user nan 1434972584\nbogus\nunmapped.path 1 1434972584\n"
+	g.ServePlaintext(strings.NewReader(input))
+
+	if len(metrics) != 1 {
+		t.Fatalf("Expected %d metric, got %d\n", 1, len(metrics))
+	}
+	if m := <-metrics; m.Check != "web1: cpu idle" || m.at.Unix() != 1434972584 {
+		t.Errorf("Unexpected metric: %+v\n", m)
+	}
+	if g.Unmapped() != 1 {
+		t.Errorf("Expected 1 unmapped path, got %d\n", g.Unmapped())
+	}
+}
+
+func TestGraphitePickle(t *testing.T) {
+	for protocol, pickled := range pickledDatapoints {
+		var input bytes.Buffer
+		binary.Write(&input, binary.BigEndian, uint32(len(pickled)))
+		input.WriteString(pickled)
+
+		metrics := make(chan Metric, 10)
+		g := &GraphiteReceiver{Rules: graphiteRules, Metrics: metrics}
+		g.ServePickle(&input)
+
+		results := map[string]float64{}
+		for len(metrics) > 0 {
+			m := <-metrics
+			results[m.Check] = m.Metric
+			if m.at.Unix() != 1434972584 {
+				t.Errorf("%s: expected the pickled timestamp, got %s\n", protocol, m.at)
+			}
+		}
+		if results["web1: cpu idle"] != 97.5 || results["web2: cpu user"] != 3 || len(results) != 2 {
+			t.Errorf("%s: unexpected metrics: %+v\n", protocol, results)
+		}
+		if g.Unmapped() != 1 {
+			t.Errorf("%s: expected 1 unmapped path, got %d\n", protocol, g.Unmapped())
+		}
+	}
+}
+
+func TestUnpickleRejectsObjects(t *testing.T) {
+	// os.system('true'), as pickled by Python 2
+	_, err := Unpickle([]byte("cos\nsystem\n(S'true'\ntR."))
+	if err == nil {
+		t.Errorf("Expected unpickling a global to fail\n")
+	}
+}
+
+func TestUnpickleUnbalancedMark(t *testing.T) {
+	// A mark set above items that have since been popped.
+	_, err := Unpickle([]byte("]N(ae."))
+	if err == nil {
+		t.Errorf("Expected unpickling an unbalanced mark to fail\n")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSONPath maps a path expression in a JSON document to a metric name.
+//
+// Paths are a dotted list of object keys with optional array indexes, e.g.
+// "stats.queues[0].depth". Keys containing dots can be quoted in brackets,
+// e.g. `servers["web.1"].load`. A leading "$" is accepted and ignored.
+type JSONPath struct {
+	Path   string `json:"path"`
+	Metric string `json:"metric"`
+}
+
+// PollJSON fetches a JSON document from a check's URL and emits a metric for
+// every path configured on the check.
+func PollJSON(ctx context.Context, check Check, metrics chan Metric) {
+	client := &http.Client{Timeout: time.Second * 5, Transport: Breakers}
+	req, err := NewCheckRequest(ctx, check)
+	if err != nil {
+		Logf(ctx, "[error] PollJSON: %s: new request: %s\n", check.URL, err)
+		return
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		Logf(ctx, "[error] PollJSON: %s: client do: %s\n", check.URL, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		Logf(ctx, "[error] PollJSON: %s: couldn't read body: %s\n", check.URL, err)
+		return
+	}
+	if resp.StatusCode != 200 {
+		Logf(ctx, "[error] PollJSON: %s: HTTP %d: %s\n", check.URL, resp.StatusCode, string(body))
+		return
+	}
+
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	err = decoder.Decode(&doc)
+	if err != nil {
+		Logf(ctx, "[error] PollJSON: %s: couldn't decode json: %s\n", check.URL, err)
+		return
+	}
+
+	for _, p := range check.Paths {
+		value, err := ExtractNumber(doc, p.Path)
+		if err != nil {
+			Logf(ctx, "[error] PollJSON: %s: path %q: %s\n", check.URL, p.Path, err)
+			continue
+		}
+		metrics <- Metric{
+			ApiKey: check.ApiKey,
+			Check:  p.Metric,
+			Metric: value,
+			TTL:    400,
+			Tags:   check.Tags,
+		}
+	}
+}
+
+// NewCheckRequest builds a request for a check's URL, cancelled with ctx, and
+// with the method, headers and basic auth credentials set on the check.
+func NewCheckRequest(ctx context.Context, check Check) (*http.Request, error) {
+	method := check.Method
+	if method == "" {
+		method = "GET"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, check.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range check.Headers {
+		req.Header.Set(k, v)
+	}
+	if check.Username != "" || !check.Password.IsZero() {
+		req.SetBasicAuth(check.Username, check.Password.Reveal())
+	}
+	return req, nil
+}
+
+// ExtractNumber looks up path in a decoded JSON document, and returns the
+// value found there as a number. Numeric strings are accepted, as plenty of
+// APIs quote their numbers.
+func ExtractNumber(doc interface{}, path string) (float64, error) {
+	value, err := lookupPath(doc, path)
+	if err != nil {
+		return 0, err
+	}
+
+	switch v := value.(type) {
+	case json.Number:
+		return v.Float64()
+	case float64:
+		return v, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return 0, fmt.Errorf("not a number: %q", v)
+		}
+		return f, nil
+	case nil:
+		return 0, fmt.Errorf("value is null")
+	default:
+		return 0, fmt.Errorf("not a number: %v", v)
+	}
+}
+
+// lookupPath walks a decoded JSON document following path.
+func lookupPath(doc interface{}, path string) (interface{}, error) {
+	steps, err := parsePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	current := doc
+	for _, step := range steps {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			if step.index >= 0 {
+				return nil, fmt.Errorf("can't index object with [%d]", step.index)
+			}
+			value, ok := node[step.key]
+			if !ok {
+				return nil, fmt.Errorf("no such key %q", step.key)
+			}
+			current = value
+		case []interface{}:
+			if step.index < 0 {
+				return nil, fmt.Errorf("can't look up key %q in array", step.key)
+			}
+			if step.index >= len(node) {
+				return nil, fmt.Errorf("index %d out of range (length %d)", step.index, len(node))
+			}
+			current = node[step.index]
+		default:
+			return nil, fmt.Errorf("can't descend into %v", current)
+		}
+	}
+	return current, nil
+}
+
+// pathStep is either an object key, or an array index when index >= 0.
+type pathStep struct {
+	key   string
+	index int
+}
+
+func parsePath(path string) ([]pathStep, error) {
+	p := strings.TrimPrefix(strings.TrimSpace(path), "$")
+	steps := []pathStep{}
+
+	for len(p) > 0 {
+		switch p[0] {
+		case '.':
+			p = p[1:]
+		case '[':
+			end := strings.IndexByte(p, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in path %q", path)
+			}
+			inner := p[1:end]
+			p = p[end+1:]
+			if len(inner) >= 2 && (inner[0] == '"' || inner[0] == '\'') && inner[len(inner)-1] == inner[0] {
+				steps = append(steps, pathStep{key: inner[1 : len(inner)-1], index: -1})
+				continue
+			}
+			i, err := strconv.Atoi(inner)
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("bad index [%s] in path %q", inner, path)
+			}
+			steps = append(steps, pathStep{index: i})
+		default:
+			end := strings.IndexAny(p, ".[")
+			if end < 0 {
+				end = len(p)
+			}
+			steps = append(steps, pathStep{key: p[:end], index: -1})
+			p = p[end:]
+		}
+	}
+
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("empty path")
+	}
+	return steps, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/radalert/layer4/secret"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func decodeJSON(t *testing.T, s string) interface{} {
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader([]byte(s)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		t.Fatalf("Couldn't decode test document: %s\n", err)
+	}
+	return doc
+}
+
+func TestExtractNumber(t *testing.T) {
+	doc := decodeJSON(t, `{
+		"uptime": 12345,
+		"load": "0.75",
+		"name": "web",
+		"queues": [{"depth": 3}, {"depth": 7}],
+		"servers": {"web.1": {"rps": 42.5}},
+		"nothing": null,
+		"ratio": "NaN",
+		"limit": "Infinity"
+	}`)
+
+	good := map[string]float64{
+		"uptime":               12345,
+		"$.uptime":             12345,
+		"load":                 0.75,
+		"queues[1].depth":      7,
+		"$.queues[0].depth":    3,
+		`servers["web.1"].rps`: 42.5,
+	}
+	for path, expected := range good {
+		value, err := ExtractNumber(doc, path)
+		if err != nil {
+			t.Errorf("Path %q: unexpected error: %s\n", path, err)
+			continue
+		}
+		if value != expected {
+			t.Errorf("Path %q: expected %f, got %f\n", path, expected, value)
+		}
+	}
+
+	bad := []string{"name", "missing", "queues[2].depth", "queues.depth", "nothing", "uptime.seconds", "", "queues[x]"}
+	for _, path := range bad {
+		if value, err := ExtractNumber(doc, path); err == nil {
+			t.Errorf("Path %q: expected error, got %f\n", path, value)
+		}
+	}
+	for _, path := range []string{"ratio", "limit"} {
+		if value, err := ExtractNumber(doc, path); err == nil || !strings.Contains(err.Error(), "not a number") {
+			t.Errorf("Path %q: expected not a number, got %f and %v\n", path, value, err)
+		}
+	}
+}
+
+func TestPollJSON(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, _ := r.BasicAuth()
+		if r.Header.Get("X-Token") != "sekrit" || user != "nudger" || pass != "hunter2" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"stats": {"requests": 100, "status": "ok"}}`))
+	}))
+	defer server.Close()
+
+	check := Check{
+		Type:     "http_json",
+		URL:      server.URL,
+		Headers:  map[string]string{"X-Token": "sekrit"},
+		Username: "nudger",
+		Password: secret.New("hunter2"),
+		ApiKey:   secret.New("def"),
+		Paths: []JSONPath{
+			JSONPath{Path: "stats.requests", Metric: "requests"},
+			JSONPath{Path: "stats.status", Metric: "status"},
+		},
+	}
+
+	metrics := make(chan Metric, 10)
+	Poll(context.Background(), check, metrics)
+
+	if len(metrics) != 1 {
+		t.Fatalf("Expected %d metric, got %d\n", 1, len(metrics))
+	}
+	m := <-metrics
+	if m.Check != "requests" || m.Metric != 100 || m.ApiKey.Reveal() != "def" {
+		t.Errorf("Unexpected metric: %+v\n", m)
+	}
+
+	check.Password = secret.New("wrong")
+	Poll(context.Background(), check, metrics)
+	if len(metrics) != 0 {
+		t.Errorf("Expected no metrics for failed request, got %d\n", len(metrics))
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/radalert/layer4/secret"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// InfluxPoint is a point parsed from the InfluxDB line protocol. Only numeric
+// and boolean fields are kept, as those are all Pacemaker can use.
+type InfluxPoint struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]float64
+	Timestamp   int64
+}
+
+// SeriesKey returns the measurement and its tags, sorted by key, in line
+// protocol form, e.g. "cpu,cpu=cpu0,host=web1".
+func (p InfluxPoint) SeriesKey() string {
+	keys := []string{}
+	for k := range p.Tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	key := p.Measurement
+	for _, k := range keys {
+		key += "," + k + "=" + p.Tags[k]
+	}
+	return key
+}
+
+// splitUnescaped splits s on sep, ignoring separators escaped with a
+// backslash or inside double quotes.
+func splitUnescaped(s string, sep byte, n int) []string {
+	parts := []string{}
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			if n > 0 && len(parts) == n-1 {
+				continue
+			}
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+func unescapeInflux(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	unescaped := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`, ="\`, s[i+1]) >= 0 {
+			i++
+		}
+		unescaped = append(unescaped, s[i])
+	}
+	return string(unescaped)
+}
+
+// precisions maps the precision parameter to nanoseconds per unit.
+var precisions = map[string]int64{
+	"":   1,
+	"n":  1,
+	"ns": 1,
+	"u":  1e3,
+	"us": 1e3,
+	"ms": 1e6,
+	"s":  1e9,
+	"m":  60e9,
+	"h":  3600e9,
+}
+
+// ParseInfluxLine parses a line of the InfluxDB line protocol, e.g.
+// "cpu,host=web1 usage_idle=97.5,procs=120i 1434972584000000000". The
+// timestamp is converted from precision to nanoseconds.
+func ParseInfluxLine(line string, precision string) (InfluxPoint, error) {
+	p := InfluxPoint{Tags: map[string]string{}, Fields: map[string]float64{}}
+	multiplier, ok := precisions[precision]
+	if !ok {
+		return p, fmt.Errorf("unknown precision %q", precision)
+	}
+
+	sections := []string{}
+	for _, s := range splitUnescaped(line, ' ', 0) {
+		if s != "" {
+			sections = append(sections, s)
+		}
+	}
+	if len(sections) < 2 || len(sections) > 3 {
+		return p, fmt.Errorf("expected measurement, fields and optional timestamp in %q", line)
+	}
+
+	series := splitUnescaped(sections[0], ',', 0)
+	p.Measurement = unescapeInflux(series[0])
+	if p.Measurement == "" {
+		return p, fmt.Errorf("no measurement in %q", line)
+	}
+	for _, tag := range series[1:] {
+		kv := splitUnescaped(tag, '=', 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return p, fmt.Errorf("bad tag %q in %q", tag, line)
+		}
+		p.Tags[unescapeInflux(kv[0])] = unescapeInflux(kv[1])
+	}
+
+	fields := 0
+	for _, field := range splitUnescaped(sections[1], ',', 0) {
+		kv := splitUnescaped(field, '=', 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return p, fmt.Errorf("bad field %q in %q", field, line)
+		}
+		fields++
+		name, raw := unescapeInflux(kv[0]), kv[1]
+
+		switch {
+		case strings.HasPrefix(raw, `"`):
+			// String fields aren't numeric, so there's nothing to forward.
+			continue
+		case raw == "t" || raw == "T" || raw == "true" || raw == "True" || raw == "TRUE":
+			p.Fields[name] = 1
+		case raw == "f" || raw == "F" || raw == "false" || raw == "False" || raw == "FALSE":
+			p.Fields[name] = 0
+		case strings.HasSuffix(raw, "i"):
+			v, err := strconv.ParseInt(raw[:len(raw)-1], 10, 64)
+			if err != nil {
+				return p, fmt.Errorf("bad integer field %q in %q", field, line)
+			}
+			p.Fields[name] = float64(v)
+		case strings.HasSuffix(raw, "u"):
+			v, err := strconv.ParseUint(raw[:len(raw)-1], 10, 64)
+			if err != nil {
+				return p, fmt.Errorf("bad unsigned field %q in %q", field, line)
+			}
+			p.Fields[name] = float64(v)
+		default:
+			// Line protocol has no NaN or infinities, though ParseFloat
+			// accepts them.
+			v, err := strconv.ParseFloat(raw, 64)
+			if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+				return p, fmt.Errorf("bad field %q in %q", field, line)
+			}
+			p.Fields[name] = v
+		}
+	}
+	if fields == 0 {
+		return p, fmt.Errorf("no fields in %q", line)
+	}
+
+	if len(sections) == 3 {
+		ts, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return p, fmt.Errorf("bad timestamp in %q", line)
+		}
+		p.Timestamp = ts * multiplier
+	}
+	return p, nil
+}
+
+// influxApiKey finds the API key a write is authenticated with. InfluxDB
+// clients send credentials as u and p parameters, with basic auth, or as an
+// "Authorization: Token" header. Only the password or token is used.
+func influxApiKey(r *http.Request) string {
+	if p := r.URL.Query().Get("p"); p != "" {
+		return p
+	}
+	if _, p, ok := r.BasicAuth(); ok && p != "" {
+		return p
+	}
+	auth := r.Header.Get("Authorization")
+	if strings.HasPrefix(auth, "Token ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Token "))
+	}
+	return ""
+}
+
+// influxMaxBody is the most a write can be, decompressed, in bytes.
+const influxMaxBody = 10 << 20
+
+// influxHandler is an InfluxDB compatible /write endpoint, so Telegraf and
+// other InfluxDB clients can submit metrics to Pacemaker through nudger.
+// Writes must use one of keys, so a wrong key is refused rather than
+// accepted and then rejected by Pacemaker, which the client wouldn't see.
+type influxHandler struct {
+	metrics chan Metric
+	keys    []secret.Secret
+}
+
+// key returns which of the handler's keys apikey is.
+func (ih *influxHandler) key(apikey string) (secret.Secret, bool) {
+	for _, key := range ih.keys {
+		if key.Equal(apikey) {
+			return key, true
+		}
+	}
+	return secret.Secret{}, false
+}
+
+func influxError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	b, _ := json.Marshal(map[string]string{"error": message})
+	w.Write(b)
+}
+
+// ServeHTTP handles writes from InfluxDB clients
+func (ih *influxHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		influxError(w, http.StatusMethodNotAllowed, "writes must be POSTed")
+		return
+	}
+	given := influxApiKey(r)
+	if given == "" {
+		influxError(w, http.StatusUnauthorized, "an API key is required as the password or token")
+		return
+	}
+	apikey, ok := ih.key(given)
+	if !ok {
+		influxError(w, http.StatusUnauthorized, "unknown API key, see --influx-key")
+		return
+	}
+
+	// Writes are limited both as sent and once decompressed, so a small
+	// gzipped body can't expand without bound.
+	var reader io.Reader = http.MaxBytesReader(w, r.Body, influxMaxBody)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			influxError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer gz.Close()
+		reader = io.LimitReader(gz, influxMaxBody+1)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err == nil && len(body) > influxMaxBody {
+		err = fmt.Errorf("http: request body too large")
+	}
+	if err != nil {
+		log.Printf("[error] influxHandler: reading body: %s\n", err)
+		if strings.Contains(err.Error(), "too large") {
+			influxError(w, http.StatusRequestEntityTooLarge, err.Error())
+		} else {
+			influxError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+
+	precision := r.URL.Query().Get("precision")
+	errors := []string{}
+	for _, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		point, err := ParseInfluxLine(line, precision)
+		if err != nil {
+			errors = append(errors, err.Error())
+			continue
+		}
+
+		tags := []string{}
+		for k, v := range point.Tags {
+			tags = append(tags, k+":"+v)
+		}
+		sort.Strings(tags)
+		series := point.SeriesKey()
+		at := time.Time{}
+		if point.Timestamp != 0 {
+			at = time.Unix(0, point.Timestamp)
+		}
+		for field, value := range point.Fields {
+			ih.metrics <- Metric{
+				ApiKey: apikey,
+				Check:  series + ": " + field,
+				Metric: value,
+				TTL:    400,
+				Tags:   tags,
+				at:     at,
+			}
+		}
+	}
+
+	if len(errors) > 0 {
+		log.Printf("[error] influxHandler: %d bad lines, first: %s\n", len(errors), errors[0])
+		influxError(w, http.StatusBadRequest, "partial write: "+strings.Join(errors, "; "))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// influxPing answers InfluxDB clients checking the server is up.
+func influxPing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Influxdb-Version", "1.8-nudger")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/radalert/layer4/secret"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseInfluxLine(t *testing.T) {
+	p, err := ParseInfluxLine(`cpu\ load,host=web\ 1,region=eu usage_idle=97.5,procs=120i,up=t,note="a, b=c" 1434972584`, "s")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if p.Measurement != "cpu load" || p.Tags["host"] != "web 1" || p.Tags["region"] != "eu" {
+		t.Errorf("Unexpected series: %+v\n", p)
+	}
+	if len(p.Fields) != 3 || p.Fields["usage_idle"] != 97.5 || p.Fields["procs"] != 120 || p.Fields["up"] != 1 {
+		t.Errorf("Unexpected fields: %+v\n", p.Fields)
+	}
+	if p.Timestamp != 1434972584000000000 {
+		t.Errorf("Expected timestamp in nanoseconds, got %d\n", p.Timestamp)
+	}
+	if key := p.SeriesKey(); key != "cpu load,host=web 1,region=eu" {
+		t.Errorf("Unexpected series key %q\n", key)
+	}
+
+	p, err = ParseInfluxLine("disk free=18446744073709551615u", "")
+	if err != nil || p.Fields["free"] != 18446744073709551615 {
+		t.Errorf("Expected the largest unsigned field, got %+v and %v\n", p.Fields, err)
+	}
+
+	bad := []string{"cpu", "cpu value=", "cpu value=abc", "cpu,host value=1", "cpu value=1 yesterday", ",host=a value=1", "disk free=-1u"}
+	for _, line := range bad {
+		if _, err := ParseInfluxLine(line, ""); err == nil {
+			t.Errorf("Expected error parsing %q\n", line)
+		}
+	}
+	for _, line := range []string{"x v=NaN", "x v=Inf", "x v=+Inf", "x v=-inf"} {
+		if _, err := ParseInfluxLine(line, ""); err == nil || !strings.Contains(err.Error(), "bad field") {
+			t.Errorf("Expected a bad field parsing %q, got %v\n", line, err)
+		}
+	}
+	if _, err := ParseInfluxLine("cpu value=1", "fortnights"); err == nil {
+		t.Errorf("Expected error for unknown precision\n")
+	}
+}
+
+func TestInfluxWrite(t *testing.T) {
+	metrics := make(chan Metric, 10)
+	server := httptest.NewServer(&influxHandler{metrics: metrics, keys: []secret.Secret{secret.New("def"), secret.New("ghi")}})
+	defer server.Close()
+
+	body := "cpu,host=web1 usage_idle=97.5\nmem,host=web1 used=1024i 1434972584000\n"
+	resp, err := http.Post(server.URL+"/write?db=telegraf&u=nudger&p=def&precision=ms", "text/plain", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("HTTP POST should not have failed! Got: %s\n", err)
+	}
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected HTTP 204, got %d\n", resp.StatusCode)
+	}
+	if len(metrics) != 2 {
+		t.Fatalf("Expected %d metrics, got %d\n", 2, len(metrics))
+	}
+	m := <-metrics
+	if m.ApiKey.Reveal() != "def" || m.Check != "cpu,host=web1: usage_idle" || m.Metric != 97.5 || m.Tags[0] != "host:web1" {
+		t.Errorf("Unexpected metric: %+v\n", m)
+	}
+	<-metrics
+
+	// Unauthenticated
+	resp, _ = http.Post(server.URL+"/write", "text/plain", strings.NewReader(body))
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected HTTP 401 without an API key, got %d\n", resp.StatusCode)
+	}
+	resp, _ = http.Post(server.URL+"/write?p=wrong", "text/plain", strings.NewReader(body))
+	if resp.StatusCode != http.StatusUnauthorized || len(metrics) != 0 {
+		t.Errorf("Expected HTTP 401 and no metrics with an unknown API key, got %d and %d metrics\n", resp.StatusCode, len(metrics))
+	}
+
+	// Partial write, gzipped, with a token
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte("cpu usage_idle=50\ncpu usage_idle=bogus\n"))
+	gz.Close()
+	req, _ := http.NewRequest("POST", server.URL+"/write", &gzipped)
+	req.Header.Set("Authorization", "Token ghi")
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("HTTP POST should not have failed! Got: %s\n", err)
+	}
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected HTTP 400 for partial write, got %d\n", resp.StatusCode)
+	}
+	if len(metrics) != 1 {
+		t.Fatalf("Expected valid line of partial write to be forwarded, got %d metrics\n", len(metrics))
+	}
+	if m := <-metrics; m.ApiKey.Reveal() != "ghi" {
+		t.Errorf("Expected API key from token, got %+v\n", m)
+	}
+
+	// Too large once decompressed
+	gzipped.Reset()
+	gz = gzip.NewWriter(&gzipped)
+	gz.Write(bytes.Repeat([]byte("cpu usage_idle=50\n"), influxMaxBody/10))
+	gz.Close()
+	req, _ = http.NewRequest("POST", server.URL+"/write?p=def", &gzipped)
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("HTTP POST should not have failed! Got: %s\n", err)
+	}
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || len(metrics) != 0 {
+		t.Errorf("Expected HTTP 413 and no metrics for a gzip bomb, got %d and %d metrics\n", resp.StatusCode, len(metrics))
+	}
+}
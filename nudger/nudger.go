@@ -1,24 +1,64 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"crypto/sha1"
 	"encoding/json"
 	"fmt"
+	"github.com/radalert/layer4/logging"
+	"github.com/radalert/layer4/pacemaker"
+	"github.com/radalert/layer4/secret"
+	"golang.org/x/net/trace"
 	"gopkg.in/alecthomas/kingpin.v1"
+	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 type Config struct {
 	Interval     time.Duration
-	MasterApiKey string
+	MasterApiKey secret.Secret
 	Api          string
+	Changes      string
 	Pacemaker    string
 	Timeout      time.Duration
+	Statsd       []StatsdListener
+	StatsdFlush  time.Duration
+	Graphite     string
+	Pickle       string
+	Rules        []GraphiteRule
+	Windows      []WindowRule
+	ListenBind   string
+	StateDir     string
+	Syslog       string
+	SyslogFlush  time.Duration
+	SyslogDrains map[string]secret.Secret
+	InfluxKeys   []secret.Secret
+	Agent        bool
+	AgentApiKey  secret.Secret
+	ProcRoot     string
+
+	ShutdownTimeout time.Duration
+	Peers           []string
+	Advertise       string
+	Heartbeat       time.Duration
+
+	BreakerFailures    int
+	BreakerCooldown    time.Duration
+	BreakerMaxCooldown time.Duration
+
+	Record string
 }
 
 type ApplicationResponse struct {
@@ -42,50 +82,91 @@ type ApplicationSummary struct {
 	InstanceCount float64 `json:"instance_count"`
 }
 
+// Check is a single thing for nudger to poll. Type selects the source used to
+// poll it, and the remaining fields are interpreted by that source.
 type Check struct {
-	NRAppId  int      `json:"nr_app_id"`
-	NRApiKey string   `json:"nr_api_key"`
-	ApiKey   string   `json:"api_key"`
-	Tags     []string `json:"tags"`
+	ID        string            `json:"id,omitempty"`
+	Type      string            `json:"type"`
+	NRAppId   int               `json:"nr_app_id"`
+	NRApiKey  secret.Secret     `json:"nr_api_key"`
+	URL       string            `json:"url"`
+	Address   string            `json:"address"`
+	Hostname  string            `json:"hostname"`
+	Record    string            `json:"record"`
+	Resolver  string            `json:"resolver"`
+	Method    string            `json:"method"`
+	Headers   map[string]string `json:"headers"`
+	Username  string            `json:"username"`
+	Password  secret.Secret     `json:"password"`
+	Paths     []JSONPath        `json:"paths"`
+	Expect    []string          `json:"expect"`
+	Series    []string          `json:"series"`
+	Quantiles []float64         `json:"quantiles"`
+	File      string            `json:"file"`
+	Patterns  []LogPattern      `json:"patterns"`
+	Name      string            `json:"name"`
+	Driver    string            `json:"driver"`
+	DSN       string            `json:"dsn"`
+	Query     string            `json:"query"`
+	Timeout   float64           `json:"timeout"`
+	ApiKey    secret.Secret     `json:"api_key"`
+	Tags      []string          `json:"tags"`
+}
+
+// Key identifies a check, for sources that keep state between polls. Any
+// change to the check's configuration gives it a new key.
+func (c Check) Key() string {
+	b, _ := json.Marshal(c)
+	return fmt.Sprintf("%x", sha1.Sum(b))
 }
 
 type Metric struct {
-	ApiKey string   `json:"api_key"`
-	Check  string   `json:"check"`
-	Metric float64  `json:"metric"`
-	TTL    int      `json:"ttl"`
-	Tags   []string `json:"tags"`
+	ApiKey secret.Secret `json:"api_key"`
+	Check  string        `json:"check"`
+	Metric float64       `json:"metric"`
+	TTL    int           `json:"ttl"`
+	Tags   []string      `json:"tags"`
+
+	// trace is the ID of the poll's trace, if the metric came from polling.
+	trace string
+	// at is when the metric was measured, if its source says.
+	at time.Time
 }
 
-func PollNR(check Check, metrics chan Metric) {
+func PollNR(ctx context.Context, check Check, metrics chan Metric) {
 	appid := strconv.Itoa(check.NRAppId)
 	parts := []string{"https://api.newrelic.com/v2/applications/", appid, ".json"}
 	url := strings.Join(parts, "")
 
-	client := &http.Client{Timeout: time.Second * 5}
-	req, err := http.NewRequest("GET", url, nil)
+	client := &http.Client{Timeout: time.Second * 5, Transport: Breakers}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
-		log.Printf("[error] PollNR: new request: %s\n", err)
+		Logf(ctx, "[error] PollNR: new request: %s\n", err)
 		return
 	}
-	req.Header.Set("X-Api-Key", check.NRApiKey)
+	req.Header.Set("X-Api-Key", check.NRApiKey.Reveal())
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("[error] PollNR: client do: %s\n", err)
+		Logf(ctx, "[error] PollNR: client do: %s\n", err)
 		return
 	}
+	defer resp.Body.Close()
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Printf("[error] PollNR: couldn't read body: %s\n", err)
+		Logf(ctx, "[error] PollNR: couldn't read body: %s\n", err)
+		return
+	}
+	if resp.StatusCode != 200 {
+		Logf(ctx, "[error] PollNR: app %s: HTTP %d: %s\n", appid, resp.StatusCode, string(body))
 		return
 	}
 
 	var app ApplicationResponse
 	err = json.Unmarshal(body, &app)
 	if err != nil {
-		log.Printf("[error] PollNR: couldn't decode json: %s", err)
+		Logf(ctx, "[error] PollNR: couldn't decode json: %s", err)
 		return
 	}
 
@@ -101,121 +182,535 @@ func PollNR(check Check, metrics chan Metric) {
 	metrics <- m
 }
 
-func PollChecks(config Config, checks *[]Check) {
+// sources maps a check type to the function that polls it. Checks without a
+// type are New Relic checks, as that was the only source nudger used to have.
+var sources = map[string]func(context.Context, Check, chan Metric){
+	"":           PollNR,
+	"new_relic":  PollNR,
+	"http_json":  PollJSON,
+	"http_probe": PollProbe,
+	"tcp":        PollTCP,
+	"tls":        PollTLS,
+	"dns":        PollDNS,
+	"prometheus": PollPrometheus,
+	"log":        PollLog,
+	"sql":        PollSQL,
+}
+
+// checkTarget describes what a check polls, for titling its traces.
+func checkTarget(check Check) string {
+	for _, target := range []string{check.URL, check.Address, check.Hostname, check.File, check.Name} {
+		if target != "" {
+			return target
+		}
+	}
+	return "app " + strconv.Itoa(check.NRAppId)
+}
+
+// Poll polls a check with the source for its type, tracing the poll and
+// recording how long it took. Metrics the poll emits carry its trace ID to
+// Dispatch.
+func Poll(ctx context.Context, check Check, metrics chan Metric) {
+	poll, ok := sources[check.Type]
+	if !ok {
+		log.Printf("[error] Poll: unknown check type %q\n", check.Type)
+		return
+	}
+	source := check.Type
+	if source == "" {
+		source = "new_relic"
+	}
+	ctx, tr := NewTrace(ctx, "nudger.Poll."+source, checkTarget(check))
+	defer tr.Finish()
+	ctx = WithBreakerCheck(ctx, checkTarget(check))
+	ctx = logging.WithFields(ctx, logging.Fields{"check": checkTarget(check), "source": source})
+
+	emitted := make(chan Metric)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for m := range emitted {
+			Tracef(ctx, "emitted %s = %g", m.Check, m.Metric)
+			m.trace = TraceID(ctx)
+			metrics <- m
+		}
+	}()
+
+	start := time.Now()
+	poll(ctx, check, emitted)
+	close(emitted)
+	<-done
+	Stats.Polled(source, time.Since(start))
+}
+
+// PollCycle polls every check, tracing the cycle as a whole as well as each
+// poll. The cycle's trace finishes once every poll has. Cancelling ctx
+// cancels the polls.
+func PollCycle(ctx context.Context, checks []Check, metrics chan Metric) {
+	ctx, tr := NewTrace(ctx, "nudger.PollCycle", fmt.Sprintf("%d checks", len(checks)))
+	defer tr.Finish()
+
+	var wg sync.WaitGroup
+	for _, c := range checks {
+		wg.Add(1)
+		go func(c Check) {
+			defer wg.Done()
+			Poll(ctx, c, metrics)
+		}(c)
+	}
+	wg.Wait()
+	PruneLogTails(checks)
+	PruneDNSAnswers(checks)
+}
+
+// PollChecks fetches checks every interval, until ctx is cancelled.
+func PollChecks(ctx context.Context, config Config, checks *CheckSet) {
 	defer func() {
 		if r := recover(); r != nil {
 			log.Println("[error] PollChecks: unhandled panic when polling for checks:", r)
 		}
 	}()
 
+	events := trace.NewEventLog("nudger.PollChecks", config.Api)
+	defer events.Finish()
+
+	fetcher := NewChecksFetcher(config)
+
 	tick := time.NewTicker(config.Interval).C
 	for {
 		select {
 		case <-tick:
 			log.Println("[info] PollChecks: tick")
-			client := &http.Client{Timeout: config.Timeout}
-			req, err := http.NewRequest("GET", config.Api, nil)
+			fetchCtx, tr := NewTrace(ctx, "nudger.PollChecks", config.Api)
+			fetched, changed, err := fetcher.Fetch(fetchCtx)
 			if err != nil {
-				log.Printf("[error] PollChecks: new request: %s\n", err)
+				Logf(fetchCtx, "[error] PollChecks: %s\n", err)
+				events.Errorf("trace=%s: %s", TraceID(fetchCtx), err)
+				Stats.ChecksFailed()
+				tr.Finish()
 				continue
 			}
-			req.SetBasicAuth(config.MasterApiKey, "")
-
-			resp, err := client.Do(req)
-			if err != nil {
-				log.Printf("[error] PollChecks: client do: %s\n", err)
-				continue
+			if changed {
+				checks.Replace(fetched)
+				Tracef(fetchCtx, "decoded %d checks", len(fetched))
+				events.Printf("fetched %d checks", len(fetched))
+			} else {
+				Tracef(fetchCtx, "%d checks unchanged", len(fetched))
 			}
+			Stats.ChecksLoaded(len(fetched))
+			tr.Finish()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
-			body, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				log.Printf("[error] PollChecks: couldn't read body: %s\n", err)
-				continue
+// NewPacemakerClient creates a client for submitting metrics to Pacemaker,
+// which records its attempts in the dispatch's trace, and its requests as
+// fixtures with --record. Metrics carry their own API keys, so it doesn't
+// need one.
+func NewPacemakerClient(config Config) *pacemaker.Client {
+	client := pacemaker.New(config.Pacemaker, secret.Secret{})
+	client.Trace = Tracef
+	if Recording != nil {
+		client.HTTP.Transport = Recording.Wrap(client.HTTP.Transport)
+	}
+	return client
+}
+
+// submission is what's submitted to Pacemaker for a metric.
+func (m Metric) submission() pacemaker.Metric {
+	return pacemaker.Metric{ApiKey: m.ApiKey, Check: m.Check, Metric: m.Metric, TTL: m.TTL, Tags: m.Tags}
+}
+
+// dispatchTraced dispatches a metric in a trace of its own, which records the
+// trace of the poll that emitted it.
+func dispatchTraced(ctx context.Context, client *pacemaker.Client, events trace.EventLog, metric Metric) error {
+	ctx, tr := NewTrace(ctx, "nudger.Dispatch", metric.Check)
+	defer tr.Finish()
+	if metric.trace != "" {
+		Tracef(ctx, "polled in trace=%s", metric.trace)
+	}
+	Logf(ctx, "[debug] Dispatch: %+v", metric)
+
+	err := client.SubmitMetric(ctx, metric.submission())
+	if err != nil {
+		Logf(ctx, "[error] Dispatch: %s\n", err)
+		events.Errorf("trace=%s: %s", TraceID(ctx), err)
+	}
+	Stats.Dispatched(err == nil)
+	return err
+}
+
+// Dispatch submits metrics to Pacemaker until ctx is cancelled. It then
+// drains the queue, until everything producing metrics is finished (when
+// finished is closed) and the queue is empty, or config.ShutdownTimeout
+// passes. It returns what happened to the metrics dispatched while draining.
+// Metrics for checks with config.Windows are rolled up, and dispatched as
+// their windows close.
+func Dispatch(ctx context.Context, config Config, metrics chan Metric, finished <-chan struct{}) DrainSummary {
+	events := trace.NewEventLog("nudger.Dispatch", config.Pacemaker)
+	defer events.Finish()
+	// Metrics are dispatched one at a time, so retrying one while Pacemaker
+	// is unreachable would hold up the rest. Metrics that fail while
+	// draining are spooled instead.
+	client := NewPacemakerClient(config)
+	client.Retries = 0
+	aggregator := NewWindowAggregator(config.Windows)
+	var flushes <-chan time.Time
+	if aggregator != nil {
+		ticker := time.NewTicker(windowFlushInterval)
+		defer ticker.Stop()
+		flushes = ticker.C
+	}
+
+	for {
+		select {
+		case metric := <-metrics:
+			if !aggregator.Add(metric) {
+				dispatchTraced(context.Background(), client, events, metric)
 			}
-			err = json.Unmarshal(body, &checks)
-			if err != nil {
-				log.Printf("[error] PollChecks: couldn't decode checks: %s\n", err)
-				log.Printf("[error] PollChecks: response body: %s\n", string(body))
-				continue
+		case <-flushes:
+			for _, metric := range aggregator.Flush() {
+				dispatchTraced(context.Background(), client, events, metric)
 			}
+		case <-ctx.Done():
+			summary := drainQueue(config, client, events, aggregator, metrics, finished, config.ShutdownTimeout)
+			events.Printf("drained: %s", summary)
+			return summary
 		}
 	}
 }
 
-func Dispatch(config Config, metrics chan Metric) {
-	url := config.Pacemaker
-	for {
-		metric := <-metrics
-		log.Printf("[debug] Dispatch: %+v", metric)
+// Listen serves nudger's HTTP endpoints: its own metrics, health and traces,
+// and InfluxDB writes.
+func Listen(config Config, metrics chan Metric, checks *CheckSet) {
+	router := http.NewServeMux()
+	router.Handle("/metrics", metricsHandler(Stats, Breakers, metrics))
+	router.Handle("/breakers", breakersHandler(Breakers))
+	router.Handle("/healthz", healthHandler(Stats, config))
+	router.Handle("/readyz", readyHandler(Stats, config))
+	router.Handle("/write", &influxHandler{metrics: metrics, keys: config.InfluxKeys})
+	router.HandleFunc("/ping", influxPing)
+	router.HandleFunc("/debug/requests", trace.Traces)
+	router.HandleFunc("/debug/events", trace.Events)
+	router.Handle("/debug/loglevel", logging.Default.Handler())
+	if Shard != nil {
+		router.Handle("/peers", Shard)
+	}
+	if checks != nil {
+		router.Handle("/checks/events", checkEventsHandler(checks, config.MasterApiKey))
+	}
+
+	log.Fatal(http.ListenAndServe(config.ListenBind, router))
+}
 
-		body, err := json.Marshal(metric)
+// ListenTCP accepts TCP connections on bind, and serves each with serve.
+func ListenTCP(bind string, serve func(io.Reader)) {
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		log.Fatalf("[error] ListenTCP: couldn't listen on %s: %s\n", bind, err)
+	}
+	log.Printf("[info] ListenTCP: listening on %s\n", listener.Addr())
+	for {
+		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("[error] Dispatch: JSON marshal: %s\n", err)
+			log.Printf("[error] ListenTCP: accept: %s\n", err)
 			continue
 		}
-		log.Printf("[debug] Dispatch: JSON marshal: %s", string(body))
+		go func() {
+			defer conn.Close()
+			serve(conn)
+		}()
+	}
+}
+
+var (
+	api          = kingpin.Flag("endpoint", "API endpoint to fetch checks").Default("https://radalert.io/api/v1/checks/new_relic.nudger").OverrideDefaultFromEnvar("API").String()
+	changes      = kingpin.Flag("changes", "API endpoint to fetch changes to checks since a cursor, instead of every check each time").OverrideDefaultFromEnvar("CHANGES").String()
+	pacemakerURL = kingpin.Flag("pacemaker", "Pacemaker instance to submit heartbeats to").Default("http://130.211.158.50:7223").OverrideDefaultFromEnvar("PACEMAKER").String()
+	statsd       = kingpin.Flag("statsd", "UDP address to receive StatsD metrics on, as address[=NAME], where the API key is in NAME or NAME_FILE (repeatable)").Strings()
+	flush        = kingpin.Flag("statsd-flush", "Interval to aggregate StatsD metrics over").Default("30s").Duration()
+	graphite     = kingpin.Flag("graphite", "TCP address to receive Graphite plaintext metrics on").String()
+	pickle       = kingpin.Flag("graphite-pickle", "TCP address to receive Graphite pickled metrics on").String()
+	rules        = kingpin.Flag("graphite-rules", "JSON file of rules mapping Graphite paths to checks").String()
+	windows      = kingpin.Flag("windows", "JSON file of rules rolling metrics up over windows before dispatching them").String()
+	syslog       = kingpin.Flag("syslog", "UDP and TCP address to receive syslog on").String()
+	sflush       = kingpin.Flag("syslog-flush", "Interval to aggregate syslog metrics over").Default("30s").Duration()
+	drains       = kingpin.Flag("syslog-drain", "Drain token or hostname to accept syslog from, as token=NAME, where the API key is in NAME or NAME_FILE (repeatable)").StringMap()
+	influxKeys   = kingpin.Flag("influx-key", "NAME of an API key InfluxDB writes may use, where the key is in NAME or NAME_FILE (repeatable)").Strings()
+	agent        = kingpin.Flag("agent", "Run as a host agent, reporting this host's metrics instead of polling checks").Bool()
+	proc         = kingpin.Flag("proc", "Where procfs is mounted, for the host agent").Default("/proc").String()
+	state        = kingpin.Flag("state-dir", "Directory to keep state in across restarts").OverrideDefaultFromEnvar("STATE_DIR").String()
+	peers        = kingpin.Flag("peer", "URL of another nudger to share checks with (repeatable)").Strings()
+	advertise    = kingpin.Flag("advertise", "URL other nudgers can reach this one's --listen address at, when sharing checks").OverrideDefaultFromEnvar("ADVERTISE").String()
+	failures     = kingpin.Flag("breaker-failures", "Failed requests in a row to an endpoint or with a credential before polls using it are paused").Default("5").Int()
+	cooldown     = kingpin.Flag("breaker-cooldown", "How long to pause polls using a failing endpoint or credential before trying again").Default("5m").Duration()
+	maxcool      = kingpin.Flag("breaker-max-cooldown", "Longest pause, as it doubles each time trying again fails").Default("1h").Duration()
+	record       = kingpin.Flag("record", "Directory to record requests to sources and Pacemaker in, as test fixtures").String()
+	loglevel     = kingpin.Flag("log-level", "Least important level to log: debug, info, warn or error").Default("info").OverrideDefaultFromEnvar("LOG_LEVEL").String()
+	logformat    = kingpin.Flag("log-format", "Format to log in: text, logfmt or json").Default("text").OverrideDefaultFromEnvar("LOG_FORMAT").String()
+	shutdown     = kingpin.Flag("shutdown-timeout", "How long to spend finishing polls and dispatching queued metrics on SIGTERM").Default("20s").Duration()
+	listen       = kingpin.Flag("listen", "HTTP address to serve metrics, health checks and InfluxDB writes on").Default(":8086").OverrideDefaultFromEnvar("LISTEN").String()
+)
+
+// secretName is what the names of secrets given on the command line look
+// like: upper case environment variables, unlike API keys.
+var secretName = regexp.MustCompile(`^[A-Z_][A-Z0-9_]*$`)
+
+// loadNamedSecret loads a secret whose name was given on the command line,
+// e.g. the STATSD_APIKEY in --statsd=:8126=STATSD_APIKEY. The name is checked
+// first, so a credential given by mistake isn't repeated in the error.
+func loadNamedSecret(name string) (secret.Secret, error) {
+	if !secretName.MatchString(name) {
+		return secret.Secret{}, fmt.Errorf("expected the name of an environment variable holding the API key, not the key itself")
+	}
+	return secret.Load(name)
+}
 
-		client := &http.Client{Timeout: time.Second * 5}
-		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+func main() {
+	kingpin.Version("1.0.0")
+	// Without a command, nudger polls checks.
+	command := kingpin.MustParse(kingpin.CommandLine.Parse(os.Args[1:]))
+	if err := logging.Setup("nudger", *logformat, *loglevel); err != nil {
+		log.Fatalf("[error] Main: %s\n", err)
+	}
+
+	config := Config{
+		Interval:    time.Second * 30,
+		Api:         *api,
+		Changes:     *changes,
+		Pacemaker:   *pacemakerURL,
+		Timeout:     time.Second * 5,
+		StatsdFlush: *flush,
+		Graphite:    *graphite,
+		Pickle:      *pickle,
+		ListenBind:  *listen,
+		StateDir:    *state,
+		Syslog:      *syslog,
+		SyslogFlush: *sflush,
+		Agent:       *agent,
+		ProcRoot:    *proc,
+
+		ShutdownTimeout: *shutdown,
+		Peers:           *peers,
+		Advertise:       *advertise,
+		Heartbeat:       time.Second * 10,
+
+		BreakerFailures:    *failures,
+		BreakerCooldown:    *cooldown,
+		BreakerMaxCooldown: *maxcool,
+
+		Record: *record,
+	}
+	if *rules != "" {
+		r, err := LoadGraphiteRules(*rules)
 		if err != nil {
-			log.Printf("[error] Dispatch: new request: %s\n", err)
-			continue
+			log.Fatalf("[error] Main: graphite rules: %s\n", err)
 		}
+		config.Rules = r
+	}
+	if *windows != "" {
+		w, err := LoadWindowRules(*windows)
+		if err != nil {
+			log.Fatalf("[error] Main: windows: %s\n", err)
+		}
+		config.Windows = w
+	}
+	if command != "" {
+		kingpin.FatalIfError(RunCommand(command, config, os.Stdout), "")
+		return
+	}
+
+	fmt.Println("nudgers gonna nudge nudge nudge nudge")
 
-		resp, err := client.Do(req)
+	// Secrets are only read from the environment or mounted files, so they
+	// don't show up in ps or shell history, and there are no defaults.
+	var err error
+	if config.Agent {
+		config.AgentApiKey, err = secret.Load("AGENT_APIKEY")
+	}
+	if err == nil && (!config.Agent || len(config.Peers) > 0) {
+		config.MasterApiKey, err = secret.Load("APIKEY")
+	}
+	for _, s := range *statsd {
 		if err != nil {
-			log.Printf("[error] Dispatch: client do: %s\n", err)
-			continue
+			break
+		}
+		var l StatsdListener
+		l, err = ParseStatsdListener(s)
+		config.Statsd = append(config.Statsd, l)
+	}
+	config.SyslogDrains = map[string]secret.Secret{}
+	for token, name := range *drains {
+		if err != nil {
+			break
+		}
+		config.SyslogDrains[token], err = loadNamedSecret(name)
+		if err != nil {
+			err = fmt.Errorf("--syslog-drain %s: %s", token, err)
+		}
+	}
+	for _, name := range *influxKeys {
+		if err != nil {
+			break
 		}
+		var key secret.Secret
+		key, err = loadNamedSecret(name)
+		if err != nil {
+			err = fmt.Errorf("--influx-key %s: %s", name, err)
+		}
+		config.InfluxKeys = append(config.InfluxKeys, key)
+	}
+	if err != nil {
+		log.Fatalf("[error] Main: %s\n", err)
+	}
+	log.Printf("[debug] Main: config: %+v\n", config)
 
-		body, err = ioutil.ReadAll(resp.Body)
+	if config.StateDir != "" {
+		LogTailers.StateFile = filepath.Join(config.StateDir, "log-positions.json")
+	} else {
+		log.Println("[warn] Main: no --state-dir, so metrics still queued at shutdown will be dropped rather than spooled")
+	}
+	Breakers = NewBreakerSet(config.BreakerFailures, config.BreakerCooldown, config.BreakerMaxCooldown)
+	if config.Record != "" {
+		recorder, err := NewRecorder(config.Record)
 		if err != nil {
-			log.Printf("[error] Dispatch: couldn't read body: %s\n", err)
-			continue
+			log.Fatalf("[error] Main: couldn't record: %s\n", err)
 		}
+		Recording = recorder
+		Breakers.Next = Recording.Wrap(Breakers.Next)
+		log.Printf("[info] Main: recording requests to sources and Pacemaker in %s\n", config.Record)
+	}
 
-		if resp.StatusCode != 200 {
-			log.Printf("[error] Dispatch: Pacemaker returned HTTP %d: %s\n", resp.StatusCode, string(body))
+	// ctx is cancelled on SIGTERM, to stop scheduling polls and have receivers
+	// flush. Polls in flight and Dispatch have contexts of their own, so they
+	// can finish what they're doing first.
+	ctx, stop := context.WithCancel(context.Background())
+	pollCtx, cancelPolls := context.WithCancel(context.Background())
+	dispatchCtx, drain := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-signals
+		log.Printf("[info] Main: received %s, shutting down\n", sig)
+		// Draining first means receivers' final flushes are spooled if they
+		// can't be dispatched.
+		drain()
+		stop()
+	}()
+
+	metrics := make(chan Metric, 1024)
+	drained := make(chan DrainSummary)
+	finished := make(chan struct{})
+	go func() {
+		drained <- Dispatch(dispatchCtx, config, metrics, finished)
+	}()
+
+	if path := spoolPath(config); path != "" {
+		spooled, err := UnspoolMetrics(path)
+		if err != nil {
+			log.Printf("[error] Main: spool: %s\n", err)
 		}
+		if len(spooled) > 0 {
+			log.Printf("[info] Main: dispatching %d metrics spooled at last shutdown\n", len(spooled))
+		}
+		go func() {
+			for _, m := range spooled {
+				metrics <- m
+			}
+		}()
 	}
-}
 
-var (
-	apikey    = kingpin.Flag("apikey", "Master API key for authenticating to console").Default("r4d4l3rt").OverrideDefaultFromEnvar("APIKEY").String()
-	api       = kingpin.Flag("endpoint", "API endpoint to fetch checks").Default("https://radalert.io/api/v1/checks/new_relic.nudger").OverrideDefaultFromEnvar("API").String()
-	pacemaker = kingpin.Flag("pacemaker", "Pacemaker instance to submit heartbeats to").Default("http://130.211.158.50:7223").OverrideDefaultFromEnvar("PACEMAKER").String()
-)
+	for _, l := range config.Statsd {
+		ListenStatsd(ctx, config, l, metrics)
+	}
 
-func main() {
-	kingpin.Version("1.0.0")
-	kingpin.Parse()
+	receiver := &GraphiteReceiver{Rules: config.Rules, Metrics: metrics}
+	if config.Graphite != "" {
+		go ListenTCP(config.Graphite, receiver.ServePlaintext)
+	}
+	if config.Pickle != "" {
+		go ListenTCP(config.Pickle, receiver.ServePickle)
+	}
 
-	fmt.Println("nudgers gonna nudge nudge nudge nudge")
+	if config.Syslog != "" {
+		ListenSyslog(ctx, config, metrics)
+	}
 
-	config := Config{
-		Interval:     time.Second * 30,
-		MasterApiKey: *apikey,
-		Api:          *api,
-		Pacemaker:    *pacemaker,
-		Timeout:      time.Second * 5,
+	if len(config.Peers) > 0 {
+		if config.Advertise == "" || config.ListenBind == "" {
+			log.Fatalf("[error] Main: sharing checks with --peer needs --advertise and --listen\n")
+		}
+		Shard = NewCluster(config.Advertise, config.Peers, config.MasterApiKey, config.Heartbeat)
+		go Shard.Run(ctx, config.Heartbeat)
 	}
-	log.Printf("[debug] Main: config: %+v\n", config)
 
-	var checks []Check
-	go PollChecks(config, &checks)
+	var checks *CheckSet
+	if !config.Agent {
+		checks = &CheckSet{}
+	}
+	if config.ListenBind != "" {
+		go Listen(config, metrics, checks)
+	}
 
-	metrics := make(chan Metric)
-	go Dispatch(config, metrics)
+	var cycles sync.WaitGroup
+	if config.Agent {
+		RunAgent(ctx, config, metrics)
+	} else {
+		go PollChecks(ctx, config, checks)
 
-	tick := time.NewTicker(time.Second * 30).C
-	for {
-		select {
-		case <-tick:
-			log.Println("[info] Main: tick")
-			log.Println("[info] Main: number of checks:", len(checks))
-			for _, c := range checks {
-				go PollNR(c, metrics)
+		// When checks are shared, they're divided up afresh for each window
+		// of config.Interval, and the last window polled is remembered so a
+		// leaving instance can finish polling its checks for the current one.
+		var polled time.Time
+		cycle := func(now time.Time) {
+			all := checks.All()
+			owned := all
+			if Shard != nil {
+				window := now.Truncate(config.Interval)
+				if window.Equal(polled) {
+					log.Printf("[warn] Main: already polled the window starting %s\n", window.Format(time.RFC3339))
+					return
+				}
+				polled = window
+				owned = Shard.Owned(all, polled)
+				Stats.Sharded(len(Shard.Members(polled)), len(owned))
+				log.Printf("[info] Main: polling %d of %d checks\n", len(owned), len(all))
+			}
+			cycles.Add(1)
+			go func(checks []Check) {
+				defer cycles.Done()
+				PollCycle(pollCtx, checks, metrics)
+			}(owned)
+		}
+
+		var tick <-chan time.Time
+		if Shard != nil {
+			tick = windowTicks(ctx, config.Interval)
+		} else {
+			tick = time.NewTicker(config.Interval).C
+		}
+	poll:
+		for {
+			select {
+			case now := <-tick:
+				log.Println("[info] Main: tick")
+				log.Println("[info] Main: number of checks:", len(checks.All()))
+				cycle(now)
+			case <-ctx.Done():
+				break poll
+			}
+		}
+
+		if Shard != nil {
+			now := time.Now()
+			Shard.Leave(context.Background(), now, config.Interval)
+			if polled.Before(now.Truncate(config.Interval)) {
+				cycle(now)
 			}
 		}
 	}
+
+	Shutdown(config, &cycles, cancelPolls, drain, finished, drained)
 }
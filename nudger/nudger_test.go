@@ -1,77 +1,68 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"io/ioutil"
-	"log"
+	"github.com/radalert/layer4/pacemaker"
+	"github.com/radalert/layer4/secret"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 )
 
-func MockApi(bind string) {
-	http.HandleFunc("/api/v1/checks/new_relic.nudger", func(w http.ResponseWriter, r *http.Request) {
+// MockApi serves checks like the console's API.
+func MockApi() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		checks := []Check{
-			Check{NRAppId: 123, NRApiKey: "abc", ApiKey: "def"},
-			Check{NRAppId: 123, NRApiKey: "ghi", ApiKey: "jkl"},
-			Check{NRAppId: 123, NRApiKey: "mno", ApiKey: "qrs"},
+			Check{NRAppId: 123, NRApiKey: secret.New("abc"), ApiKey: secret.New("def")},
+			Check{NRAppId: 123, NRApiKey: secret.New("ghi"), ApiKey: secret.New("jkl")},
+			Check{NRAppId: 123, NRApiKey: secret.New("mno"), ApiKey: secret.New("qrs")},
 		}
 		b, _ := json.Marshal(checks)
 		w.Write(b)
-	})
-	log.Fatal(http.ListenAndServe(bind, nil))
-}
-
-func MockPacemaker(bind string, requests chan string) {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		var m Metric
-		body, _ := ioutil.ReadAll(r.Body)
-		_ = json.Unmarshal(body, &m)
-		requests <- m.Check
-	})
-	log.Fatal(http.ListenAndServe(bind, nil))
+	}))
 }
 
 func TestPollChecks(t *testing.T) {
-	go MockApi("127.0.0.1:42424")
+	server := MockApi()
+	defer server.Close()
 	config := Config{
 		Interval:     1 * time.Millisecond,
-		MasterApiKey: "r4d4l3rt",
-		Api:          "http://127.0.0.1:42424/api/v1/checks/new_relic.nudger",
+		MasterApiKey: secret.New("r4d4l3rt"),
+		Api:          server.URL + "/api/v1/checks/new_relic.nudger",
 		Timeout:      5 * time.Second,
 	}
-	var checks []Check
-	go PollChecks(config, &checks)
+	checks := &CheckSet{}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go PollChecks(ctx, config, checks)
 	time.Sleep(10 * time.Millisecond)
 
-	if len(checks) == 0 {
+	if len(checks.All()) == 0 {
 		t.Errorf("No checks, got %+v\n", config)
 	}
 
-	t.Logf("checks: %d\n", len(checks))
+	t.Logf("checks: %d\n", len(checks.All()))
 }
 
 func TestDispatch(t *testing.T) {
-	requests := make(chan string)
-	go MockPacemaker("127.0.0.1:42224", requests)
+	server := pacemaker.NewFakeServer()
+	defer server.Close()
 
 	config := Config{
-		Pacemaker: "http://127.0.0.1:42224",
+		Pacemaker: server.URL,
 	}
 	metrics := make(chan Metric)
-	go Dispatch(config, metrics)
-	go func() {
-		time.Sleep(1 * time.Second)
-		requests <- "false"
-	}()
+	go Dispatch(context.Background(), config, metrics, nil)
 
-	metrics <- Metric{Check: "true"}
+	metrics <- Metric{ApiKey: secret.New("abc"), Check: "true", Metric: 1, TTL: 400}
 
-	request := <-requests
-	switch request {
-	case "true":
-		t.Logf("Dispatched.")
-	case "false":
+	dispatched := server.WaitForMetrics(1, time.Second)
+	if len(dispatched) != 1 {
 		t.Fatal("Expected dispatch to pacemaker, got nothing after 1 second.")
 	}
+	if m := dispatched[0]; m.Check != "true" || m.ApiKey.Reveal() != "abc" || m.TTL != 400 {
+		t.Errorf("Expected the metric to be dispatched, got %+v\n", m)
+	}
 }
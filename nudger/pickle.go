@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Unpickle decodes the subset of Python's pickle format that Graphite
+// clients send: lists and tuples (both decoded as []interface{}) of strings,
+// integers (int64), floats (float64), booleans and None.
+//
+// Protocols 0 through 4 are understood. Anything that would construct an
+// arbitrary Python object is rejected.
+func Unpickle(data []byte) (interface{}, error) {
+	u := &unpickler{data: data, memo: map[int]interface{}{}}
+	return u.run()
+}
+
+type unpickler struct {
+	data  []byte
+	pos   int
+	stack []interface{}
+	marks []int
+	memo  map[int]interface{}
+}
+
+// pickleMark sits on the stack between a MARK opcode and the opcode that
+// consumes everything after it.
+type pickleMark struct{}
+
+func (u *unpickler) read(n int) ([]byte, error) {
+	if u.pos+n > len(u.data) {
+		return nil, fmt.Errorf("pickle truncated at byte %d", u.pos)
+	}
+	b := u.data[u.pos : u.pos+n]
+	u.pos += n
+	return b, nil
+}
+
+func (u *unpickler) readLine() (string, error) {
+	end := bytes.IndexByte(u.data[u.pos:], '\n')
+	if end < 0 {
+		return "", fmt.Errorf("pickle truncated at byte %d", u.pos)
+	}
+	line := string(u.data[u.pos : u.pos+end])
+	u.pos += end + 1
+	return line, nil
+}
+
+func (u *unpickler) readUint(n int) (int, error) {
+	b, err := u.read(n)
+	if err != nil {
+		return 0, err
+	}
+	v := 0
+	for i := n - 1; i >= 0; i-- {
+		v = v<<8 | int(b[i])
+	}
+	return v, nil
+}
+
+func (u *unpickler) push(v interface{}) {
+	u.stack = append(u.stack, v)
+}
+
+func (u *unpickler) pop() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, fmt.Errorf("pickle stack underflow at byte %d", u.pos)
+	}
+	v := u.stack[len(u.stack)-1]
+	u.stack = u.stack[:len(u.stack)-1]
+	return v, nil
+}
+
+func (u *unpickler) top() (interface{}, error) {
+	if len(u.stack) == 0 {
+		return nil, fmt.Errorf("pickle stack underflow at byte %d", u.pos)
+	}
+	return u.stack[len(u.stack)-1], nil
+}
+
+// popMark pops everything pushed since the last MARK.
+func (u *unpickler) popMark() ([]interface{}, error) {
+	if len(u.marks) == 0 {
+		return nil, fmt.Errorf("pickle has no mark at byte %d", u.pos)
+	}
+	mark := u.marks[len(u.marks)-1]
+	u.marks = u.marks[:len(u.marks)-1]
+	if mark > len(u.stack) {
+		return nil, fmt.Errorf("pickle stack underflow at byte %d", u.pos)
+	}
+	items := append([]interface{}{}, u.stack[mark:]...)
+	u.stack = u.stack[:mark]
+	return items, nil
+}
+
+func (u *unpickler) tuple(n int) error {
+	if len(u.stack) < n {
+		return fmt.Errorf("pickle stack underflow at byte %d", u.pos)
+	}
+	items := append([]interface{}{}, u.stack[len(u.stack)-n:]...)
+	u.stack = u.stack[:len(u.stack)-n]
+	u.push(items)
+	return nil
+}
+
+// appendTo appends items to the list on top of the stack.
+func (u *unpickler) appendTo(items ...interface{}) error {
+	if len(u.stack) == 0 {
+		return fmt.Errorf("pickle stack underflow at byte %d", u.pos)
+	}
+	list, ok := u.stack[len(u.stack)-1].([]interface{})
+	if !ok {
+		return fmt.Errorf("pickle appends to non-list at byte %d", u.pos)
+	}
+	u.stack[len(u.stack)-1] = append(list, items...)
+	return nil
+}
+
+func (u *unpickler) run() (interface{}, error) {
+	for {
+		op, err := u.read(1)
+		if err != nil {
+			return nil, err
+		}
+
+		switch op[0] {
+		case 0x80: // PROTO
+			_, err = u.read(1)
+		case 0x95: // FRAME
+			_, err = u.read(8)
+		case '.': // STOP
+			return u.pop()
+		case '(': // MARK
+			u.marks = append(u.marks, len(u.stack))
+		case ']': // EMPTY_LIST
+			u.push([]interface{}{})
+		case ')': // EMPTY_TUPLE
+			u.push([]interface{}{})
+		case 'l', 't': // LIST, TUPLE
+			var items []interface{}
+			items, err = u.popMark()
+			u.push(items)
+		case 0x85, 0x86, 0x87: // TUPLE1, TUPLE2, TUPLE3
+			err = u.tuple(int(op[0]-0x85) + 1)
+		case 'a': // APPEND
+			var v interface{}
+			if v, err = u.pop(); err == nil {
+				err = u.appendTo(v)
+			}
+		case 'e': // APPENDS
+			var items []interface{}
+			if items, err = u.popMark(); err == nil {
+				err = u.appendTo(items...)
+			}
+		case 'N': // NONE
+			u.push(nil)
+		case 0x88: // NEWTRUE
+			u.push(true)
+		case 0x89: // NEWFALSE
+			u.push(false)
+		case 'I', 'L': // INT, LONG
+			var line string
+			if line, err = u.readLine(); err == nil {
+				err = u.pushInt(line)
+			}
+		case 'J': // BININT
+			var b []byte
+			if b, err = u.read(4); err == nil {
+				u.push(int64(int32(binary.LittleEndian.Uint32(b))))
+			}
+		case 'K': // BININT1
+			var v int
+			if v, err = u.readUint(1); err == nil {
+				u.push(int64(v))
+			}
+		case 'M': // BININT2
+			var v int
+			if v, err = u.readUint(2); err == nil {
+				u.push(int64(v))
+			}
+		case 0x8a: // LONG1
+			var n int
+			var b []byte
+			if n, err = u.readUint(1); err == nil {
+				if b, err = u.read(n); err == nil {
+					err = u.pushLong(b)
+				}
+			}
+		case 'F': // FLOAT
+			var line string
+			var f float64
+			if line, err = u.readLine(); err == nil {
+				if f, err = strconv.ParseFloat(line, 64); err == nil {
+					u.push(f)
+				}
+			}
+		case 'G': // BINFLOAT
+			var b []byte
+			if b, err = u.read(8); err == nil {
+				u.push(math.Float64frombits(binary.BigEndian.Uint64(b)))
+			}
+		case 'S': // STRING
+			var line string
+			if line, err = u.readLine(); err == nil {
+				var s string
+				if s, err = strconv.Unquote(line); err != nil {
+					// Python quotes with single quotes more often than not.
+					s, err = strconv.Unquote(`"` + strings.Replace(strings.Trim(line, `'`), `"`, `\"`, -1) + `"`)
+				}
+				u.push(s)
+			}
+		case 'V': // UNICODE
+			var line string
+			if line, err = u.readLine(); err == nil {
+				u.push(line)
+			}
+		case 'U', 'C', 0x8c: // SHORT_BINSTRING, SHORT_BINBYTES, SHORT_BINUNICODE
+			err = u.pushString(1)
+		case 'T', 'X', 'B': // BINSTRING, BINUNICODE, BINBYTES
+			err = u.pushString(4)
+		case 'p': // PUT
+			var line string
+			var i int
+			if line, err = u.readLine(); err == nil {
+				if i, err = strconv.Atoi(line); err == nil {
+					err = u.put(i)
+				}
+			}
+		case 'q': // BINPUT
+			var i int
+			if i, err = u.readUint(1); err == nil {
+				err = u.put(i)
+			}
+		case 'r': // LONG_BINPUT
+			var i int
+			if i, err = u.readUint(4); err == nil {
+				err = u.put(i)
+			}
+		case 0x94: // MEMOIZE
+			err = u.put(len(u.memo))
+		case 'g': // GET
+			var line string
+			var i int
+			if line, err = u.readLine(); err == nil {
+				if i, err = strconv.Atoi(line); err == nil {
+					err = u.get(i)
+				}
+			}
+		case 'h': // BINGET
+			var i int
+			if i, err = u.readUint(1); err == nil {
+				err = u.get(i)
+			}
+		case 'j': // LONG_BINGET
+			var i int
+			if i, err = u.readUint(4); err == nil {
+				err = u.get(i)
+			}
+		default:
+			return nil, fmt.Errorf("unsupported pickle opcode 0x%02x at byte %d", op[0], u.pos-1)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (u *unpickler) pushInt(line string) error {
+	line = strings.TrimSuffix(line, "L")
+	switch line {
+	case "00":
+		u.push(false)
+		return nil
+	case "01":
+		u.push(true)
+		return nil
+	}
+	v, err := strconv.ParseInt(line, 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad pickled integer %q", line)
+	}
+	u.push(v)
+	return nil
+}
+
+// pushLong pushes a little endian two's complement integer.
+func (u *unpickler) pushLong(b []byte) error {
+	if len(b) > 8 {
+		return fmt.Errorf("pickled integer of %d bytes is too big", len(b))
+	}
+	var v int64
+	for i := len(b) - 1; i >= 0; i-- {
+		v = v<<8 | int64(b[i])
+	}
+	if len(b) > 0 && len(b) < 8 && b[len(b)-1]&0x80 != 0 {
+		v -= 1 << uint(8*len(b))
+	}
+	u.push(v)
+	return nil
+}
+
+func (u *unpickler) pushString(lengthBytes int) error {
+	n, err := u.readUint(lengthBytes)
+	if err != nil {
+		return err
+	}
+	b, err := u.read(n)
+	if err != nil {
+		return err
+	}
+	u.push(string(b))
+	return nil
+}
+
+func (u *unpickler) put(i int) error {
+	v, err := u.top()
+	if err != nil {
+		return err
+	}
+	u.memo[i] = v
+	return nil
+}
+
+func (u *unpickler) get(i int) error {
+	v, ok := u.memo[i]
+	if !ok {
+		return fmt.Errorf("pickle memo has no entry %d", i)
+	}
+	u.push(v)
+	return nil
+}
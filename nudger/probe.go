@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"time"
+)
+
+// probeTimings records when each phase of a probe request finished.
+type probeTimings struct {
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	firstByte    time.Time
+}
+
+func (t *probeTimings) clientTrace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { t.dnsStart = time.Now() },
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.dnsDone = time.Now() },
+		ConnectStart:         func(string, string) { t.connectStart = time.Now() },
+		ConnectDone:          func(string, string, error) { t.connectDone = time.Now() },
+		TLSHandshakeStart:    func() { t.tlsStart = time.Now() },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.tlsDone = time.Now() },
+		GotFirstResponseByte: func() { t.firstByte = time.Now() },
+	}
+}
+
+// milliseconds returns the time between two instants in milliseconds, or
+// false if either never happened (e.g. no DNS lookup for an IP address).
+func milliseconds(from, to time.Time) (float64, bool) {
+	if from.IsZero() || to.IsZero() {
+		return 0, false
+	}
+	return float64(to.Sub(from)) / float64(time.Millisecond), true
+}
+
+// PollProbe makes a request to a check's URL, and emits how long each phase
+// of the request took, the size of the response, and the class of its status
+// code (2 for 2xx, 5 for 5xx, and 0 if no response was received at all).
+//
+// If the check has any expected strings, whether all of them appear in the
+// response body is emitted as 1 or 0.
+func PollProbe(ctx context.Context, check Check, metrics chan Metric) {
+	emit := func(name string, value float64) {
+		metrics <- Metric{
+			ApiKey: check.ApiKey,
+			Check:  check.URL + ": " + name,
+			Metric: value,
+			TTL:    400,
+			Tags:   check.Tags,
+		}
+	}
+
+	req, err := NewCheckRequest(ctx, check)
+	if err != nil {
+		Logf(ctx, "[error] PollProbe: %s: new request: %s\n", check.URL, err)
+		return
+	}
+
+	// Every probe uses a fresh connection, so connection setup is measured.
+	client := &http.Client{
+		Timeout:   time.Second * 5,
+		Transport: &http.Transport{DisableKeepAlives: true, Proxy: http.ProxyFromEnvironment},
+	}
+	timings := &probeTimings{}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), timings.clientTrace()))
+
+	timings.start = time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		Logf(ctx, "[error] PollProbe: %s: client do: %s\n", check.URL, err)
+		emit("status class", 0)
+		return
+	}
+	defer resp.Body.Close()
+
+	var body []byte
+	var size int64
+	if len(check.Expect) > 0 {
+		body, err = ioutil.ReadAll(resp.Body)
+		size = int64(len(body))
+	} else {
+		size, err = io.Copy(ioutil.Discard, resp.Body)
+	}
+	done := time.Now()
+	if err != nil {
+		Logf(ctx, "[error] PollProbe: %s: couldn't read body: %s\n", check.URL, err)
+		emit("status class", 0)
+		return
+	}
+
+	if ms, ok := milliseconds(timings.start, done); ok {
+		emit("total time", ms)
+	}
+	if ms, ok := milliseconds(timings.dnsStart, timings.dnsDone); ok {
+		emit("dns time", ms)
+	}
+	if ms, ok := milliseconds(timings.connectStart, timings.connectDone); ok {
+		emit("connect time", ms)
+	}
+	if ms, ok := milliseconds(timings.tlsStart, timings.tlsDone); ok {
+		emit("tls time", ms)
+	}
+	if ms, ok := milliseconds(timings.start, timings.firstByte); ok {
+		emit("first byte time", ms)
+	}
+	emit("response size", float64(size))
+	emit("status class", float64(resp.StatusCode/100))
+
+	if len(check.Expect) > 0 {
+		matched := 1.0
+		for _, expected := range check.Expect {
+			if !strings.Contains(string(body), expected) {
+				Logf(ctx, "[info] PollProbe: %s: body doesn't contain %q\n", check.URL, expected)
+				matched = 0
+			}
+		}
+		emit("body matches", matched)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func collect(metrics chan Metric) map[string]float64 {
+	results := map[string]float64{}
+	for len(metrics) > 0 {
+		m := <-metrics
+		results[m.Check] = m.Metric
+	}
+	return results
+}
+
+func TestPollProbe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("all systems go"))
+	}))
+	defer server.Close()
+
+	check := Check{Type: "http_probe", URL: server.URL, Expect: []string{"systems go"}}
+	metrics := make(chan Metric, 20)
+	Poll(context.Background(), check, metrics)
+	results := collect(metrics)
+
+	for _, name := range []string{"total time", "connect time", "first byte time"} {
+		if _, ok := results[server.URL+": "+name]; !ok {
+			t.Errorf("Expected %q metric, got %+v\n", name, results)
+		}
+	}
+	if size := results[server.URL+": response size"]; size != 14 {
+		t.Errorf("Expected response size of 14, got %f\n", size)
+	}
+	if class := results[server.URL+": status class"]; class != 2 {
+		t.Errorf("Expected status class 2, got %f\n", class)
+	}
+	if matches := results[server.URL+": body matches"]; matches != 1 {
+		t.Errorf("Expected body to match, got %f\n", matches)
+	}
+
+	check.Expect = []string{"systems go", "houston"}
+	Poll(context.Background(), check, metrics)
+	results = collect(metrics)
+	if matches := results[server.URL+": body matches"]; matches != 0 {
+		t.Errorf("Expected body not to match, got %f\n", matches)
+	}
+}
+
+func TestPollProbeUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	url := server.URL
+	server.Close()
+
+	metrics := make(chan Metric, 20)
+	Poll(context.Background(), Check{Type: "http_probe", URL: url}, metrics)
+	results := collect(metrics)
+
+	if class, ok := results[url+": status class"]; !ok || class != 0 {
+		t.Errorf("Expected status class 0 for unreachable URL, got %+v\n", results)
+	}
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PromSample is a single sample from the Prometheus text exposition format.
+type PromSample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// PromFamily is a metric family: samples sharing a name and a type, including
+// the _bucket, _sum and _count samples of histograms and summaries.
+type PromFamily struct {
+	Name    string
+	Type    string
+	Samples []PromSample
+}
+
+// ParsePrometheus parses the Prometheus text exposition format, returning
+// metric families in the order they appear.
+func ParsePrometheus(r io.Reader) ([]*PromFamily, error) {
+	families := []*PromFamily{}
+	byName := map[string]*PromFamily{}
+	types := map[string]string{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			fields := strings.Fields(line)
+			if len(fields) >= 4 && fields[1] == "TYPE" {
+				types[fields[2]] = fields[3]
+			}
+			continue
+		}
+
+		sample, err := parsePromSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+
+		// Histogram and summary samples belong to the family they were
+		// declared under, rather than one named after their suffix.
+		name, kind := sample.Name, types[sample.Name]
+		for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+			base := strings.TrimSuffix(sample.Name, suffix)
+			if base != sample.Name && (types[base] == "histogram" || types[base] == "summary") {
+				name, kind = base, types[base]
+			}
+		}
+		if kind == "" {
+			kind = "untyped"
+		}
+
+		family, ok := byName[name]
+		if !ok {
+			family = &PromFamily{Name: name, Type: kind}
+			byName[name] = family
+			families = append(families, family)
+		}
+		family.Samples = append(family.Samples, sample)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return families, nil
+}
+
+func parsePromSample(line string) (PromSample, error) {
+	s := PromSample{Labels: map[string]string{}}
+
+	end := strings.IndexAny(line, "{ \t")
+	if end <= 0 {
+		return s, fmt.Errorf("no value in %q", line)
+	}
+	s.Name = line[:end]
+	rest := line[end:]
+
+	if strings.HasPrefix(rest, "{") {
+		labels, remaining, err := parsePromLabels(rest[1:])
+		if err != nil {
+			return s, fmt.Errorf("%s in %q", err, line)
+		}
+		s.Labels = labels
+		rest = remaining
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return s, fmt.Errorf("no value in %q", line)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, fmt.Errorf("bad value in %q", line)
+	}
+	s.Value = value
+	return s, nil
+}
+
+// parsePromLabels parses `name="value",...}` returning whatever follows it.
+func parsePromLabels(s string) (map[string]string, string, error) {
+	labels := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if strings.HasPrefix(s, "}") {
+			return labels, s[1:], nil
+		}
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 || len(s) < eq+2 || s[eq+1] != '"' {
+			return nil, "", fmt.Errorf("malformed labels")
+		}
+		name := strings.TrimSpace(s[:eq])
+		s = s[eq+2:]
+
+		var value []byte
+		closed := false
+		for i := 0; i < len(s); i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				i++
+				switch s[i] {
+				case 'n':
+					value = append(value, '\n')
+				default:
+					value = append(value, s[i])
+				}
+				continue
+			}
+			if s[i] == '"' {
+				s = s[i+1:]
+				closed = true
+				break
+			}
+			value = append(value, s[i])
+		}
+		if !closed {
+			return nil, "", fmt.Errorf("unterminated label value")
+		}
+		labels[name] = string(value)
+	}
+}
+
+// PromSelector selects series by metric name and label matchers, in the
+// same syntax as PromQL, e.g. `http_requests_total{code=~"5..",method!="GET"}`.
+type PromSelector struct {
+	Name     string
+	Matchers []PromMatcher
+}
+
+// PromMatcher matches a label with one of =, !=, =~ or !~.
+type PromMatcher struct {
+	Label string
+	Op    string
+	Value string
+	re    *regexp.Regexp
+}
+
+func ParsePromSelector(s string) (PromSelector, error) {
+	sel := PromSelector{}
+	s = strings.TrimSpace(s)
+	brace := strings.IndexByte(s, '{')
+	if brace < 0 {
+		sel.Name = s
+		return sel, nil
+	}
+	sel.Name = strings.TrimSpace(s[:brace])
+	body := strings.TrimSpace(s[brace+1:])
+	if !strings.HasSuffix(body, "}") {
+		return sel, fmt.Errorf("unterminated selector %q", s)
+	}
+	body = body[:len(body)-1]
+
+	matcher := regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|=)\s*"((?:[^"\\]|\\.)*)"\s*(?:,|$)`)
+	for strings.TrimSpace(body) != "" {
+		m := matcher.FindStringSubmatch(body)
+		if m == nil {
+			return sel, fmt.Errorf("malformed matcher in %q", s)
+		}
+		body = body[len(m[0]):]
+		value, err := strconv.Unquote(`"` + m[3] + `"`)
+		if err != nil {
+			// Regexps like "\d+" are often written unescaped.
+			value = m[3]
+		}
+		pm := PromMatcher{Label: m[1], Op: m[2], Value: value}
+		if pm.Op == "=~" || pm.Op == "!~" {
+			pm.re, err = regexp.Compile("^(?:" + value + ")$")
+			if err != nil {
+				return sel, fmt.Errorf("bad regexp in %q: %s", s, err)
+			}
+		}
+		sel.Matchers = append(sel.Matchers, pm)
+	}
+	return sel, nil
+}
+
+// Matches reports whether the selector selects a series in a family.
+func (sel PromSelector) Matches(family string, labels map[string]string) bool {
+	if sel.Name != "" && sel.Name != family {
+		return false
+	}
+	for _, m := range sel.Matchers {
+		value := labels[m.Label]
+		switch m.Op {
+		case "=":
+			if value != m.Value {
+				return false
+			}
+		case "!=":
+			if value == m.Value {
+				return false
+			}
+		case "=~":
+			if !m.re.MatchString(value) {
+				return false
+			}
+		case "!~":
+			if m.re.MatchString(value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// promSeriesName formats a name and labels like Prometheus does.
+func promSeriesName(name string, labels map[string]string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	keys := []string{}
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+strconv.Quote(labels[k]))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// withoutLabel returns a copy of labels without the named label.
+func withoutLabel(labels map[string]string, name string) map[string]string {
+	copied := map[string]string{}
+	for k, v := range labels {
+		if k != name {
+			copied[k] = v
+		}
+	}
+	return copied
+}
+
+// promPoint is a previous scrape's value for a series, for working out rates.
+type promPoint struct {
+	value float64
+	time  time.Time
+}
+
+var promPrevious = struct {
+	sync.Mutex
+	points map[string]promPoint
+}{points: map[string]promPoint{}}
+
+// promDelta returns how much a counter increased since the last scrape, and
+// over how long. It returns false on the first scrape and after a reset.
+func promDelta(key string, value float64, now time.Time) (float64, time.Duration, bool) {
+	promPrevious.Lock()
+	defer promPrevious.Unlock()
+	previous, ok := promPrevious.points[key]
+	promPrevious.points[key] = promPoint{value: value, time: now}
+	if !ok || value < previous.value || !now.After(previous.time) {
+		return 0, 0, false
+	}
+	return value - previous.value, now.Sub(previous.time), true
+}
+
+// promStale is how long a series' previous value is kept without it being
+// scraped again, e.g. after its check is deleted or changed.
+const promStale = 10 * time.Minute
+
+// promPrune forgets the series of the check with key that weren't in its
+// scrape at now, and every series that hasn't been scraped for promStale, so
+// series that come and go don't pile up.
+func promPrune(key string, now time.Time) {
+	promPrevious.Lock()
+	defer promPrevious.Unlock()
+	for k, p := range promPrevious.points {
+		if (strings.HasPrefix(k, key+" ") && !p.time.Equal(now)) || now.Sub(p.time) > promStale {
+			delete(promPrevious.points, k)
+		}
+	}
+}
+
+// promBucket is a cumulative histogram bucket.
+type promBucket struct {
+	le    float64
+	count float64
+}
+
+// HistogramQuantile estimates quantile q (0 to 1) from cumulative buckets,
+// interpolating linearly within the bucket the quantile falls in, as
+// Prometheus' histogram_quantile does.
+func HistogramQuantile(q float64, buckets []promBucket) float64 {
+	if len(buckets) == 0 {
+		return math.NaN()
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].le < buckets[j].le })
+	total := buckets[len(buckets)-1].count
+	if total == 0 {
+		return math.NaN()
+	}
+
+	rank := q * total
+	for i, b := range buckets {
+		if b.count < rank {
+			continue
+		}
+		if math.IsInf(b.le, 1) {
+			// The quantile is beyond the highest finite bucket.
+			if i == 0 {
+				return math.NaN()
+			}
+			return buckets[i-1].le
+		}
+		lower, below := 0.0, 0.0
+		if i > 0 {
+			lower, below = buckets[i-1].le, buckets[i-1].count
+		} else if b.le < 0 {
+			return b.le
+		}
+		if b.count == below {
+			return b.le
+		}
+		return lower + (b.le-lower)*(rank-below)/(b.count-below)
+	}
+	return buckets[len(buckets)-1].le
+}
+
+// PollPrometheus scrapes a Prometheus metrics endpoint, and emits every
+// series matching the check's selectors.
+//
+// Gauges are emitted as they are. Counters are emitted as per second rates
+// since the previous scrape. Histograms are emitted as estimated quantiles
+// over the requests observed since the previous scrape.
+func PollPrometheus(ctx context.Context, check Check, metrics chan Metric) {
+	selectors := []PromSelector{}
+	for _, s := range check.Series {
+		sel, err := ParsePromSelector(s)
+		if err != nil {
+			Logf(ctx, "[error] PollPrometheus: %s: %s\n", check.URL, err)
+			return
+		}
+		selectors = append(selectors, sel)
+	}
+	quantiles := check.Quantiles
+	if len(quantiles) == 0 {
+		quantiles = []float64{0.5, 0.9, 0.99}
+	}
+
+	client := &http.Client{Timeout: time.Second * 5, Transport: Breakers}
+	req, err := NewCheckRequest(ctx, check)
+	if err != nil {
+		Logf(ctx, "[error] PollPrometheus: %s: new request: %s\n", check.URL, err)
+		return
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		Logf(ctx, "[error] PollPrometheus: %s: client do: %s\n", check.URL, err)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		Logf(ctx, "[error] PollPrometheus: %s: HTTP %d\n", check.URL, resp.StatusCode)
+		return
+	}
+
+	families, err := ParsePrometheus(resp.Body)
+	if err != nil {
+		Logf(ctx, "[error] PollPrometheus: %s: couldn't parse metrics: %s\n", check.URL, err)
+		return
+	}
+	now := time.Now()
+	key := check.Key()
+
+	emit := func(name string, labels map[string]string, value float64) {
+		// Empty summaries' quantiles are NaN, which Pacemaker can't take.
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return
+		}
+		tags := append([]string{}, check.Tags...)
+		for k, v := range labels {
+			tags = append(tags, k+":"+v)
+		}
+		sort.Strings(tags[len(check.Tags):])
+		metrics <- Metric{
+			ApiKey: check.ApiKey,
+			Check:  name,
+			Metric: value,
+			TTL:    400,
+			Tags:   tags,
+		}
+	}
+	selected := func(family string, labels map[string]string) bool {
+		for _, sel := range selectors {
+			if sel.Matches(family, labels) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, family := range families {
+		buckets := map[string][]promBucket{}
+		bucketLabels := map[string]map[string]string{}
+
+		for _, s := range family.Samples {
+			switch {
+			case family.Type == "histogram" && s.Name == family.Name+"_bucket":
+				labels := withoutLabel(s.Labels, "le")
+				if !selected(family.Name, labels) {
+					continue
+				}
+				le, err := strconv.ParseFloat(s.Labels["le"], 64)
+				if err != nil {
+					Logf(ctx, "[error] PollPrometheus: %s: bad bucket %q for %s\n", check.URL, s.Labels["le"], family.Name)
+					continue
+				}
+				series := promSeriesName(family.Name, labels)
+				delta, _, ok := promDelta(key+" "+promSeriesName(s.Name, s.Labels), s.Value, now)
+				if !ok {
+					continue
+				}
+				buckets[series] = append(buckets[series], promBucket{le: le, count: delta})
+				bucketLabels[series] = labels
+			case family.Type == "counter" || (family.Type == "histogram" || family.Type == "summary") && s.Name != family.Name:
+				if !selected(family.Name, s.Labels) {
+					continue
+				}
+				series := promSeriesName(s.Name, s.Labels)
+				delta, elapsed, ok := promDelta(key+" "+series, s.Value, now)
+				if ok {
+					emit(series, s.Labels, delta/elapsed.Seconds())
+				}
+			default:
+				if !selected(family.Name, s.Labels) {
+					continue
+				}
+				emit(promSeriesName(s.Name, s.Labels), s.Labels, s.Value)
+			}
+		}
+
+		for series, bs := range buckets {
+			for _, q := range quantiles {
+				value := HistogramQuantile(q, bs)
+				if math.IsNaN(value) {
+					continue
+				}
+				name := fmt.Sprintf("%s: p%s", series, strconv.FormatFloat(q*100, 'f', -1, 64))
+				emit(name, bucketLabels[series], value)
+			}
+		}
+	}
+	promPrune(key, now)
+}
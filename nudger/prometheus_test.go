@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const promExposition = `# HELP http_requests_total Requests handled.
+# TYPE http_requests_total counter
+http_requests_total{code="200",method="GET"} %d
+http_requests_total{code="500",method="GET"} %d
+http_requests_total{code="503",method="POST"} 1 1434972584000
+# TYPE queue_depth gauge
+queue_depth{queue="mail \"outbound\""} 12
+# TYPE request_seconds histogram
+request_seconds_bucket{le="0.1"} %d
+request_seconds_bucket{le="0.5"} %d
+request_seconds_bucket{le="+Inf"} %d
+request_seconds_sum 40
+request_seconds_count %d
+`
+
+func TestParsePrometheus(t *testing.T) {
+	families, err := ParsePrometheus(strings.NewReader(fmt.Sprintf(promExposition, 1, 2, 3, 4, 5, 5)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if len(families) != 3 {
+		t.Fatalf("Expected 3 families, got %d\n", len(families))
+	}
+	if f := families[2]; f.Name != "request_seconds" || f.Type != "histogram" || len(f.Samples) != 5 {
+		t.Errorf("Unexpected histogram family: %+v\n", f)
+	}
+	if label := families[1].Samples[0].Labels["queue"]; label != `mail "outbound"` {
+		t.Errorf("Expected escaped label value to be unescaped, got %q\n", label)
+	}
+
+	if _, err := ParsePrometheus(strings.NewReader(`broken{code="200" 1`)); err == nil {
+		t.Errorf("Expected error parsing unterminated labels\n")
+	}
+}
+
+func TestPromSelector(t *testing.T) {
+	sel, err := ParsePromSelector(`http_requests_total{code=~"5..", method!="POST"}`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	cases := []struct {
+		family string
+		labels map[string]string
+		match  bool
+	}{
+		{"http_requests_total", map[string]string{"code": "500", "method": "GET"}, true},
+		{"http_requests_total", map[string]string{"code": "200", "method": "GET"}, false},
+		{"http_requests_total", map[string]string{"code": "503", "method": "POST"}, false},
+		{"queue_depth", map[string]string{"code": "500"}, false},
+	}
+	for _, c := range cases {
+		if sel.Matches(c.family, c.labels) != c.match {
+			t.Errorf("Expected match of %s%v to be %t\n", c.family, c.labels, c.match)
+		}
+	}
+
+	if _, err := ParsePromSelector(`up{job=}`); err == nil {
+		t.Errorf("Expected error parsing malformed selector\n")
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	buckets := []promBucket{{le: 1, count: 10}, {le: 2, count: 20}, {le: math.Inf(1), count: 20}}
+	if q := HistogramQuantile(0.5, buckets); q != 1 {
+		t.Errorf("Expected median of 1, got %f\n", q)
+	}
+	if q := HistogramQuantile(0.75, buckets); q != 1.5 {
+		t.Errorf("Expected p75 of 1.5, got %f\n", q)
+	}
+
+	buckets = []promBucket{{le: 1, count: 10}, {le: math.Inf(1), count: 20}}
+	if q := HistogramQuantile(0.99, buckets); q != 1 {
+		t.Errorf("Expected quantile in +Inf bucket to be highest finite bound, got %f\n", q)
+	}
+	if q := HistogramQuantile(0.5, []promBucket{{le: math.Inf(1), count: 0}}); !math.IsNaN(q) {
+		t.Errorf("Expected NaN for empty histogram, got %f\n", q)
+	}
+}
+
+func TestPollPrometheus(t *testing.T) {
+	var mutex sync.Mutex
+	scrape := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		scrape++
+		// Between scrapes there are 10 more 500s, and 10 requests of which
+		// 4 took up to 0.1s, and 6 up to 0.5s.
+		fmt.Fprintf(w, promExposition, 100, 10*scrape, 4*scrape, 10*scrape, 10*scrape, 10*scrape)
+	}))
+	defer server.Close()
+
+	check := Check{
+		Type:      "prometheus",
+		URL:       server.URL,
+		Series:    []string{`http_requests_total{code=~"5.."}`, `queue_depth`, `request_seconds`},
+		Quantiles: []float64{0.5},
+		Tags:      []string{"web"},
+	}
+	metrics := make(chan Metric, 20)
+
+	Poll(context.Background(), check, metrics)
+	first := collect(metrics)
+	if len(first) != 1 || first[`queue_depth{queue="mail \"outbound\""}`] != 12 {
+		t.Errorf("Expected only gauges on the first scrape, got %+v\n", first)
+	}
+
+	Poll(context.Background(), check, metrics)
+	tags := map[string][]string{}
+	results := map[string]float64{}
+	for len(metrics) > 0 {
+		m := <-metrics
+		results[m.Check] = m.Metric
+		tags[m.Check] = m.Tags
+	}
+
+	if rate := results[`http_requests_total{code="500",method="GET"}`]; rate <= 0 {
+		t.Errorf("Expected positive rate of 500s, got %+v\n", results)
+	}
+	if _, ok := results[`http_requests_total{code="200",method="GET"}`]; ok {
+		t.Errorf("Expected unselected series not to be emitted, got %+v\n", results)
+	}
+	if _, ok := results[`http_requests_total{code="503",method="POST"}`]; !ok {
+		t.Errorf("Expected unchanged counter to be emitted, got %+v\n", results)
+	}
+	// The median is the 5th of 10 requests, the 1st of the 6 in 0.1s to 0.5s.
+	if p50 := results["request_seconds: p50"]; math.Abs(p50-(0.1+0.4/6)) > 0.0001 {
+		t.Errorf("Expected p50 of 0.167, got %+v\n", results)
+	}
+	if _, ok := results["request_seconds_count"]; !ok {
+		t.Errorf("Expected histogram count rate, got %+v\n", results)
+	}
+	if strings.Join(tags[`http_requests_total{code="500",method="GET"}`], ",") != "web,code:500,method:GET" {
+		t.Errorf("Expected tags from labels, got %+v\n", tags)
+	}
+}
+
+func TestPollPrometheusSkipsNonFinite(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "# TYPE rpc_seconds summary\nrpc_seconds{quantile=\"0.5\"} NaN\nrpc_seconds{quantile=\"0.99\"} NaN\nrpc_seconds_sum 0\nrpc_seconds_count 0\n# TYPE ceiling gauge\nceiling +Inf\n# TYPE floor gauge\nfloor -Inf\n# TYPE temperature gauge\ntemperature 21.5\n")
+	}))
+	defer server.Close()
+
+	check := Check{Type: "prometheus", URL: server.URL, Series: []string{"rpc_seconds", "ceiling", "floor", "temperature"}}
+	metrics := make(chan Metric, 20)
+	Poll(context.Background(), check, metrics)
+	results := collect(metrics)
+	if len(results) != 1 || results["temperature"] != 21.5 {
+		t.Errorf("Expected only the finite gauge, got %+v\n", results)
+	}
+}
+
+func TestPromPrune(t *testing.T) {
+	now := time.Now()
+	promDelta("a gone", 1, now)
+	promDelta("a kept", 1, now)
+	promDelta("b stale", 1, now.Add(-promStale-time.Second))
+	promDelta("c recent", 1, now.Add(-time.Minute))
+
+	later := now.Add(time.Second)
+	promDelta("a kept", 2, later)
+	promPrune("a", later)
+
+	promPrevious.Lock()
+	defer promPrevious.Unlock()
+	for key, expected := range map[string]bool{"a gone": false, "a kept": true, "b stale": false, "c recent": true} {
+		if _, ok := promPrevious.points[key]; ok != expected {
+			t.Errorf("Expected %s to be kept: %t\n", key, expected)
+		}
+		delete(promPrevious.points, key)
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"github.com/radalert/layer4/secret"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Shard is the cluster this instance shares checks with, or nil if it polls
+// every check itself.
+var Shard *Cluster
+
+// ringReplicas is how many points each member gets on the hash ring, to even
+// out how many checks each is given.
+const ringReplicas = 64
+
+func ringHash(s string) uint32 {
+	sum := sha1.Sum([]byte(s))
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// HashRing assigns keys to members by consistent hashing, so that adding or
+// removing a member only moves the keys it gains or loses.
+type HashRing struct {
+	points  []uint32
+	members map[uint32]string
+}
+
+func NewHashRing(members []string) *HashRing {
+	r := &HashRing{members: map[uint32]string{}}
+	for _, m := range members {
+		for i := 0; i < ringReplicas; i++ {
+			point := ringHash(m + "#" + strconv.Itoa(i))
+			r.points = append(r.points, point)
+			r.members[point] = m
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Owner returns the member a key belongs to, or "" if there are no members.
+func (r *HashRing) Owner(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := ringHash(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.members[r.points[i]]
+}
+
+// Peer is a nudger instance in a cluster. Since is when it joined, Until is
+// when it's leaving (if it is), and Seen is when it last sent a heartbeat.
+type Peer struct {
+	URL   string    `json:"url"`
+	Since time.Time `json:"since"`
+	Until time.Time `json:"until,omitempty"`
+	Seen  time.Time `json:"seen"`
+}
+
+// Cluster divides checks between nudger instances. Instances send each other
+// heartbeats, and gossip about the others they've heard from, so each can work
+// out the same membership and hash checks onto it.
+//
+// Checks are polled once per window of config.Interval, in the middle of the
+// window, and membership is decided as of the start of each window. A joining instance is only a member
+// from the first window that starts Settle after it joined, by which time
+// every instance has heard about it. A leaving instance tells every other one
+// which window it's leaving at before it goes. So as long as instances agree
+// on the time, each check is polled exactly once per window. An instance that
+// dies without leaving keeps its checks until its heartbeats are older than
+// Expiry, and they aren't polled until then. Once its heartbeats are older
+// than Forget, it's forgotten altogether, so it's no longer sent heartbeats
+// or gossiped about.
+//
+// Checks of hostLocalTypes aren't shared, as they read from the host they're
+// polled on, e.g. a log file or a DSN in its environment. Every instance
+// polls those itself, so they should only be given to instances on hosts
+// they make sense for.
+type Cluster struct {
+	sync.Mutex
+	Self   Peer
+	Static []string
+	ApiKey secret.Secret
+	Settle time.Duration
+	Expiry time.Duration
+	Forget time.Duration
+	peers  map[string]Peer
+	// forgotten is when peers were last forgotten, so gossip about them
+	// from before then is ignored.
+	forgotten time.Time
+}
+
+// NewCluster creates a cluster for the instance at self, that sends
+// heartbeats every interval to the static peers and any it hears about.
+func NewCluster(self string, static []string, apikey secret.Secret, interval time.Duration) *Cluster {
+	return &Cluster{
+		Self:   Peer{URL: self, Since: time.Now()},
+		Static: static,
+		ApiKey: apikey,
+		Settle: 3 * interval,
+		Expiry: 3 * interval,
+		Forget: 6 * interval,
+		peers:  map[string]Peer{},
+	}
+}
+
+// Heard records what's known about a peer, keeping the most recent news.
+func (c *Cluster) Heard(p Peer) {
+	c.Lock()
+	defer c.Unlock()
+	if p.URL == c.Self.URL || p.URL == "" || c.forgotten.Sub(p.Seen) > c.Forget {
+		return
+	}
+	known, ok := c.peers[p.URL]
+	if !ok || p.Seen.After(known.Seen) {
+		c.peers[p.URL] = p
+	}
+}
+
+// Peers returns every instance this one knows about, including itself as of
+// now.
+func (c *Cluster) Peers(now time.Time) []Peer {
+	c.Lock()
+	defer c.Unlock()
+	self := c.Self
+	self.Seen = now
+	peers := []Peer{self}
+	for _, p := range c.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// forget forgets peers that haven't sent a heartbeat for Forget, or that
+// left longer ago than that.
+func (c *Cluster) forget(now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	c.forgotten = now
+	for url, p := range c.peers {
+		if now.Sub(p.Seen) > c.Forget || (!p.Until.IsZero() && now.Sub(p.Until) > c.Forget) {
+			log.Printf("[info] Cluster: forgetting %s, last heard from at %s\n", url, p.Seen.Format(time.RFC3339))
+			delete(c.peers, url)
+		}
+	}
+}
+
+// Members returns the instances that own checks in the window starting at.
+func (c *Cluster) Members(at time.Time) []string {
+	members := []string{}
+	for _, p := range c.Peers(at) {
+		switch {
+		case at.Before(p.Since.Add(c.Settle)):
+			// Still joining.
+		case !p.Until.IsZero() && !at.Before(p.Until):
+			// Left.
+		case p.URL != c.Self.URL && at.Sub(p.Seen) > c.Expiry:
+			// Presumed dead.
+		default:
+			members = append(members, p.URL)
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// shardKey is what a check is hashed onto the ring by: its ID, which is the
+// same on every instance even while their copies of the check differ during a
+// rollout, or else its Key if it doesn't have one.
+func shardKey(check Check) string {
+	if check.ID != "" {
+		return check.ID
+	}
+	return check.Key()
+}
+
+// windowTicks sends the time once in the middle of each window of interval,
+// until ctx is done. Ticking mid-window, and working out each tick afresh
+// from the clock, means jitter can't put two ticks in one window and none in
+// the next, as a ticker started at an arbitrary time could.
+func windowTicks(ctx context.Context, interval time.Duration) <-chan time.Time {
+	ticks := make(chan time.Time)
+	go func() {
+		for {
+			now := time.Now()
+			next := now.Truncate(interval).Add(interval / 2)
+			if !next.After(now) {
+				next = next.Add(interval)
+			}
+			timer := time.NewTimer(next.Sub(now))
+			select {
+			case t := <-timer.C:
+				select {
+				case ticks <- t:
+				case <-ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			}
+		}
+	}()
+	return ticks
+}
+
+// hostLocalTypes are the types of check that read from the host they're
+// polled on, so can't be polled by another instance in their place.
+var hostLocalTypes = map[string]bool{"log": true, "sql": true}
+
+// Owned returns the checks this instance should poll in the window starting
+// at: those hashed onto it, and every host-local check.
+func (c *Cluster) Owned(checks []Check, at time.Time) []Check {
+	ring := NewHashRing(c.Members(at))
+	owned := []Check{}
+	for _, check := range checks {
+		if hostLocalTypes[check.Type] || ring.Owner(shardKey(check)) == c.Self.URL {
+			owned = append(owned, check)
+		}
+	}
+	return owned
+}
+
+// send posts this instance to a peer, and records the peers it replies with.
+func (c *Cluster) send(ctx context.Context, url string, now time.Time) error {
+	c.Lock()
+	self := c.Self
+	c.Unlock()
+	self.Seen = now
+	body, err := json.Marshal(self)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: time.Second * 5}
+	req, err := http.NewRequestWithContext(ctx, "POST", url+"/peers", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(c.ApiKey.Reveal(), "")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
+	}
+
+	var peers []Peer
+	if err := json.Unmarshal(body, &peers); err != nil {
+		return fmt.Errorf("couldn't decode peers: %s", err)
+	}
+	for _, p := range peers {
+		c.Heard(p)
+	}
+	return nil
+}
+
+// Heartbeat sends a heartbeat to the static peers and every peer heard
+// about, returning how many couldn't be reached.
+func (c *Cluster) Heartbeat(ctx context.Context, now time.Time) int {
+	c.forget(now)
+	urls := map[string]bool{}
+	for _, url := range c.Static {
+		urls[url] = true
+	}
+	for _, p := range c.Peers(now) {
+		urls[p.URL] = true
+	}
+	delete(urls, c.Self.URL)
+
+	failed := 0
+	for url := range urls {
+		if err := c.send(ctx, url, now); err != nil {
+			log.Printf("[error] Heartbeat: %s: %s\n", url, err)
+			failed++
+		}
+	}
+	return failed
+}
+
+// Leave tells the other instances this one is leaving at the start of the
+// window after now, so they take over its checks from then.
+func (c *Cluster) Leave(ctx context.Context, now time.Time, interval time.Duration) {
+	c.Lock()
+	c.Self.Until = now.Truncate(interval).Add(interval)
+	c.Unlock()
+	if failed := c.Heartbeat(ctx, now); failed > 0 {
+		log.Printf("[error] Leave: %d peers weren't told, and won't poll this instance's checks until it expires\n", failed)
+	}
+}
+
+// Run sends heartbeats every interval until ctx is cancelled.
+func (c *Cluster) Run(ctx context.Context, interval time.Duration) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		c.Heartbeat(ctx, time.Now())
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ServeHTTP receives a heartbeat from a peer, and replies with the peers this
+// instance knows about.
+func (c *Cluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if key, _, _ := r.BasicAuth(); !c.ApiKey.Equal(key) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method == "POST" {
+		var p Peer
+		if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.Heard(p)
+	}
+	body, err := json.Marshal(c.Peers(time.Now()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
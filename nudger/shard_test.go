@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/radalert/layer4/secret"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHashRing(t *testing.T) {
+	ring := NewHashRing([]string{"a", "b", "c"})
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		counts[ring.Owner(fmt.Sprint(i))]++
+	}
+	for _, m := range []string{"a", "b", "c"} {
+		if counts[m] < 500 {
+			t.Errorf("Expected keys to be spread evenly, got %+v\n", counts)
+		}
+	}
+
+	// Removing a member only moves the keys it owned.
+	smaller := NewHashRing([]string{"a", "b"})
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprint(i)
+		if before := ring.Owner(key); before != "c" && smaller.Owner(key) != before {
+			t.Errorf("Expected %s to stay with %s, moved to %s\n", key, before, smaller.Owner(key))
+		}
+	}
+
+	if owner := NewHashRing(nil).Owner("x"); owner != "" {
+		t.Errorf("Expected no owner without members, got %q\n", owner)
+	}
+}
+
+// testInstance is a nudger instance in a simulated cluster, reachable over
+// HTTP like a real one.
+type testInstance struct {
+	cluster *Cluster
+	server  *httptest.Server
+	running bool
+}
+
+func newTestInstance(since time.Time, static []string) *testInstance {
+	instance := &testInstance{}
+	instance.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		instance.cluster.ServeHTTP(w, r)
+	}))
+	instance.cluster = NewCluster(instance.server.URL, static, secret.New("r4d4l3rt"), 10*time.Second)
+	instance.cluster.Self.Since = since
+	return instance
+}
+
+func TestClusterRebalance(t *testing.T) {
+	checks := []Check{}
+	for i := 0; i < 200; i++ {
+		checks = append(checks, Check{Type: "tcp", Address: fmt.Sprintf("host%d:80", i)})
+	}
+	interval := 30 * time.Second
+	start := time.Now().Truncate(interval).Add(interval)
+
+	a := newTestInstance(start.Add(-time.Hour), nil)
+	b := newTestInstance(start.Add(-time.Hour), []string{a.server.URL})
+	a.running, b.running = true, true
+	// c joins 5 seconds in, knowing only about b.
+	c := newTestInstance(start.Add(5*time.Second), []string{b.server.URL})
+	instances := map[string]*testInstance{"a": a, "b": b, "c": c}
+	for _, instance := range instances {
+		defer instance.server.Close()
+	}
+	a.cluster.Heartbeat(context.Background(), start.Add(-10*time.Second))
+	b.cluster.Heartbeat(context.Background(), start.Add(-10*time.Second))
+
+	// owned[window][instance] is what each instance polled in each window.
+	owned := map[time.Time]map[string][]string{}
+	leave := start.Add(125 * time.Second)
+	for now := start; now.Before(start.Add(4 * time.Minute)); now = now.Add(10 * time.Second) {
+		if now.After(c.cluster.Self.Since) {
+			c.running = true
+		}
+		if a.running && !now.Before(leave) {
+			a.cluster.Leave(context.Background(), now, interval)
+			a.running = false
+			// a finishes polling the window it's leaving in.
+			window := now.Truncate(interval)
+			if owned[window]["a"] == nil {
+				owned[window]["a"] = checkAddresses(a.cluster.Owned(checks, window))
+			}
+		}
+		for _, instance := range instances {
+			if instance.running {
+				instance.cluster.Heartbeat(context.Background(), now)
+			}
+		}
+
+		// Each instance polls once per window, at some point during it, so
+		// ownership has to be the same at every point.
+		window := now.Truncate(interval)
+		if owned[window] == nil {
+			owned[window] = map[string][]string{}
+		}
+		for name, instance := range instances {
+			if !instance.running {
+				continue
+			}
+			current := checkAddresses(instance.cluster.Owned(checks, window))
+			if previous, ok := owned[window][name]; ok && strings.Join(previous, ",") != strings.Join(current, ",") {
+				t.Errorf("Expected %s's checks to stay the same during the window at %s, went from %d to %d\n", name, window, len(previous), len(current))
+			}
+			owned[window][name] = current
+		}
+	}
+
+	for window, byInstance := range owned {
+		polls := map[string][]string{}
+		for name, addresses := range byInstance {
+			for _, address := range addresses {
+				polls[address] = append(polls[address], name)
+			}
+		}
+		for _, check := range checks {
+			switch n := len(polls[check.Address]); {
+			case n == 0:
+				t.Errorf("Expected %s to be polled in the window at %s, but it wasn't\n", check.Address, window)
+			case n > 1:
+				t.Errorf("Expected %s to be polled once in the window at %s, but %v all polled it\n", check.Address, window, polls[check.Address])
+			}
+		}
+	}
+
+	// By the end, b and c share every check.
+	last := start.Add(4 * time.Minute).Add(-interval)
+	if members := c.cluster.Members(last); len(members) != 2 {
+		t.Errorf("Expected b and c to be the only members, got %v\n", members)
+	}
+	if len(owned[last]["b"]) == 0 || len(owned[last]["c"]) == 0 {
+		t.Errorf("Expected checks to be shared by b and c, got %d and %d\n", len(owned[last]["b"]), len(owned[last]["c"]))
+	}
+}
+
+func TestClusterRejectsWrongApiKey(t *testing.T) {
+	instance := newTestInstance(time.Now(), nil)
+	defer instance.server.Close()
+
+	other := NewCluster("http://other", []string{instance.server.URL}, secret.New("wrong"), 10*time.Second)
+	if failed := other.Heartbeat(context.Background(), time.Now()); failed != 1 {
+		t.Errorf("Expected heartbeat with the wrong API key to fail\n")
+	}
+	if peers := instance.cluster.Peers(time.Now()); len(peers) != 1 {
+		t.Errorf("Expected no peers to be recorded, got %+v\n", peers)
+	}
+}
+
+func checkAddresses(checks []Check) []string {
+	addresses := []string{}
+	for _, c := range checks {
+		addresses = append(addresses, c.Address)
+	}
+	sort.Strings(addresses)
+	return addresses
+}
+
+func TestClusterHashesCheckIDs(t *testing.T) {
+	c := NewCluster("http://a", nil, secret.New("r4d4l3rt"), 10*time.Second)
+	c.Self.Since = time.Now().Add(-time.Hour)
+	c.Heard(Peer{URL: "http://b", Since: c.Self.Since, Seen: time.Now()})
+
+	// Instances with different versions of the same checks, as during a
+	// rollout, still agree on who owns each.
+	before, after := []Check{}, []Check{}
+	for i := 0; i < 100; i++ {
+		check := Check{ID: fmt.Sprint(i), Type: "tcp", Address: fmt.Sprintf("host%d:80", i)}
+		before = append(before, check)
+		check.Tags = []string{"changed"}
+		after = append(after, check)
+	}
+	now := time.Now()
+	owned, ownedAfter := checkAddresses(c.Owned(before, now)), checkAddresses(c.Owned(after, now))
+	if len(owned) == 0 || strings.Join(owned, ",") != strings.Join(ownedAfter, ",") {
+		t.Errorf("Expected changed checks to keep their owner, got %d then %d\n", len(owned), len(ownedAfter))
+	}
+}
+
+func TestClusterKeepsHostLocalChecks(t *testing.T) {
+	c := NewCluster("http://a", nil, secret.New("r4d4l3rt"), 10*time.Second)
+	c.Self.Since = time.Now().Add(-time.Hour)
+	c.Heard(Peer{URL: "http://b", Since: c.Self.Since, Seen: time.Now()})
+
+	checks := []Check{}
+	for i := 0; i < 20; i++ {
+		checks = append(checks, Check{ID: fmt.Sprint("log", i), Type: "log", File: "/var/log/app.log"})
+		checks = append(checks, Check{ID: fmt.Sprint("sql", i), Type: "sql", Name: "orders"})
+	}
+	if owned := c.Owned(checks, time.Now()); len(owned) != len(checks) {
+		t.Errorf("Expected every host-local check to be polled here, got %d of %d\n", len(owned), len(checks))
+	}
+}
+
+func TestWindowTicks(t *testing.T) {
+	interval := 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ticks := windowTicks(ctx, interval)
+
+	var last time.Time
+	for i := 0; i < 5; i++ {
+		window := (<-ticks).Truncate(interval)
+		if !last.IsZero() && !window.Equal(last.Add(interval)) {
+			t.Errorf("Expected a tick in the window after %s, got one in %s\n", last.Format(time.StampMilli), window.Format(time.StampMilli))
+		}
+		last = window
+	}
+}
+
+func TestClusterForgetsDeadPeers(t *testing.T) {
+	now := time.Now()
+	c := NewCluster("http://a", nil, secret.New("r4d4l3rt"), 10*time.Second)
+	c.Heard(Peer{URL: "http://dead", Since: now.Add(-time.Hour), Seen: now.Add(-time.Minute)})
+	c.Heard(Peer{URL: "http://left", Since: now.Add(-time.Hour), Until: now.Add(-time.Minute), Seen: now})
+
+	c.forget(now)
+	peers := c.Peers(now)
+	if len(peers) != 3 {
+		t.Errorf("Expected peers to be remembered until they've been gone for a minute, got %+v\n", peers)
+	}
+
+	later := now.Add(time.Second)
+	c.forget(later)
+	if peers := c.Peers(later); len(peers) != 1 {
+		t.Errorf("Expected the dead and departed peers to be forgotten, got %+v\n", peers)
+	}
+	// Gossip about them from before they were forgotten doesn't bring them
+	// back, but a heartbeat from after does.
+	c.Heard(Peer{URL: "http://dead", Since: now.Add(-time.Hour), Seen: now.Add(-time.Minute)})
+	if peers := c.Peers(later); len(peers) != 1 {
+		t.Errorf("Expected stale gossip to be ignored, got %+v\n", peers)
+	}
+	c.Heard(Peer{URL: "http://dead", Since: now.Add(-time.Hour), Seen: later})
+	if peers := c.Peers(later); len(peers) != 2 {
+		t.Errorf("Expected a peer that's back to be heard, got %+v\n", peers)
+	}
+}
+
+// TestShardProcess isn't a test by itself: it's a nudger instance for
+// TestClusterProcesses to run in a process of its own, sharing checks with
+// the instances in NUDGER_SHARD_STATIC. It prints its URL, then the IDs of
+// the checks it owns in each window, until it's killed.
+func TestShardProcess(t *testing.T) {
+	if os.Getenv("NUDGER_SHARD_PROCESS") == "" {
+		return
+	}
+	interval, _ := time.ParseDuration(os.Getenv("NUDGER_SHARD_INTERVAL"))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %s\n", err)
+	}
+	url := "http://" + listener.Addr().String()
+	var static []string
+	if s := os.Getenv("NUDGER_SHARD_STATIC"); s != "" {
+		static = strings.Split(s, ",")
+	}
+	c := NewCluster(url, static, secret.New("r4d4l3rt"), interval)
+	go http.Serve(listener, c)
+	go c.Run(context.Background(), interval)
+	fmt.Printf("url %s\n", url)
+
+	// Each process has its own version of the checks, as during a rollout.
+	checks := []Check{}
+	for i := 0; i < 100; i++ {
+		checks = append(checks, Check{ID: fmt.Sprint(i), Type: "tcp", Address: fmt.Sprintf("host%d:80", i), Tags: []string{url}})
+	}
+	var last time.Time
+	for now := range time.NewTicker(interval / 4).C {
+		if window := now.Truncate(interval); window != last {
+			last = window
+			ids := []string{}
+			for _, check := range c.Owned(checks, window) {
+				ids = append(ids, check.ID)
+			}
+			fmt.Printf("window %d %s\n", window.UnixNano(), strings.Join(ids, ","))
+		}
+	}
+}
+
+// shardProcess is a nudger instance running in a process of its own.
+type shardProcess struct {
+	cmd *exec.Cmd
+	url string
+	// windows are the IDs of the checks it owned in each window.
+	windows map[int64][]string
+	mu      sync.Mutex
+}
+
+func startShardProcess(t *testing.T, interval time.Duration, static string) *shardProcess {
+	p := &shardProcess{windows: map[int64][]string{}}
+	p.cmd = exec.Command(os.Args[0], "-test.run=^TestShardProcess$")
+	p.cmd.Env = append(os.Environ(), "NUDGER_SHARD_PROCESS=1", "NUDGER_SHARD_STATIC="+static, "NUDGER_SHARD_INTERVAL="+interval.String())
+	stdout, err := p.cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if err := p.cmd.Start(); err != nil {
+		t.Fatalf("Couldn't start instance: %s\n", err)
+	}
+	urls := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			fields := strings.Split(scanner.Text(), " ")
+			switch {
+			case fields[0] == "url" && len(fields) == 2:
+				urls <- fields[1]
+			case fields[0] == "window" && len(fields) == 3:
+				window, _ := strconv.ParseInt(fields[1], 10, 64)
+				ids := []string{}
+				if fields[2] != "" {
+					ids = strings.Split(fields[2], ",")
+				}
+				p.mu.Lock()
+				p.windows[window] = ids
+				p.mu.Unlock()
+			}
+		}
+	}()
+	select {
+	case p.url = <-urls:
+	case <-time.After(10 * time.Second):
+		p.cmd.Process.Kill()
+		t.Fatalf("Instance didn't start\n")
+	}
+	return p
+}
+
+func (p *shardProcess) kill() {
+	p.cmd.Process.Kill()
+	p.cmd.Wait()
+}
+
+// owned returns the checks the instance owned in a window, and whether it
+// reported the window.
+func (p *shardProcess) owned(window int64) ([]string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ids, ok := p.windows[window]
+	return ids, ok
+}
+
+func TestClusterProcesses(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs instances in processes of their own")
+	}
+	interval := 200 * time.Millisecond
+	start := time.Now()
+	a := startShardProcess(t, interval, "")
+	b := startShardProcess(t, interval, a.url)
+	c := startShardProcess(t, interval, a.url)
+	processes := []*shardProcess{a, b, c}
+	defer func() {
+		for _, p := range processes {
+			p.kill()
+		}
+	}()
+
+	// Every check is polled exactly once in each window checked, once the
+	// instances have settled in, and again after one of them dies without
+	// leaving and expires.
+	checkWindows := func(from time.Time, until time.Time, live []*shardProcess) {
+		checked := 0
+		for window := from.Truncate(interval).Add(interval); window.Before(until); window = window.Add(interval) {
+			polls := map[string]int{}
+			reported := true
+			for _, p := range live {
+				ids, ok := p.owned(window.UnixNano())
+				if !ok || len(ids) == 0 {
+					reported = reported && ok
+					continue
+				}
+				for _, id := range ids {
+					polls[id]++
+				}
+			}
+			if !reported {
+				continue
+			}
+			checked++
+			for i := 0; i < 100; i++ {
+				if n := polls[fmt.Sprint(i)]; n != 1 {
+					t.Errorf("Expected check %d to be polled once in the window at %s, got %d\n", i, window.Format("15:04:05.000"), n)
+				}
+			}
+		}
+		if checked < 2 {
+			t.Errorf("Expected at least 2 windows to check between %s and %s, got %d\n", from.Format("15:04:05.000"), until.Format("15:04:05.000"), checked)
+		}
+	}
+
+	settled := start.Add(5 * interval)
+	time.Sleep(12 * interval)
+	killed := time.Now()
+	c.kill()
+	checkWindows(settled, killed.Add(-interval), processes)
+
+	expired := killed.Add(4 * interval)
+	time.Sleep(10 * interval)
+	checkWindows(expired, time.Now().Add(-interval), []*shardProcess{a, b})
+	for _, p := range []*shardProcess{a, b} {
+		if ids, _ := p.owned(time.Now().Add(-2 * interval).Truncate(interval).UnixNano()); len(ids) == 0 {
+			t.Errorf("Expected both survivors to own checks, %s owned none\n", p.url)
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/radalert/layer4/pacemaker"
+	"golang.org/x/net/trace"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// spoolPath is where metrics that couldn't be dispatched before shutdown are
+// kept, or "" if there's no state dir to keep them in.
+func spoolPath(config Config) string {
+	if config.StateDir == "" {
+		return ""
+	}
+	return filepath.Join(config.StateDir, "spool.json")
+}
+
+// SpoolMetrics adds metrics to the spool at path, to be dispatched when nudger
+// next starts. Metrics are marshalled one by one, so any that can't be are
+// dropped without costing the rest. It returns how many of metrics were
+// spooled.
+func SpoolMetrics(path string, metrics []Metric) (int, error) {
+	spooled, err := readSpool(path)
+	if err != nil {
+		return 0, err
+	}
+	marshalled := []json.RawMessage{}
+	for _, m := range append(spooled, metrics...) {
+		b, err := json.Marshal(m)
+		if err != nil {
+			log.Printf("[error] SpoolMetrics: dropping %q: %s\n", m.Check, err)
+			continue
+		}
+		marshalled = append(marshalled, b)
+	}
+	body, err := json.Marshal(marshalled)
+	if err != nil {
+		return 0, err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, body, 0600)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		return 0, err
+	}
+	Stats.Spooled(len(marshalled))
+	return len(marshalled) - len(spooled), nil
+}
+
+// UnspoolMetrics returns the metrics spooled at path, and empties the spool.
+func UnspoolMetrics(path string) ([]Metric, error) {
+	spooled, err := readSpool(path)
+	if err != nil || len(spooled) == 0 {
+		return nil, err
+	}
+	if err := os.Remove(path); err != nil {
+		return nil, err
+	}
+	Stats.Spooled(0)
+	return spooled, nil
+}
+
+func readSpool(path string) ([]Metric, error) {
+	body, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var spooled []Metric
+	if err := json.Unmarshal(body, &spooled); err != nil {
+		return nil, fmt.Errorf("couldn't decode %s: %s", path, err)
+	}
+	return spooled, nil
+}
+
+// DrainSummary is what happened to the metrics queued for dispatch when
+// nudger shut down.
+type DrainSummary struct {
+	Dispatched int
+	Spooled    int
+	Dropped    int
+}
+
+func (s DrainSummary) String() string {
+	return fmt.Sprintf("%d metrics dispatched while draining, %d spooled, %d dropped", s.Dispatched, s.Spooled, s.Dropped)
+}
+
+// drainQueue dispatches queued metrics until finished is closed and the queue
+// is empty, or timeout passes. Metrics that fail to dispatch for now, e.g.
+// while Pacemaker is down, or that are still queued when timeout passes, are
+// spooled, or dropped if there's nowhere to spool them. Metrics Pacemaker
+// will never accept are dropped. Windows the aggregator has open are flushed early, as there
+// won't be anything more to add to them.
+func drainQueue(config Config, client *pacemaker.Client, events trace.EventLog, aggregator *WindowAggregator, metrics chan Metric, finished <-chan struct{}, timeout time.Duration) DrainSummary {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	summary := DrainSummary{}
+	unsent := []Metric{}
+	dispatch := func(metric Metric) {
+		if err := dispatchTraced(ctx, client, events, metric); err != nil {
+			if pacemaker.Temporary(err) {
+				unsent = append(unsent, metric)
+			} else {
+				summary.Dropped++
+			}
+			return
+		}
+		summary.Dispatched++
+	}
+drain:
+	for {
+		select {
+		case metric := <-metrics:
+			if !aggregator.Add(metric) {
+				dispatch(metric)
+			}
+		case <-finished:
+			for len(metrics) > 0 {
+				if metric := <-metrics; !aggregator.Add(metric) {
+					dispatch(metric)
+				}
+			}
+			for _, metric := range aggregator.FlushAll() {
+				dispatch(metric)
+			}
+			break drain
+		case <-ctx.Done():
+			for len(metrics) > 0 {
+				unsent = append(unsent, <-metrics)
+			}
+			unsent = append(unsent, aggregator.FlushAll()...)
+			break drain
+		}
+	}
+	if len(unsent) == 0 {
+		return summary
+	}
+
+	path := spoolPath(config)
+	if path == "" {
+		log.Printf("[error] drainQueue: no --state-dir to spool %d metrics to\n", len(unsent))
+		summary.Dropped += len(unsent)
+		return summary
+	}
+	spooled, err := SpoolMetrics(path, unsent)
+	if err != nil {
+		log.Printf("[error] drainQueue: couldn't spool %d metrics: %s\n", len(unsent), err)
+	}
+	summary.Spooled = spooled
+	summary.Dropped += len(unsent) - spooled
+	return summary
+}
+
+// waitTimeout waits for wg, giving up after timeout. It returns whether
+// everything finished in time.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// Shutdown stops nudger gracefully, once the context for scheduling polls and
+// flushing receivers has been cancelled. Dispatch drains from here on (if it
+// isn't already), so metrics that fail to dispatch are spooled. In-flight
+// polls and receivers' final flushes get half of config.ShutdownTimeout to
+// finish, after which any polls still going are cancelled and finished is
+// closed. Dispatch has until config.ShutdownTimeout to empty the queue.
+func Shutdown(config Config, polls *sync.WaitGroup, cancelPolls context.CancelFunc, drain context.CancelFunc, finished chan struct{}, drained chan DrainSummary) {
+	start := time.Now()
+	grace := config.ShutdownTimeout / 2
+	drain()
+
+	polled := waitTimeout(polls, grace)
+	flushed := waitTimeout(&flushers, grace-time.Since(start))
+	cancelPolls()
+	if !polled {
+		log.Println("[info] Shutdown: cancelled polls still in flight")
+		waitTimeout(polls, time.Second)
+	}
+	if !flushed {
+		log.Println("[error] Shutdown: receivers didn't finish flushing in time")
+	}
+	close(finished)
+
+	summary := <-drained
+	log.Printf("[info] Shutdown: stopped after %s: %s\n", time.Since(start).Round(time.Millisecond), summary)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDispatchDrainsOnShutdown(t *testing.T) {
+	var received int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+	}))
+	defer server.Close()
+
+	config := Config{Pacemaker: server.URL, ShutdownTimeout: 10 * time.Second}
+	metrics := make(chan Metric, 10)
+	for i := 0; i < 5; i++ {
+		metrics <- Metric{Check: "queued"}
+	}
+
+	// Dispatch is cancelled before it starts, so it returns once the queue
+	// has drained.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	finished := make(chan struct{})
+	close(finished)
+	summary := Dispatch(ctx, config, metrics, finished)
+
+	if atomic.LoadInt32(&received) != 5 || summary.Spooled != 0 || summary.Dropped != 0 {
+		t.Errorf("Expected every queued metric to be dispatched, got %s and %d received\n", summary, received)
+	}
+	if len(metrics) != 0 {
+		t.Errorf("Expected queue to be empty, got %d\n", len(metrics))
+	}
+}
+
+func TestDrainWaitsForProducers(t *testing.T) {
+	var received int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&received, 1)
+	}))
+	defer server.Close()
+
+	metrics := make(chan Metric, 10)
+	finished := make(chan struct{})
+	go func() {
+		// A poll still in flight when draining starts.
+		time.Sleep(50 * time.Millisecond)
+		metrics <- Metric{Check: "late"}
+		close(finished)
+	}()
+
+	summary := drainQueue(Config{Pacemaker: server.URL}, NewPacemakerClient(Config{Pacemaker: server.URL}), nullEvents{}, nil, metrics, finished, 5*time.Second)
+	if summary.Dispatched != 1 || atomic.LoadInt32(&received) != 1 {
+		t.Errorf("Expected the late metric to be dispatched, got %s\n", summary)
+	}
+}
+
+func TestDrainSpoolsUndispatched(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "nudger")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := Config{Pacemaker: server.URL, StateDir: dir}
+	metrics := make(chan Metric, 10)
+	metrics <- Metric{Check: "first", Metric: 1}
+	metrics <- Metric{Check: "second", Metric: 2}
+
+	finished := make(chan struct{})
+	close(finished)
+	summary := drainQueue(config, NewPacemakerClient(config), nullEvents{}, nil, metrics, finished, time.Second)
+	if summary.Spooled != 2 {
+		t.Errorf("Expected 2 metrics spooled, got %s\n", summary)
+	}
+
+	spooled, err := UnspoolMetrics(spoolPath(config))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if len(spooled) != 2 || spooled[0].Check != "first" || spooled[1].Metric != 2 {
+		t.Errorf("Expected spooled metrics back, got %+v\n", spooled)
+	}
+	if again, _ := UnspoolMetrics(spoolPath(config)); len(again) != 0 {
+		t.Errorf("Expected spool to be emptied, got %+v\n", again)
+	}
+
+	// Without a state dir, there's nowhere to spool to.
+	metrics <- Metric{Check: "first"}
+	summary = drainQueue(Config{Pacemaker: server.URL}, NewPacemakerClient(Config{Pacemaker: server.URL}), nullEvents{}, nil, metrics, finished, time.Second)
+	if summary.Dropped != 1 {
+		t.Errorf("Expected 1 metric dropped, got %s\n", summary)
+	}
+}
+
+func TestDrainDropsRejected(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no such org", http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "nudger")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Neither will ever be accepted, so they aren't spooled.
+	config := Config{Pacemaker: server.URL, StateDir: dir}
+	metrics := make(chan Metric, 10)
+	metrics <- Metric{Check: "rejected", Metric: 1}
+	metrics <- Metric{Check: "unmarshallable", Metric: math.NaN()}
+	finished := make(chan struct{})
+	close(finished)
+	summary := drainQueue(config, NewPacemakerClient(config), nullEvents{}, nil, metrics, finished, time.Second)
+	if summary.Spooled != 0 || summary.Dropped != 2 {
+		t.Errorf("Expected both metrics dropped, got %s\n", summary)
+	}
+}
+
+func TestSpoolSkipsUnmarshallable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nudger")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spool.json")
+
+	n, err := SpoolMetrics(path, []Metric{Metric{Check: "good", Metric: 1}, Metric{Check: "bad", Metric: math.Inf(1)}})
+	if err != nil || n != 1 {
+		t.Errorf("Expected 1 metric spooled, got %d and %v\n", n, err)
+	}
+	spooled, err := UnspoolMetrics(path)
+	if err != nil || len(spooled) != 1 || spooled[0].Check != "good" {
+		t.Errorf("Expected the good metric back, got %+v and %v\n", spooled, err)
+	}
+}
+
+func TestFlushEveryFlushesOnCancel(t *testing.T) {
+	agg := NewStatsdAggregator("abc")
+	agg.Add(StatsdSample{Name: "web.requests", Type: "c", Value: 3, Rate: 1})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	metrics := make(chan Metric, 10)
+	done := make(chan struct{})
+	flushers.Add(1)
+	go func() {
+		FlushEvery(ctx, agg, time.Hour, metrics)
+		close(done)
+	}()
+	cancel()
+	<-done
+
+	results := collect(metrics)
+	if results["web.requests: count"] != 3 {
+		t.Errorf("Expected a final flush of the counter, got %+v\n", results)
+	}
+}
+
+// nullEvents is a trace.EventLog that discards events.
+type nullEvents struct{}
+
+func (nullEvents) Printf(format string, a ...interface{}) {}
+func (nullEvents) Errorf(format string, a ...interface{}) {}
+func (nullEvents) Finish()                                {}
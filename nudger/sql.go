@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sqlMaxRows caps how many rows a query can turn into metrics, so a query
+// missing its GROUP BY or LIMIT doesn't flood Pacemaker.
+const sqlMaxRows = 100
+
+// sqlMaxTimeout caps how long a check can ask for its query to run.
+const sqlMaxTimeout = time.Second * 30
+
+var sqlDatabases = struct {
+	sync.Mutex
+	open map[string]*sql.DB
+}{open: map[string]*sql.DB{}}
+
+// sqlDSN looks up the DSN a check refers to. Checks name an environment
+// variable rather than holding the DSN, so database credentials stay on the
+// host nudger runs on, and only variables prefixed NUDGER_DSN_ can be read.
+func sqlDSN(ref string) (string, error) {
+	if ref == "" {
+		return "", fmt.Errorf("no dsn given")
+	}
+	name := "NUDGER_DSN_" + strings.ToUpper(ref)
+	dsn := os.Getenv(name)
+	if dsn == "" {
+		return "", fmt.Errorf("%s is not set", name)
+	}
+	return dsn, nil
+}
+
+// sqlDriverRegistered is whether a driver is compiled in.
+func sqlDriverRegistered(driver string) bool {
+	for _, registered := range sql.Drivers() {
+		if registered == driver {
+			return true
+		}
+	}
+	return false
+}
+
+// sqlDatabase returns a connection pool for a driver and DSN, reusing the
+// pool between polls.
+func sqlDatabase(driver string, dsn string) (*sql.DB, error) {
+	sqlDatabases.Lock()
+	defer sqlDatabases.Unlock()
+
+	key := driver + "\x00" + dsn
+	if db, ok := sqlDatabases.open[key]; ok {
+		return db, nil
+	}
+	if driver == "sqlite3" {
+		dsn = sqliteQueryOnly(dsn)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(2)
+	sqlDatabases.open[key] = db
+	return db, nil
+}
+
+// sqliteQueryOnly sets the query_only pragma on every connection opened with
+// a SQLite DSN, as the driver ignores read-only transactions.
+func sqliteQueryOnly(dsn string) string {
+	path, query := dsn, ""
+	if i := strings.IndexByte(dsn, '?'); i >= 0 {
+		path, query = dsn[:i], dsn[i+1:]
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		// The driver will refuse it anyway.
+		return dsn
+	}
+	params.Set("_query_only", "true")
+	return path + "?" + params.Encode()
+}
+
+// CheckReadOnlyQuery rejects queries that aren't a single SELECT (or WITH ...
+// SELECT). Queries are also run in a read-only transaction (or for SQLite on
+// a query_only connection), but not every database enforces that, so this is
+// checked first.
+func CheckReadOnlyQuery(query string) error {
+	q := strings.TrimSpace(query)
+	for strings.HasPrefix(q, "--") || strings.HasPrefix(q, "/*") {
+		end, skip := strings.Index(q, "\n"), 1
+		if strings.HasPrefix(q, "/*") {
+			end, skip = strings.Index(q, "*/"), 2
+		}
+		if end < 0 {
+			return fmt.Errorf("no query after comment")
+		}
+		q = strings.TrimSpace(q[end+skip:])
+	}
+	q = strings.TrimSpace(strings.TrimSuffix(q, ";"))
+	if strings.Contains(q, ";") {
+		return fmt.Errorf("only a single statement is allowed")
+	}
+	fields := strings.Fields(q)
+	if len(fields) == 0 {
+		return fmt.Errorf("empty query")
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "SELECT", "WITH":
+		return nil
+	}
+	return fmt.Errorf("only SELECT queries are allowed, got %s", fields[0])
+}
+
+// sqlNumber converts a column value to a number. Drivers return numeric
+// columns as integers, floats, or (for decimals) text.
+func sqlNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	case []byte:
+		f, err := strconv.ParseFloat(string(v), 64)
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// sqlText converts a column value to text, for use in a metric name.
+func sqlText(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.Format(time.RFC3339)
+	}
+	return fmt.Sprint(value)
+}
+
+// QuerySQL runs a check's query in a read-only transaction, or for SQLite on
+// a query_only connection, and returns a metric for each numeric value it
+// returns. The first column of each row is the metric name's suffix, and each
+// remaining column is a value. A query returning a single column emits its
+// values under the check's name.
+func QuerySQL(ctx context.Context, check Check) ([]Metric, error) {
+	if err := CheckReadOnlyQuery(check.Query); err != nil {
+		return nil, err
+	}
+	dsn, err := sqlDSN(check.DSN)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sqlDatabase(check.Driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("begin read-only transaction: %s", err)
+	}
+	// Nothing is ever committed.
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, check.Query)
+	if err != nil {
+		return nil, fmt.Errorf("query: %s", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("query returned no columns")
+	}
+
+	metrics := []Metric{}
+	emit := func(suffix string, value float64) {
+		name := check.Name
+		if suffix != "" {
+			name += ": " + suffix
+		}
+		metrics = append(metrics, Metric{
+			ApiKey: check.ApiKey,
+			Check:  name,
+			Metric: value,
+			TTL:    400,
+			Tags:   check.Tags,
+		})
+	}
+
+	values := make([]interface{}, len(columns))
+	pointers := make([]interface{}, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	for n := 0; rows.Next(); n++ {
+		if n == sqlMaxRows {
+			return metrics, fmt.Errorf("query returned more than %d rows, ignoring the rest", sqlMaxRows)
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return metrics, fmt.Errorf("scan: %s", err)
+		}
+
+		if len(columns) == 1 {
+			value, ok := sqlNumber(values[0])
+			if !ok {
+				return metrics, fmt.Errorf("%s is %v, not a number", columns[0], values[0])
+			}
+			emit("", value)
+			continue
+		}
+
+		suffix := sqlText(values[0])
+		for i := 1; i < len(columns); i++ {
+			if values[i] == nil {
+				continue
+			}
+			value, ok := sqlNumber(values[i])
+			if !ok {
+				Logf(ctx, "[error] QuerySQL: %s: %s %s is %v, not a number\n", check.Name, suffix, columns[i], values[i])
+				continue
+			}
+			name := suffix
+			if len(columns) > 2 {
+				name = strings.TrimSpace(suffix + " " + columns[i])
+			}
+			emit(name, value)
+		}
+	}
+	return metrics, rows.Err()
+}
+
+// PollSQL runs a check's query against its database, with a timeout of the
+// check's timeout in seconds (5 by default, and at most 30).
+func PollSQL(ctx context.Context, check Check, metrics chan Metric) {
+	timeout := time.Second * 5
+	if check.Timeout > 0 {
+		timeout = time.Duration(check.Timeout * float64(time.Second))
+	}
+	if timeout > sqlMaxTimeout {
+		timeout = sqlMaxTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	results, err := QuerySQL(ctx, check)
+	if err != nil {
+		Logf(ctx, "[error] PollSQL: %s: %s\n", check.Name, err)
+	}
+	for _, m := range results {
+		metrics <- m
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"github.com/radalert/layer4/secret"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeDB is a stand-in database driver that answers queries from a fixed
+// table of results, and records the transactions it's asked to begin.
+type fakeDB struct {
+	results  map[string][][]driver.Value
+	columns  map[string][]string
+	readOnly []bool
+	queries  []string
+}
+
+var fake = &fakeDB{
+	columns: map[string][]string{
+		"SELECT count(*) FROM orders":                                  {"count"},
+		"SELECT status, count(*) FROM orders GROUP BY status":          {"status", "count"},
+		"SELECT region, count(*) AS orders, sum(total) AS revenue ...": {"region", "orders", "revenue"},
+	},
+	results: map[string][][]driver.Value{
+		"SELECT count(*) FROM orders":                         {{int64(42)}},
+		"SELECT status, count(*) FROM orders GROUP BY status": {{"paid", int64(40)}, {[]byte("failed"), []byte("2")}},
+		"SELECT region, count(*) AS orders, sum(total) AS revenue ...": {
+			{"eu", int64(3), 59.5}, {"us", int64(1), nil},
+		},
+	},
+}
+
+func init() {
+	sql.Register("fake", fake)
+}
+
+func (d *fakeDB) Open(name string) (driver.Conn, error) { return &fakeConn{db: d}, nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("prepare not supported")
+}
+func (c *fakeConn) Close() error              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error) { return c, nil }
+func (c *fakeConn) Commit() error             { return nil }
+func (c *fakeConn) Rollback() error           { return nil }
+
+func (c *fakeConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	c.db.readOnly = append(c.db.readOnly, opts.ReadOnly)
+	return c, nil
+}
+
+func (c *fakeConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	c.db.queries = append(c.db.queries, query)
+	if query == "SELECT pg_sleep(10)" {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	columns, ok := c.db.columns[query]
+	if !ok {
+		return nil, fmt.Errorf("no such table")
+	}
+	return &fakeRows{columns: columns, rows: c.db.results[query]}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func TestCheckReadOnlyQuery(t *testing.T) {
+	allowed := []string{
+		"SELECT 1",
+		"  select count(*) from orders;",
+		"-- orders in the last 5 minutes\nSELECT count(*) FROM orders",
+		"/* cte */ WITH recent AS (SELECT 1) SELECT * FROM recent",
+	}
+	for _, q := range allowed {
+		if err := CheckReadOnlyQuery(q); err != nil {
+			t.Errorf("Expected %q to be allowed, got %s\n", q, err)
+		}
+	}
+
+	rejected := []string{
+		"",
+		"DELETE FROM orders",
+		"SELECT 1; DROP TABLE orders",
+		"-- SELECT 1",
+		"/* SELECT */ UPDATE orders SET total = 0",
+	}
+	for _, q := range rejected {
+		if err := CheckReadOnlyQuery(q); err == nil {
+			t.Errorf("Expected %q to be rejected\n", q)
+		}
+	}
+}
+
+func TestPollSQL(t *testing.T) {
+	os.Setenv("NUDGER_DSN_SHOP", "shop")
+	defer os.Unsetenv("NUDGER_DSN_SHOP")
+
+	tests := []struct {
+		query    string
+		expected map[string]float64
+	}{
+		{"SELECT count(*) FROM orders", map[string]float64{"orders": 42}},
+		{"SELECT status, count(*) FROM orders GROUP BY status", map[string]float64{
+			"orders: paid":   40,
+			"orders: failed": 2,
+		}},
+		{"SELECT region, count(*) AS orders, sum(total) AS revenue ...", map[string]float64{
+			"orders: eu orders":  3,
+			"orders: eu revenue": 59.5,
+			"orders: us orders":  1,
+		}},
+	}
+
+	for _, test := range tests {
+		fake.readOnly = nil
+		metrics := make(chan Metric, 10)
+		PollSQL(context.Background(), Check{Type: "sql", Name: "orders", Driver: "fake", DSN: "shop", Query: test.query}, metrics)
+		results := collect(metrics)
+
+		if len(results) != len(test.expected) {
+			t.Errorf("Expected %d metrics for %q, got %+v\n", len(test.expected), test.query, results)
+		}
+		for name, value := range test.expected {
+			if results[name] != value {
+				t.Errorf("Expected %s to be %f, got %f\n", name, value, results[name])
+			}
+		}
+		if len(fake.readOnly) != 1 || !fake.readOnly[0] {
+			t.Errorf("Expected query to run in a read-only transaction, got %v\n", fake.readOnly)
+		}
+	}
+}
+
+func TestPollSQLRejected(t *testing.T) {
+	os.Setenv("NUDGER_DSN_SHOP", "shop")
+	defer os.Unsetenv("NUDGER_DSN_SHOP")
+	fake.queries = nil
+
+	checks := []Check{
+		{Name: "orders", Driver: "fake", DSN: "shop", Query: "DELETE FROM orders"},
+		{Name: "orders", Driver: "fake", DSN: "elsewhere", Query: "SELECT 1"},
+		{Name: "orders", Driver: "fake", Query: "SELECT 1"},
+	}
+	for _, check := range checks {
+		metrics := make(chan Metric, 10)
+		PollSQL(context.Background(), check, metrics)
+		if len(metrics) != 0 {
+			t.Errorf("Expected no metrics for %+v, got %d\n", check, len(metrics))
+		}
+	}
+	if len(fake.queries) != 0 {
+		t.Errorf("Expected no queries to reach the database, got %v\n", fake.queries)
+	}
+}
+
+func TestPollSQLTimeout(t *testing.T) {
+	os.Setenv("NUDGER_DSN_SHOP", "shop")
+	defer os.Unsetenv("NUDGER_DSN_SHOP")
+
+	start := time.Now()
+	metrics := make(chan Metric, 10)
+	PollSQL(context.Background(), Check{Name: "slow", Driver: "fake", DSN: "shop", Query: "SELECT pg_sleep(10)", Timeout: 0.1}, metrics)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected query to time out after 100ms, took %s\n", elapsed)
+	}
+	if len(metrics) != 0 {
+		t.Errorf("Expected no metrics from a timed out query, got %d\n", len(metrics))
+	}
+}
+
+func TestPollSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nudger")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "shop.db")
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	defer db.Close()
+	for _, statement := range []string{
+		"CREATE TABLE orders (status TEXT, total REAL)",
+		"INSERT INTO orders VALUES ('paid', 20.5), ('paid', 9.5), ('failed', 12)",
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("Couldn't set up the database: %s\n", err)
+		}
+	}
+
+	os.Setenv("NUDGER_DSN_SQLITE_SHOP", "file:"+path+"?mode=ro")
+	defer os.Unsetenv("NUDGER_DSN_SQLITE_SHOP")
+	check := Check{Type: "sql", Name: "orders", Driver: "sqlite3", DSN: "sqlite_shop", Query: "SELECT status, count(*) AS orders, sum(total) AS revenue FROM orders GROUP BY status", ApiKey: secret.New("def")}
+	if err := check.Validate(); err != nil {
+		t.Errorf("Expected the check to be valid, got %s\n", err)
+	}
+	metrics := make(chan Metric, 10)
+	PollSQL(context.Background(), check, metrics)
+	results := collect(metrics)
+
+	expected := map[string]float64{
+		"orders: failed orders":  1,
+		"orders: failed revenue": 12,
+		"orders: paid orders":    2,
+		"orders: paid revenue":   30,
+	}
+	if len(results) != len(expected) {
+		t.Errorf("Expected %d metrics, got %+v\n", len(expected), results)
+	}
+	for name, value := range expected {
+		if results[name] != value {
+			t.Errorf("Expected %s to be %f, got %f\n", name, value, results[name])
+		}
+	}
+}
+
+func TestSQLiteQueryOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nudger")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "shop.db")
+
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	defer db.Close()
+	for _, statement := range []string{
+		"CREATE TABLE orders (status TEXT, total REAL)",
+		"INSERT INTO orders VALUES ('paid', 20.5)",
+	} {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatalf("Couldn't set up the database: %s\n", err)
+		}
+	}
+
+	// The DSN doesn't ask for read-only, and tries to turn query_only off.
+	os.Setenv("NUDGER_DSN_SQLITE_WRITABLE", path+"?_query_only=0")
+	defer os.Unsetenv("NUDGER_DSN_SQLITE_WRITABLE")
+	query := "WITH x AS (SELECT 1) DELETE FROM orders RETURNING total"
+	if err := CheckReadOnlyQuery(query); err != nil {
+		t.Fatalf("Expected the CTE to get past CheckReadOnlyQuery, got %s\n", err)
+	}
+	check := Check{Type: "sql", Name: "orders", Driver: "sqlite3", DSN: "sqlite_writable", Query: query, ApiKey: secret.New("def")}
+	if _, err := QuerySQL(context.Background(), check); err == nil || !strings.Contains(err.Error(), "readonly") {
+		t.Errorf("Expected the DELETE to be refused by SQLite, got %v\n", err)
+	}
+	var count int
+	if err := db.QueryRow("SELECT count(*) FROM orders").Scan(&count); err != nil || count != 1 {
+		t.Errorf("Expected the order to still be there, got %d and %v\n", count, err)
+	}
+}
+
+func TestSQLDriversCompiledIn(t *testing.T) {
+	for _, driver := range []string{"postgres", "mysql", "sqlite3"} {
+		if !sqlDriverRegistered(driver) {
+			t.Errorf("Expected the %s driver to be compiled in\n", driver)
+		}
+	}
+	check := Check{Type: "sql", Name: "orders", Driver: "oracle", DSN: "shop", Query: "SELECT 1", ApiKey: secret.New("def")}
+	if err := check.Validate(); err == nil || !strings.Contains(err.Error(), "unknown driver") {
+		t.Errorf("Expected an unknown driver to be invalid, got %v\n", err)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pollBuckets are the upper bounds, in seconds, of the poll latency
+// histograms.
+var pollBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(value float64) {
+	for i, le := range pollBuckets {
+		if value <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// SelfStats is what nudger knows about how well it's working, served in the
+// Prometheus text format on /metrics, and summarised by /healthz and /readyz.
+type SelfStats struct {
+	sync.Mutex
+	started time.Time
+
+	checks             int
+	checksLoaded       time.Time
+	checksFailures     uint64
+	checksFailingSince time.Time
+
+	polls map[string]*histogram
+
+	dispatched           uint64
+	dispatchFailures     uint64
+	dispatchFailingSince time.Time
+
+	spooled int
+
+	windowLate uint64
+
+	members int
+	owned   int
+}
+
+var Stats = NewSelfStats()
+
+func NewSelfStats() *SelfStats {
+	return &SelfStats{started: time.Now(), polls: map[string]*histogram{}}
+}
+
+// ChecksLoaded records a successful fetch of n checks.
+func (s *SelfStats) ChecksLoaded(n int) {
+	s.Lock()
+	defer s.Unlock()
+	s.checks = n
+	s.checksLoaded = time.Now()
+	s.checksFailingSince = time.Time{}
+}
+
+// ChecksFailed records a failed fetch of checks.
+func (s *SelfStats) ChecksFailed() {
+	s.Lock()
+	defer s.Unlock()
+	s.checksFailures++
+	if s.checksFailingSince.IsZero() {
+		s.checksFailingSince = time.Now()
+	}
+}
+
+// Polled records how long polling a check of a source took.
+func (s *SelfStats) Polled(source string, elapsed time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	h, ok := s.polls[source]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(pollBuckets))}
+		s.polls[source] = h
+	}
+	h.observe(elapsed.Seconds())
+}
+
+// Dispatched records whether submitting a metric to Pacemaker worked.
+func (s *SelfStats) Dispatched(ok bool) {
+	s.Lock()
+	defer s.Unlock()
+	if ok {
+		s.dispatched++
+		s.dispatchFailingSince = time.Time{}
+		return
+	}
+	s.dispatchFailures++
+	if s.dispatchFailingSince.IsZero() {
+		s.dispatchFailingSince = time.Now()
+	}
+}
+
+// Spooled records how many metrics are spooled to disk, waiting to be
+// dispatched when nudger next starts.
+func (s *SelfStats) Spooled(n int) {
+	s.Lock()
+	defer s.Unlock()
+	s.spooled = n
+}
+
+// WindowLate records a point dropped for arriving after its aggregation
+// window was flushed.
+func (s *SelfStats) WindowLate() {
+	s.Lock()
+	defer s.Unlock()
+	s.windowLate++
+}
+
+// Sharded records how many instances checks are shared between, and how many
+// this instance polled in the latest cycle.
+func (s *SelfStats) Sharded(members int, owned int) {
+	s.Lock()
+	defer s.Unlock()
+	s.members = members
+	s.owned = owned
+}
+
+// Problems lists the reasons nudger isn't healthy: fetching checks or
+// dispatching to Pacemaker has been failing for longer than grace.
+func (s *SelfStats) Problems(grace time.Duration) []string {
+	s.Lock()
+	defer s.Unlock()
+	problems := []string{}
+	if !s.checksFailingSince.IsZero() && time.Since(s.checksFailingSince) > grace {
+		problems = append(problems, fmt.Sprintf("fetching checks has failed since %s", s.checksFailingSince.Format(time.RFC3339)))
+	}
+	if !s.dispatchFailingSince.IsZero() && time.Since(s.dispatchFailingSince) > grace {
+		problems = append(problems, fmt.Sprintf("dispatching to Pacemaker has failed since %s", s.dispatchFailingSince.Format(time.RFC3339)))
+	}
+	return problems
+}
+
+// Ready is whether checks have been fetched at least once.
+func (s *SelfStats) Ready() bool {
+	s.Lock()
+	defer s.Unlock()
+	return !s.checksLoaded.IsZero()
+}
+
+// WritePrometheus writes the stats in the Prometheus text format, along with
+// the depth and capacity of the queue of metrics waiting to be dispatched.
+func (s *SelfStats) WritePrometheus(w io.Writer, queue chan Metric) {
+	s.Lock()
+	defer s.Unlock()
+
+	gauge := func(name string, help string, value float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", name, help, name, name, value)
+	}
+	counter := func(name string, help string, value uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", name, help, name, name, value)
+	}
+	timestamp := func(t time.Time) float64 {
+		if t.IsZero() {
+			return 0
+		}
+		return float64(t.UnixNano()) / 1e9
+	}
+
+	gauge("nudger_start_time_seconds", "When nudger started, in seconds since the epoch.", timestamp(s.started))
+	gauge("nudger_checks_loaded", "Number of checks fetched from the console.", float64(s.checks))
+	gauge("nudger_checks_last_loaded_time_seconds", "When checks were last fetched, in seconds since the epoch.", timestamp(s.checksLoaded))
+	counter("nudger_checks_load_failures_total", "Failed fetches of checks from the console.", s.checksFailures)
+
+	sources := []string{}
+	for source := range s.polls {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	fmt.Fprintf(w, "# HELP nudger_poll_duration_seconds How long polling a check took, by source.\n")
+	fmt.Fprintf(w, "# TYPE nudger_poll_duration_seconds histogram\n")
+	for _, source := range sources {
+		h := s.polls[source]
+		for i, le := range pollBuckets {
+			fmt.Fprintf(w, "nudger_poll_duration_seconds_bucket{source=%q,le=\"%g\"} %d\n", source, le, h.counts[i])
+		}
+		fmt.Fprintf(w, "nudger_poll_duration_seconds_bucket{source=%q,le=\"+Inf\"} %d\n", source, h.count)
+		fmt.Fprintf(w, "nudger_poll_duration_seconds_sum{source=%q} %g\n", source, h.sum)
+		fmt.Fprintf(w, "nudger_poll_duration_seconds_count{source=%q} %d\n", source, h.count)
+	}
+
+	fmt.Fprintf(w, "# HELP nudger_dispatch_total Metrics submitted to Pacemaker, by result.\n")
+	fmt.Fprintf(w, "# TYPE nudger_dispatch_total counter\n")
+	fmt.Fprintf(w, "nudger_dispatch_total{result=\"success\"} %d\n", s.dispatched)
+	fmt.Fprintf(w, "nudger_dispatch_total{result=\"failure\"} %d\n", s.dispatchFailures)
+
+	fmt.Fprintf(w, "# HELP nudger_window_late_total Points dropped for arriving after their aggregation window was flushed.\n")
+	fmt.Fprintf(w, "# TYPE nudger_window_late_total counter\n")
+	fmt.Fprintf(w, "nudger_window_late_total %d\n", s.windowLate)
+
+	gauge("nudger_queue_depth", "Metrics waiting to be dispatched to Pacemaker.", float64(len(queue)))
+	gauge("nudger_queue_capacity", "How many metrics can wait to be dispatched before sources block.", float64(cap(queue)))
+	gauge("nudger_cluster_members", "Instances checks are shared between, or 0 if they aren't.", float64(s.members))
+	gauge("nudger_checks_owned", "Checks this instance polled in the latest cycle, when checks are shared.", float64(s.owned))
+	gauge("nudger_spool_size", "Metrics spooled to disk at shutdown, waiting to be dispatched.", float64(s.spooled))
+}
+
+// metricsHandler serves nudger's own metrics.
+func metricsHandler(stats *SelfStats, breakers *BreakerSet, queue chan Metric) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		stats.WritePrometheus(w, queue)
+		breakers.WritePrometheus(w)
+	}
+}
+
+// healthHandler returns 503 when fetching checks or dispatching to Pacemaker
+// has been failing for three intervals.
+func healthHandler(stats *SelfStats, config Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		problems := stats.Problems(3 * config.Interval)
+		if len(problems) > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, strings.Join(problems, "\n"))
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// readyHandler returns 503 until checks have been fetched, as until then
+// nudger isn't polling anything. The host agent doesn't fetch checks, so it's
+// always ready.
+func readyHandler(stats *SelfStats, config Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !config.Agent && !stats.Ready() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintln(w, "checks haven't been fetched yet")
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
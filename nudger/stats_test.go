@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSelfStatsPrometheus(t *testing.T) {
+	stats := NewSelfStats()
+	stats.ChecksLoaded(3)
+	stats.ChecksFailed()
+	stats.Polled("tcp", 30*time.Millisecond)
+	stats.Polled("tcp", 2*time.Second)
+	stats.Dispatched(true)
+	stats.Dispatched(true)
+	stats.Dispatched(false)
+
+	queue := make(chan Metric, 10)
+	queue <- Metric{}
+	var buf bytes.Buffer
+	stats.WritePrometheus(&buf, queue)
+
+	families, err := ParsePrometheus(&buf)
+	if err != nil {
+		t.Fatalf("Expected valid exposition format, got %s\n", err)
+	}
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, s := range family.Samples {
+			values[promSeriesName(s.Name, s.Labels)] = s.Value
+		}
+	}
+
+	expected := map[string]float64{
+		`nudger_checks_loaded`:                                        3,
+		`nudger_checks_load_failures_total`:                           1,
+		`nudger_poll_duration_seconds_bucket{le="0.05",source="tcp"}`: 1,
+		`nudger_poll_duration_seconds_bucket{le="1",source="tcp"}`:    1,
+		`nudger_poll_duration_seconds_bucket{le="2.5",source="tcp"}`:  2,
+		`nudger_poll_duration_seconds_count{source="tcp"}`:            2,
+		`nudger_dispatch_total{result="success"}`:                     2,
+		`nudger_dispatch_total{result="failure"}`:                     1,
+		`nudger_queue_depth`:                                          1,
+		`nudger_queue_capacity`:                                       10,
+	}
+	for name, value := range expected {
+		if got, ok := values[name]; !ok || got != value {
+			t.Errorf("Expected %s to be %f, got %f (in %+v)\n", name, value, got, values)
+		}
+	}
+}
+
+func TestHealthAndReadiness(t *testing.T) {
+	stats := NewSelfStats()
+	config := Config{Interval: time.Millisecond}
+
+	get := func(handler http.HandlerFunc) int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/", nil))
+		return w.Code
+	}
+
+	if code := get(readyHandler(stats, config)); code != 503 {
+		t.Errorf("Expected not ready before checks are fetched, got %d\n", code)
+	}
+	if code := get(readyHandler(stats, Config{Agent: true})); code != 200 {
+		t.Errorf("Expected host agent to always be ready, got %d\n", code)
+	}
+	if code := get(healthHandler(stats, config)); code != 200 {
+		t.Errorf("Expected healthy at start, got %d\n", code)
+	}
+
+	stats.ChecksLoaded(1)
+	if code := get(readyHandler(stats, config)); code != 200 {
+		t.Errorf("Expected ready once checks are fetched, got %d\n", code)
+	}
+
+	stats.Dispatched(false)
+	time.Sleep(5 * time.Millisecond)
+	w := httptest.NewRecorder()
+	healthHandler(stats, config)(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != 503 || !strings.Contains(w.Body.String(), "Pacemaker") {
+		t.Errorf("Expected unhealthy while dispatch is failing, got %d: %s\n", w.Code, w.Body.String())
+	}
+
+	stats.Dispatched(true)
+	if code := get(healthHandler(stats, config)); code != 200 {
+		t.Errorf("Expected healthy once dispatch recovers, got %d\n", code)
+	}
+}
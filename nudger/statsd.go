@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/radalert/layer4/secret"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsdListener is a UDP address nudger receives StatsD metrics on.
+//
+// If ApiKey is set, everything received on the address is submitted with it.
+// Otherwise the first dotted segment of each metric name is taken as the API
+// key, e.g. "ff6d177b.web.requests:1|c".
+type StatsdListener struct {
+	Bind   string
+	ApiKey secret.Secret
+}
+
+// ParseStatsdListener parses a listener from the "address[=NAME]" form used
+// on the command line, where NAME is the secret holding the API key, so the
+// key itself isn't on the command line.
+func ParseStatsdListener(s string) (StatsdListener, error) {
+	parts := strings.SplitN(s, "=", 2)
+	l := StatsdListener{Bind: parts[0]}
+	if len(parts) == 2 {
+		apikey, err := loadNamedSecret(parts[1])
+		if err != nil {
+			return l, fmt.Errorf("--statsd %s: %s", parts[0], err)
+		}
+		l.ApiKey = apikey
+	}
+	return l, nil
+}
+
+// StatsdSample is a single parsed StatsD measurement.
+type StatsdSample struct {
+	Name  string
+	Value float64
+	Type  string  // c, g, ms, h or s
+	Rate  float64 // sample rate, between 0 and 1
+	Delta bool    // gauge adjustment (+N or -N) rather than an absolute value
+	Set   string  // raw member for sets
+	Tags  []string
+}
+
+// ParseStatsdLine parses a line of the StatsD protocol, which may hold more
+// than one value for the same name, e.g. "requests:1|c:2|c|@0.5".
+func ParseStatsdLine(line string) ([]StatsdSample, error) {
+	line = strings.TrimSpace(line)
+	colon := strings.IndexByte(line, ':')
+	if colon <= 0 {
+		return nil, fmt.Errorf("no name in %q", line)
+	}
+	name := line[:colon]
+
+	samples := []StatsdSample{}
+	for _, field := range strings.Split(line[colon+1:], ":") {
+		parts := strings.Split(field, "|")
+		if len(parts) < 2 {
+			return nil, fmt.Errorf("no type in %q", line)
+		}
+
+		s := StatsdSample{Name: name, Type: parts[1], Rate: 1}
+		switch s.Type {
+		case "c", "g", "ms", "h":
+			raw := parts[0]
+			s.Delta = s.Type == "g" && (strings.HasPrefix(raw, "+") || strings.HasPrefix(raw, "-"))
+			v, err := strconv.ParseFloat(raw, 64)
+			if err != nil {
+				return nil, fmt.Errorf("bad value in %q: %s", line, err)
+			}
+			s.Value = v
+		case "s":
+			s.Set = parts[0]
+		default:
+			return nil, fmt.Errorf("unknown type %q in %q", s.Type, line)
+		}
+
+		for _, extra := range parts[2:] {
+			switch {
+			case strings.HasPrefix(extra, "@"):
+				rate, err := strconv.ParseFloat(extra[1:], 64)
+				if err != nil || rate <= 0 || rate > 1 {
+					return nil, fmt.Errorf("bad sample rate in %q", line)
+				}
+				s.Rate = rate
+			case strings.HasPrefix(extra, "#"):
+				s.Tags = strings.Split(extra[1:], ",")
+			}
+		}
+		samples = append(samples, s)
+	}
+	return samples, nil
+}
+
+// statsdSeries accumulates samples for one metric name over a flush interval.
+type statsdSeries struct {
+	apikey  string
+	name    string
+	kind    string
+	tags    []string
+	count   float64
+	gauge   float64
+	updated bool
+	timings []float64
+	set     map[string]bool
+}
+
+// StatsdAggregator rolls StatsD samples up between flushes.
+type StatsdAggregator struct {
+	sync.Mutex
+	ApiKey string
+	series map[string]*statsdSeries
+}
+
+func NewStatsdAggregator(apikey string) *StatsdAggregator {
+	return &StatsdAggregator{ApiKey: apikey, series: map[string]*statsdSeries{}}
+}
+
+// Add records a sample, resolving its API key from the name if the
+// aggregator doesn't have one.
+func (a *StatsdAggregator) Add(s StatsdSample) error {
+	apikey, name := a.ApiKey, s.Name
+	if apikey == "" {
+		dot := strings.IndexByte(s.Name, '.')
+		if dot <= 0 || dot == len(s.Name)-1 {
+			return fmt.Errorf("no API key prefix on %q", s.Name)
+		}
+		apikey, name = s.Name[:dot], s.Name[dot+1:]
+	}
+	s.Name = name
+	a.AddFor(apikey, s)
+	return nil
+}
+
+// AddFor records a sample to be submitted with apikey.
+func (a *StatsdAggregator) AddFor(apikey string, s StatsdSample) {
+	name := s.Name
+	kind := s.Type
+	if kind == "h" {
+		kind = "ms"
+	}
+	key := apikey + "|" + kind + "|" + name
+
+	a.Lock()
+	defer a.Unlock()
+	series, ok := a.series[key]
+	if !ok {
+		series = &statsdSeries{apikey: apikey, name: name, kind: kind, set: map[string]bool{}}
+		a.series[key] = series
+	}
+	if s.Tags != nil {
+		series.tags = s.Tags
+	}
+	series.updated = true
+
+	switch kind {
+	case "c":
+		series.count += s.Value / s.Rate
+	case "g":
+		if s.Delta {
+			series.gauge += s.Value
+		} else {
+			series.gauge = s.Value
+		}
+	case "ms":
+		series.timings = append(series.timings, s.Value)
+		series.count += 1 / s.Rate
+	case "s":
+		series.set[s.Set] = true
+	}
+}
+
+// Flush returns metrics for everything received since the last flush, and
+// resets the aggregator. Gauges keep their value so later adjustments apply
+// to it, but are only emitted again once they're updated.
+func (a *StatsdAggregator) Flush(interval time.Duration) []Metric {
+	a.Lock()
+	defer a.Unlock()
+
+	metrics := []Metric{}
+	emit := func(s *statsdSeries, suffix string, value float64) {
+		check := s.name
+		if suffix != "" {
+			check += ": " + suffix
+		}
+		metrics = append(metrics, Metric{ApiKey: secret.New(s.apikey), Check: check, Metric: value, TTL: 400, Tags: s.tags})
+	}
+
+	for key, s := range a.series {
+		if !s.updated {
+			continue
+		}
+		switch s.kind {
+		case "c":
+			emit(s, "count", s.count)
+			emit(s, "rate", s.count/interval.Seconds())
+			delete(a.series, key)
+		case "g":
+			emit(s, "", s.gauge)
+			s.updated = false
+		case "ms":
+			sort.Float64s(s.timings)
+			sum := 0.0
+			for _, t := range s.timings {
+				sum += t
+			}
+			emit(s, "count", s.count)
+			emit(s, "mean", sum/float64(len(s.timings)))
+			emit(s, "min", s.timings[0])
+			emit(s, "max", s.timings[len(s.timings)-1])
+			emit(s, "p90", percentile(s.timings, 90))
+			delete(a.series, key)
+		case "s":
+			emit(s, "unique", float64(len(s.set)))
+			delete(a.series, key)
+		}
+	}
+	return metrics
+}
+
+// percentile returns the nearest-rank percentile p of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+// flushers tracks running FlushEvery loops, so shutdown can wait for their
+// final flushes.
+var flushers sync.WaitGroup
+
+// FlushEvery flushes an aggregator to metrics every interval, until ctx is
+// cancelled, when it flushes whatever was received since the last flush.
+// Callers must add it to flushers before starting it, so shutdown can't miss
+// it.
+func FlushEvery(ctx context.Context, aggregator *StatsdAggregator, interval time.Duration, metrics chan Metric) {
+	defer flushers.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			last = time.Now()
+			for _, m := range aggregator.Flush(interval) {
+				metrics <- m
+			}
+		case <-ctx.Done():
+			for _, m := range aggregator.Flush(time.Since(last)) {
+				metrics <- m
+			}
+			return
+		}
+	}
+}
+
+// ListenStatsd receives StatsD packets on a UDP address, and emits their
+// aggregates every flush interval. It returns once it's listening.
+func ListenStatsd(ctx context.Context, config Config, listener StatsdListener, metrics chan Metric) {
+	conn, err := net.ListenPacket("udp", listener.Bind)
+	if err != nil {
+		log.Fatalf("[error] ListenStatsd: couldn't listen on %s: %s\n", listener.Bind, err)
+	}
+	log.Printf("[info] ListenStatsd: listening on %s\n", conn.LocalAddr())
+	ServeStatsd(ctx, config, conn, NewStatsdAggregator(listener.ApiKey.Reveal()), metrics)
+}
+
+// ServeStatsd reads StatsD packets from conn into an aggregator in the
+// background, flushing it to metrics every config.StatsdFlush, and once more
+// when ctx is cancelled or reading fails.
+func ServeStatsd(ctx context.Context, config Config, conn net.PacketConn, aggregator *StatsdAggregator, metrics chan Metric) {
+	ctx, cancel := context.WithCancel(ctx)
+	flushers.Add(1)
+	go FlushEvery(ctx, aggregator, config.StatsdFlush, metrics)
+
+	go func() {
+		defer cancel()
+		buf := make([]byte, 65535)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				log.Printf("[error] ServeStatsd: read: %s\n", err)
+				return
+			}
+			for _, line := range strings.Split(string(buf[:n]), "\n") {
+				if strings.TrimSpace(line) == "" {
+					continue
+				}
+				samples, err := ParseStatsdLine(line)
+				if err != nil {
+					log.Printf("[error] ServeStatsd: %s\n", err)
+					continue
+				}
+				for _, s := range samples {
+					if err := aggregator.Add(s); err != nil {
+						log.Printf("[error] ServeStatsd: %s\n", err)
+					}
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseStatsdLine(t *testing.T) {
+	samples, err := ParseStatsdLine("abc.requests:1|c:3|c|@0.5|#web,eu")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if len(samples) != 2 {
+		t.Fatalf("Expected 2 samples, got %d\n", len(samples))
+	}
+	s := samples[1]
+	if s.Name != "abc.requests" || s.Value != 3 || s.Type != "c" || s.Rate != 0.5 || len(s.Tags) != 2 {
+		t.Errorf("Unexpected sample: %+v\n", s)
+	}
+
+	samples, _ = ParseStatsdLine("abc.temperature:-2|g")
+	if !samples[0].Delta || samples[0].Value != -2 {
+		t.Errorf("Expected gauge delta of -2, got %+v\n", samples[0])
+	}
+
+	for _, line := range []string{"nocolon", "abc.x:1", "abc.x:one|c", "abc.x:1|q", "abc.x:1|c|@2"} {
+		if _, err := ParseStatsdLine(line); err == nil {
+			t.Errorf("Expected error parsing %q\n", line)
+		}
+	}
+}
+
+func TestStatsdAggregator(t *testing.T) {
+	a := NewStatsdAggregator("")
+	lines := []string{
+		"abc.requests:1|c",
+		"abc.requests:1|c|@0.1",
+		"abc.temperature:20|g",
+		"abc.temperature:+5|g",
+		"abc.latency:10|ms",
+		"abc.latency:30|ms",
+		"abc.latency:20|ms",
+		"abc.users:alice|s",
+		"abc.users:bob|s",
+		"abc.users:alice|s",
+	}
+	for _, line := range lines {
+		samples, err := ParseStatsdLine(line)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %q: %s\n", line, err)
+		}
+		for _, s := range samples {
+			if err := a.Add(s); err != nil {
+				t.Fatalf("Unexpected error adding %q: %s\n", line, err)
+			}
+		}
+	}
+	if err := a.Add(StatsdSample{Name: "noprefix", Type: "c", Rate: 1}); err == nil {
+		t.Errorf("Expected error adding sample without API key prefix\n")
+	}
+
+	results := map[string]float64{}
+	for _, m := range a.Flush(10 * time.Second) {
+		if m.ApiKey.Reveal() != "abc" {
+			t.Errorf("Expected API key abc, got %+v\n", m)
+		}
+		results[m.Check] = m.Metric
+	}
+	expected := map[string]float64{
+		"requests: count": 11,
+		"requests: rate":  1.1,
+		"temperature":     25,
+		"latency: count":  3,
+		"latency: mean":   20,
+		"latency: min":    10,
+		"latency: max":    30,
+		"latency: p90":    30,
+		"users: unique":   2,
+	}
+	for name, value := range expected {
+		if results[name] != value {
+			t.Errorf("Expected %s to be %f, got %f\n", name, value, results[name])
+		}
+	}
+
+	if flushed := a.Flush(10 * time.Second); len(flushed) != 0 {
+		t.Errorf("Expected nothing to flush without new samples, got %+v\n", flushed)
+	}
+	samples, _ := ParseStatsdLine("abc.temperature:-10|g")
+	a.Add(samples[0])
+	flushed := a.Flush(10 * time.Second)
+	if len(flushed) != 1 || flushed[0].Metric != 15 {
+		t.Errorf("Expected gauge adjustment to 15, got %+v\n", flushed)
+	}
+}
+
+func TestServeStatsd(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %s\n", err)
+	}
+	defer conn.Close()
+
+	config := Config{StatsdFlush: 10 * time.Millisecond}
+	metrics := make(chan Metric, 10)
+	ServeStatsd(context.Background(), config, conn, NewStatsdAggregator("def"), metrics)
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Couldn't dial: %s\n", err)
+	}
+	client.Write([]byte("queue.depth:42|g\nbogus\n"))
+
+	select {
+	case m := <-metrics:
+		if m.ApiKey.Reveal() != "def" || m.Check != "queue.depth" || m.Metric != 42 {
+			t.Errorf("Unexpected metric: %+v\n", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected StatsD gauge to be flushed, got nothing after 1 second.")
+	}
+}
+
+func TestParseStatsdListener(t *testing.T) {
+	os.Setenv("STATSD_TEST_APIKEY", "ff6d177b")
+	defer os.Unsetenv("STATSD_TEST_APIKEY")
+
+	l, err := ParseStatsdListener(":8126=STATSD_TEST_APIKEY")
+	if err != nil || l.Bind != ":8126" || l.ApiKey.Reveal() != "ff6d177b" {
+		t.Errorf("Expected the API key to be loaded, got %+v and %v\n", l, err)
+	}
+	if printed := fmt.Sprintf("%+v", l); strings.Contains(printed, "ff6d177b") {
+		t.Errorf("Expected the API key to be redacted, got %s\n", printed)
+	}
+
+	if l, err := ParseStatsdListener(":8125"); err != nil || !l.ApiKey.IsZero() {
+		t.Errorf("Expected no API key, got %+v and %v\n", l, err)
+	}
+	// API keys themselves aren't accepted, or repeated in the error.
+	if _, err := ParseStatsdListener(":8126=ff6d177b"); err == nil || strings.Contains(err.Error(), "ff6d177b") {
+		t.Errorf("Expected an error without the API key, got %v\n", err)
+	}
+	if _, err := ParseStatsdListener(":8126=STATSD_MISSING_APIKEY"); err == nil {
+		t.Errorf("Expected an error for a missing secret\n")
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/radalert/layer4/secret"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyslogMessage is a parsed RFC 5424 or RFC 3164 syslog message.
+type SyslogMessage struct {
+	Priority int
+	Hostname string
+	AppName  string
+	ProcID   string
+	// Params holds structured data parameters, followed by any key=value
+	// pairs in the message itself.
+	Params  [][2]string
+	Message string
+}
+
+// ParseSyslog parses a syslog message in either RFC 5424 or RFC 3164 format.
+func ParseSyslog(line string) (SyslogMessage, error) {
+	m := SyslogMessage{}
+	line = strings.TrimRight(line, "\r\n\x00")
+	if !strings.HasPrefix(line, "<") {
+		return m, fmt.Errorf("no priority in %q", line)
+	}
+	end := strings.IndexByte(line, '>')
+	if end < 2 || end > 4 {
+		return m, fmt.Errorf("bad priority in %q", line)
+	}
+	pri, err := strconv.Atoi(line[1:end])
+	if err != nil || pri > 191 {
+		return m, fmt.Errorf("bad priority in %q", line)
+	}
+	m.Priority = pri
+	rest := line[end+1:]
+
+	if strings.HasPrefix(rest, "1 ") {
+		err = parseSyslog5424(&m, rest[2:])
+	} else {
+		err = parseSyslog3164(&m, rest)
+	}
+	if err != nil {
+		return m, fmt.Errorf("%s in %q", err, line)
+	}
+	m.Params = append(m.Params, ParseKeyValues(m.Message)...)
+	return m, nil
+}
+
+// nextField splits off the next space separated field.
+func nextField(s string) (string, string) {
+	s = strings.TrimLeft(s, " ")
+	space := strings.IndexByte(s, ' ')
+	if space < 0 {
+		return s, ""
+	}
+	return s[:space], s[space+1:]
+}
+
+func nilValue(s string) string {
+	if s == "-" {
+		return ""
+	}
+	return s
+}
+
+func parseSyslog5424(m *SyslogMessage, rest string) error {
+	fields := make([]string, 5)
+	for i := range fields {
+		fields[i], rest = nextField(rest)
+	}
+	if fields[4] == "" {
+		return fmt.Errorf("truncated header")
+	}
+	m.Hostname = nilValue(fields[1])
+	m.AppName = nilValue(fields[2])
+	m.ProcID = nilValue(fields[3])
+
+	rest = strings.TrimLeft(rest, " ")
+	if strings.HasPrefix(rest, "-") {
+		rest = rest[1:]
+	} else {
+		for strings.HasPrefix(rest, "[") {
+			params, remaining, err := parseStructuredData(rest[1:])
+			if err != nil {
+				return err
+			}
+			m.Params = append(m.Params, params...)
+			rest = remaining
+		}
+	}
+	m.Message = strings.TrimPrefix(strings.TrimLeft(rest, " "), "\xef\xbb\xbf")
+	return nil
+}
+
+// parseStructuredData parses an SD-ELEMENT after its opening bracket, e.g.
+// `origin ip="10.0.0.1" software="nginx"]`.
+func parseStructuredData(s string) ([][2]string, string, error) {
+	params := [][2]string{}
+	_, s = nextFieldUntil(s, " ]")
+	for {
+		s = strings.TrimLeft(s, " ")
+		if strings.HasPrefix(s, "]") {
+			return params, s[1:], nil
+		}
+		eq := strings.Index(s, `="`)
+		if eq <= 0 {
+			return nil, "", fmt.Errorf("malformed structured data")
+		}
+		name := s[:eq]
+		s = s[eq+2:]
+
+		value := []byte{}
+		closed := false
+		for i := 0; i < len(s); i++ {
+			if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(`"\]`, s[i+1]) >= 0 {
+				i++
+				value = append(value, s[i])
+				continue
+			}
+			if s[i] == '"' {
+				s = s[i+1:]
+				closed = true
+				break
+			}
+			value = append(value, s[i])
+		}
+		if !closed {
+			return nil, "", fmt.Errorf("unterminated structured data")
+		}
+		params = append(params, [2]string{name, string(value)})
+	}
+}
+
+// nextFieldUntil splits s at the first of any of the bytes in stop.
+func nextFieldUntil(s string, stop string) (string, string) {
+	i := strings.IndexAny(s, stop)
+	if i < 0 {
+		return s, ""
+	}
+	return s[:i], s[i:]
+}
+
+func parseSyslog3164(m *SyslogMessage, rest string) error {
+	// "Mmm dd hh:mm:ss " is optional in practice, but usually there.
+	if len(rest) > 16 && rest[3] == ' ' && rest[6] == ' ' && rest[9] == ':' && rest[12] == ':' {
+		rest = rest[16:]
+	}
+	host, remaining := nextField(rest)
+	if strings.HasSuffix(host, ":") || strings.IndexByte(host, '[') >= 0 {
+		// No hostname, just a tag.
+		remaining = rest
+	} else {
+		m.Hostname = host
+	}
+
+	tag, message := nextFieldUntil(strings.TrimLeft(remaining, " "), ":[ ")
+	m.AppName = tag
+	if strings.HasPrefix(message, "[") {
+		end := strings.IndexByte(message, ']')
+		if end > 0 {
+			m.ProcID = message[1:end]
+			message = message[end+1:]
+		}
+	}
+	m.Message = strings.TrimLeft(strings.TrimPrefix(message, ":"), " ")
+	return nil
+}
+
+// ParseKeyValues extracts key=value pairs from a log message, where values
+// may be double quoted, e.g. `at=info path="/" service=123ms status=200`.
+func ParseKeyValues(message string) [][2]string {
+	pairs := [][2]string{}
+	s := message
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " \t")
+		eq := strings.IndexByte(s, '=')
+		space := strings.IndexAny(s, " \t")
+		if eq <= 0 || (space >= 0 && space < eq) {
+			_, s = nextFieldUntil(s, " \t")
+			continue
+		}
+		key := s[:eq]
+		s = s[eq+1:]
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.IndexByte(s[1:], '"')
+			if end < 0 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end+1], s[end+2:]
+			}
+		} else {
+			value, s = nextFieldUntil(s, " \t")
+		}
+		pairs = append(pairs, [2]string{key, value})
+	}
+	return pairs
+}
+
+// parseMilliseconds parses a number with a unit of time into milliseconds.
+func parseMilliseconds(value string) (float64, bool) {
+	units := []struct {
+		suffix string
+		scale  float64
+	}{{"ms", 1}, {"us", 0.001}, {"µs", 0.001}, {"s", 1000}}
+	for _, u := range units {
+		if strings.HasSuffix(value, u.suffix) {
+			v, err := strconv.ParseFloat(strings.TrimSuffix(value, u.suffix), 64)
+			if err != nil {
+				return 0, false
+			}
+			return v * u.scale, true
+		}
+	}
+	return 0, false
+}
+
+// trimUnit strips a unit like "MB" from the end of a number.
+func trimUnit(value string) (float64, error) {
+	end := len(value)
+	for end > 0 && strings.IndexByte("0123456789.", value[end-1]) < 0 {
+		end--
+	}
+	return strconv.ParseFloat(value[:end], 64)
+}
+
+// SyslogSamples turns a message's parameters into samples to aggregate:
+//
+//   - l2met style count#name=N, measure#name=N and sample#name=N become
+//     counters, timers and gauges
+//   - values with a unit of time, like service=123ms, become timers
+//   - status=NNN counts responses by class, e.g. "status 5xx"
+//   - at and code are counted by value, e.g. "code H12"
+func SyslogSamples(m SyslogMessage) []StatsdSample {
+	prefix := m.AppName
+	if prefix == "" {
+		prefix = "syslog"
+	}
+	samples := []StatsdSample{}
+	add := func(name string, kind string, value float64) {
+		samples = append(samples, StatsdSample{Name: prefix + ": " + name, Type: kind, Value: value, Rate: 1})
+	}
+
+	for _, kv := range m.Params {
+		key, value := kv[0], kv[1]
+		switch {
+		case strings.HasPrefix(key, "count#"):
+			if v, err := trimUnit(value); err == nil {
+				add(key[6:], "c", v)
+			}
+		case strings.HasPrefix(key, "measure#"):
+			if ms, ok := parseMilliseconds(value); ok {
+				add(key[8:], "ms", ms)
+			} else if v, err := trimUnit(value); err == nil {
+				add(key[8:], "ms", v)
+			}
+		case strings.HasPrefix(key, "sample#"):
+			if v, err := trimUnit(value); err == nil {
+				add(key[7:], "g", v)
+			}
+		case key == "status" && len(value) == 3:
+			if _, err := strconv.Atoi(value); err == nil {
+				add("status "+value[:1]+"xx", "c", 1)
+			}
+		case key == "at" || key == "code":
+			add(key+" "+value, "c", 1)
+		default:
+			if ms, ok := parseMilliseconds(value); ok {
+				add(key, "ms", ms)
+			}
+		}
+	}
+	return samples
+}
+
+// SyslogReceiver aggregates metrics from syslog messages. The hostname of
+// each message (the drain token, for Heroku log drains) is looked up in
+// Drains to find the API key to submit its metrics with.
+type SyslogReceiver struct {
+	Drains     map[string]secret.Secret
+	Aggregator *StatsdAggregator
+
+	mutex      sync.Mutex
+	unknown    int
+	lastLogged time.Time
+}
+
+// Receive parses a syslog message and aggregates its metrics.
+func (s *SyslogReceiver) Receive(line string) {
+	m, err := ParseSyslog(line)
+	if err != nil {
+		log.Printf("[error] SyslogReceiver: %s\n", err)
+		return
+	}
+	apikey, ok := s.Drains[m.Hostname]
+	if !ok {
+		s.mutex.Lock()
+		s.unknown++
+		if time.Since(s.lastLogged) > time.Second*10 {
+			s.lastLogged = time.Now()
+			log.Printf("[info] SyslogReceiver: no API key for drain %q (%d unknown messages so far)\n", m.Hostname, s.unknown)
+		}
+		s.mutex.Unlock()
+		return
+	}
+	for _, sample := range SyslogSamples(m) {
+		s.Aggregator.AddFor(apikey.Reveal(), sample)
+	}
+}
+
+// ServeStream reads syslog messages from a TCP stream, framed either by octet
+// counting (RFC 6587, as Heroku sends) or by newlines.
+func (s *SyslogReceiver) ServeStream(conn io.Reader) {
+	reader := bufio.NewReader(conn)
+	for {
+		b, err := reader.Peek(1)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("[error] SyslogReceiver: read: %s\n", err)
+			}
+			return
+		}
+
+		if b[0] >= '0' && b[0] <= '9' {
+			prefix, err := reader.ReadString(' ')
+			if err != nil {
+				log.Printf("[error] SyslogReceiver: read: %s\n", err)
+				return
+			}
+			length, err := strconv.Atoi(strings.TrimSpace(prefix))
+			if err != nil || length <= 0 || length > 1<<20 {
+				log.Printf("[error] SyslogReceiver: bad frame length %q\n", prefix)
+				return
+			}
+			frame := make([]byte, length)
+			_, err = io.ReadFull(reader, frame)
+			if err != nil {
+				log.Printf("[error] SyslogReceiver: read: %s\n", err)
+				return
+			}
+			s.Receive(string(frame))
+			continue
+		}
+
+		line, err := reader.ReadString('\n')
+		if strings.TrimSpace(line) != "" {
+			s.Receive(line)
+		}
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("[error] SyslogReceiver: read: %s\n", err)
+			}
+			return
+		}
+	}
+}
+
+// ServePackets reads a syslog message from each UDP packet.
+func (s *SyslogReceiver) ServePackets(conn net.PacketConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("[error] SyslogReceiver: read: %s\n", err)
+			return
+		}
+		s.Receive(string(buf[:n]))
+	}
+}
+
+// ListenSyslog receives syslog over both UDP and TCP on bind, and emits the
+// aggregated metrics every config.SyslogFlush. It returns once it's
+// listening.
+func ListenSyslog(ctx context.Context, config Config, metrics chan Metric) {
+	receiver := &SyslogReceiver{Drains: config.SyslogDrains, Aggregator: NewStatsdAggregator("")}
+	flushers.Add(1)
+	go FlushEvery(ctx, receiver.Aggregator, config.SyslogFlush, metrics)
+
+	packets, err := net.ListenPacket("udp", config.Syslog)
+	if err != nil {
+		log.Fatalf("[error] ListenSyslog: couldn't listen on %s: %s\n", config.Syslog, err)
+	}
+	go receiver.ServePackets(packets)
+
+	log.Printf("[info] ListenSyslog: listening on %s\n", config.Syslog)
+	go ListenTCP(config.Syslog, receiver.ServeStream)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"github.com/radalert/layer4/secret"
+	"strings"
+	"testing"
+	"time"
+)
+
+const herokuRouter = `<158>1 2015-06-22T11:29:44.000000+00:00 d.9a8b7c6d-1234 heroku router - at=info method=GET path="/api/checks" host=radalert.io request_id=abc fwd="1.2.3.4" dyno=web.1 connect=1ms service=123ms status=503 bytes=512`
+
+func TestParseSyslog5424(t *testing.T) {
+	m, err := ParseSyslog(`<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Application \"X\""][meta load="0.5s"] request took=12ms`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if m.Priority != 165 || m.Hostname != "mymachine.example.com" || m.AppName != "evntslog" || m.ProcID != "" {
+		t.Errorf("Unexpected header: %+v\n", m)
+	}
+	expected := [][2]string{{"iut", "3"}, {"eventSource", `Application "X"`}, {"load", "0.5s"}, {"took", "12ms"}}
+	if fmt.Sprint(m.Params) != fmt.Sprint(expected) {
+		t.Errorf("Expected params %v, got %v\n", expected, m.Params)
+	}
+	if m.Message != "request took=12ms" {
+		t.Errorf("Unexpected message %q\n", m.Message)
+	}
+}
+
+func TestParseSyslog3164(t *testing.T) {
+	m, err := ParseSyslog(`<34>Oct 11 22:14:15 mymachine su[123]: 'su root' failed service=5ms`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if m.Hostname != "mymachine" || m.AppName != "su" || m.ProcID != "123" || m.Message != "'su root' failed service=5ms" {
+		t.Errorf("Unexpected message: %+v\n", m)
+	}
+
+	m, err = ParseSyslog(`<13>haproxy: backend down`)
+	if err != nil || m.Hostname != "" || m.AppName != "haproxy" || m.Message != "backend down" {
+		t.Errorf("Unexpected message without timestamp or hostname: %+v, %v\n", m, err)
+	}
+
+	for _, line := range []string{"no priority", "<999>1 x", "<1>1 2015-06-22T11:29:44Z host"} {
+		if _, err := ParseSyslog(line); err == nil {
+			t.Errorf("Expected error parsing %q\n", line)
+		}
+	}
+}
+
+func TestSyslogStream(t *testing.T) {
+	receiver := &SyslogReceiver{
+		Drains:     map[string]secret.Secret{"d.9a8b7c6d-1234": secret.New("def")},
+		Aggregator: NewStatsdAggregator(""),
+	}
+
+	l2met := `<13>1 2015-06-22T11:29:44+00:00 d.9a8b7c6d-1234 app web.1 - count#signups=2 measure#db.query=0.5s sample#memory_total=512.5MB`
+	unknown := `<13>1 2015-06-22T11:29:44+00:00 d.unknown app web.1 - count#signups=100`
+	stream := ""
+	for _, line := range []string{herokuRouter, herokuRouter, l2met, unknown} {
+		stream += fmt.Sprintf("%d %s", len(line), line)
+	}
+	stream += "<13>Oct 11 22:14:15 d.9a8b7c6d-1234 app: newline framed count#signups=1\n"
+	receiver.ServeStream(strings.NewReader(stream))
+
+	results := map[string]float64{}
+	for _, m := range receiver.Aggregator.Flush(time.Second) {
+		if m.ApiKey.Reveal() != "def" {
+			t.Errorf("Expected API key from drain token, got %+v\n", m)
+		}
+		results[m.Check] = m.Metric
+	}
+
+	expected := map[string]float64{
+		"heroku: service: mean":     123,
+		"heroku: connect: count":    2,
+		"heroku: status 5xx: count": 2,
+		"heroku: at info: count":    2,
+		"app: signups: count":       3,
+		"app: db.query: mean":       500,
+		"app: memory_total":         512.5,
+	}
+	for name, value := range expected {
+		if results[name] != value {
+			t.Errorf("Expected %s to be %f, got %+v\n", name, value, results)
+		}
+	}
+	for _, name := range []string{"heroku: method: count", "heroku: bytes: count", "heroku: request_id: count"} {
+		if _, ok := results[name]; ok {
+			t.Errorf("Expected no %s metric, got %+v\n", name, results)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// LogPattern is a regular expression to count matching log lines with. If it
+// has a capture group, the first group (or one named "value") is parsed as a
+// number, and the mean and percentiles of those numbers are emitted too.
+type LogPattern struct {
+	Regexp string `json:"regexp"`
+	Metric string `json:"metric"`
+}
+
+// logPosition is where tailing a file got up to.
+type logPosition struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// logTail is an open file being tailed. offset is how far through the file
+// complete lines have been read, and leftover is any partial line after it.
+type logTail struct {
+	file     *os.File
+	inode    uint64
+	offset   int64
+	leftover []byte
+}
+
+// LogTailers tracks every file being tailed, and saves how far through each
+// file nudger has read to StateFile, so a restart picks up where it left off.
+// Files are tailed separately for each check, keyed by logTailKey, so checks
+// on the same file each see every line.
+var LogTailers = struct {
+	sync.Mutex
+	StateFile string
+	tails     map[string]*logTail
+	saved     map[string]logPosition
+}{tails: map[string]*logTail{}}
+
+// loadLogPositions reads saved positions from the state file, if there is one.
+// Callers must hold the LogTailers lock.
+func loadLogPositions() {
+	if LogTailers.saved != nil {
+		return
+	}
+	LogTailers.saved = map[string]logPosition{}
+	if LogTailers.StateFile == "" {
+		return
+	}
+	body, err := ioutil.ReadFile(LogTailers.StateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[error] loadLogPositions: %s\n", err)
+		}
+		return
+	}
+	err = json.Unmarshal(body, &LogTailers.saved)
+	if err != nil {
+		log.Printf("[error] loadLogPositions: couldn't decode %s: %s\n", LogTailers.StateFile, err)
+	}
+}
+
+// saveLogPositions writes positions to the state file. Callers must hold the
+// LogTailers lock.
+func saveLogPositions() {
+	if LogTailers.StateFile == "" {
+		return
+	}
+	for key, tail := range LogTailers.tails {
+		LogTailers.saved[key] = logPosition{Inode: tail.inode, Offset: tail.offset}
+	}
+	body, err := json.Marshal(LogTailers.saved)
+	if err != nil {
+		log.Printf("[error] saveLogPositions: %s\n", err)
+		return
+	}
+	tmp := LogTailers.StateFile + ".tmp"
+	err = ioutil.WriteFile(tmp, body, 0644)
+	if err == nil {
+		err = os.Rename(tmp, LogTailers.StateFile)
+	}
+	if err != nil {
+		log.Printf("[error] saveLogPositions: %s\n", err)
+	}
+}
+
+// openTail opens path, starting from a saved position if it's for the same
+// file, from the start if the file has been replaced, and otherwise from the
+// end so history isn't counted as new.
+func openTail(path string, saved logPosition, hasSaved bool) (*logTail, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	tail := &logTail{file: file, inode: inode(info)}
+	switch {
+	case !hasSaved:
+		tail.offset = info.Size()
+	case saved.Inode == tail.inode && saved.Offset <= info.Size():
+		tail.offset = saved.Offset
+	}
+	_, err = file.Seek(tail.offset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return tail, nil
+}
+
+// maxLogRead is the most read from a file in one go, so a runaway log can't
+// use up memory. Anything more is left in the file for the next poll.
+var maxLogRead int64 = 16 << 20
+
+// readLines returns the complete lines appended to the file since the last
+// read, up to maxLogRead of them, keeping any partial line for next time. It
+// also returns whether there's more to read.
+func (t *logTail) readLines() ([][]byte, bool, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(t.file, maxLogRead))
+	if err != nil {
+		return nil, false, err
+	}
+	more := int64(len(data)) == maxLogRead
+	data = append(t.leftover, data...)
+	end := bytes.LastIndexByte(data, '\n')
+	if end < 0 {
+		if int64(len(data)) >= maxLogRead {
+			// A line this long is dropped, rather than kept whole.
+			log.Printf("[warn] ReadLog: dropping %d bytes without a newline\n", len(data))
+			t.offset += int64(len(data))
+			t.leftover = nil
+			return nil, more, nil
+		}
+		t.leftover = data
+		return nil, more, nil
+	}
+	t.leftover = append([]byte{}, data[end+1:]...)
+	t.offset += int64(end + 1)
+	return bytes.Split(data[:end], []byte("\n")), more, nil
+}
+
+// logTailKey is what a check's tail of its file is kept under: the check's
+// ID, or else its Key, and the file.
+func logTailKey(check Check) string {
+	id := check.ID
+	if id == "" {
+		id = check.Key()
+	}
+	return id + " " + check.File
+}
+
+// ReadLog returns the lines written to path since they were last read for
+// key, following the file across rotation (a new file at path) and
+// truncation.
+func ReadLog(key string, path string) ([][]byte, error) {
+	LogTailers.Lock()
+	defer LogTailers.Unlock()
+	loadLogPositions()
+	defer saveLogPositions()
+
+	tail, ok := LogTailers.tails[key]
+	if !ok {
+		saved, hasSaved := LogTailers.saved[key]
+		if !hasSaved {
+			// Positions used to be saved by path alone.
+			saved, hasSaved = LogTailers.saved[path]
+		}
+		var err error
+		tail, err = openTail(path, saved, hasSaved)
+		if err != nil {
+			return nil, err
+		}
+		LogTailers.tails[key] = tail
+	}
+
+	// Finish reading the file we have open, even if it's been rotated away.
+	lines, more, err := tail.readLines()
+	if err != nil || more {
+		return lines, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		// Rotated, and the new file isn't there yet.
+		return lines, nil
+	}
+	switch {
+	case inode(info) != tail.inode:
+		log.Printf("[info] ReadLog: %s was rotated\n", path)
+		tail.file.Close()
+		delete(LogTailers.tails, key)
+		next, err := openTail(path, logPosition{}, true)
+		if err != nil {
+			return lines, err
+		}
+		LogTailers.tails[key] = next
+		rest, _, err := next.readLines()
+		return append(lines, rest...), err
+	case info.Size() < tail.offset:
+		log.Printf("[info] ReadLog: %s was truncated\n", path)
+		tail.offset, tail.leftover = 0, nil
+		_, err = tail.file.Seek(0, io.SeekStart)
+		if err != nil {
+			return lines, err
+		}
+		rest, _, err := tail.readLines()
+		return append(lines, rest...), err
+	}
+	return lines, nil
+}
+
+// PruneLogTails closes the files tailed for checks that aren't in checks, and
+// forgets their positions, e.g. after a check is deleted or changed.
+func PruneLogTails(checks []Check) {
+	keys := map[string]bool{}
+	for _, check := range checks {
+		if check.Type == "log" {
+			keys[logTailKey(check)] = true
+		}
+	}
+	LogTailers.Lock()
+	defer LogTailers.Unlock()
+	for key, tail := range LogTailers.tails {
+		if !keys[key] {
+			tail.file.Close()
+			delete(LogTailers.tails, key)
+			delete(LogTailers.saved, key)
+		}
+	}
+}
+
+// PollLog reads the lines written to a check's file since the last poll, and
+// for each pattern emits how many lines matched, along with the mean and
+// percentiles of any numbers it captured.
+func PollLog(ctx context.Context, check Check, metrics chan Metric) {
+	emit := func(name string, value float64) {
+		metrics <- Metric{
+			ApiKey: check.ApiKey,
+			Check:  name,
+			Metric: value,
+			TTL:    400,
+			Tags:   check.Tags,
+		}
+	}
+
+	patterns := []*regexp.Regexp{}
+	for _, p := range check.Patterns {
+		re, err := regexp.Compile(p.Regexp)
+		if err != nil {
+			Logf(ctx, "[error] PollLog: %s: bad pattern %q: %s\n", check.File, p.Regexp, err)
+			return
+		}
+		patterns = append(patterns, re)
+	}
+
+	lines, err := ReadLog(logTailKey(check), check.File)
+	if err != nil {
+		Logf(ctx, "[error] PollLog: %s: %s\n", check.File, err)
+		if len(lines) == 0 {
+			return
+		}
+	}
+
+	for i, re := range patterns {
+		group := 1
+		if named := re.SubexpIndex("value"); named > 0 {
+			group = named
+		}
+
+		count := 0
+		values := []float64{}
+		for _, line := range lines {
+			match := re.FindSubmatch(line)
+			if match == nil {
+				continue
+			}
+			count++
+			if re.NumSubexp() >= group {
+				v, err := strconv.ParseFloat(string(match[group]), 64)
+				if err != nil {
+					Logf(ctx, "[error] PollLog: %s: captured %q isn't a number\n", check.File, match[group])
+					continue
+				}
+				values = append(values, v)
+			}
+		}
+
+		name := check.Patterns[i].Metric
+		emit(name+": count", float64(count))
+		if len(values) == 0 {
+			continue
+		}
+		sort.Float64s(values)
+		sum := 0.0
+		for _, v := range values {
+			sum += v
+		}
+		emit(name+": mean", sum/float64(len(values)))
+		for _, p := range []float64{50, 90, 99} {
+			emit(fmt.Sprintf("%s: p%g", name, p), percentile(values, p))
+		}
+	}
+}
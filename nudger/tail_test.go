@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func appendFile(t *testing.T, path string, text string) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("Couldn't open %s: %s\n", path, err)
+	}
+	defer f.Close()
+	f.WriteString(text)
+}
+
+// resetLogTailers forgets open files, as if nudger had restarted.
+func resetLogTailers(stateFile string) {
+	LogTailers.Lock()
+	defer LogTailers.Unlock()
+	for _, tail := range LogTailers.tails {
+		tail.file.Close()
+	}
+	LogTailers.tails = map[string]*logTail{}
+	LogTailers.saved = nil
+	LogTailers.StateFile = stateFile
+}
+
+func TestPollLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nudger")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+	defer resetLogTailers("")
+	resetLogTailers(filepath.Join(dir, "positions.json"))
+
+	path := filepath.Join(dir, "access.log")
+	appendFile(t, path, "GET / 502 100ms\n")
+
+	check := Check{
+		Type: "log",
+		File: path,
+		Patterns: []LogPattern{
+			LogPattern{Regexp: ` 502 `, Metric: "nginx: 502s"},
+			LogPattern{Regexp: ` (?P<value>\d+)ms$`, Metric: "nginx: request time"},
+		},
+	}
+	metrics := make(chan Metric, 20)
+
+	// History before the first poll isn't counted.
+	Poll(context.Background(), check, metrics)
+	if results := collect(metrics); results["nginx: 502s: count"] != 0 || len(results) != 2 {
+		t.Errorf("Expected zero counts on first poll, got %+v\n", results)
+	}
+
+	appendFile(t, path, "GET / 502 10ms\nGET / 200 20ms\nGET / 502 30ms\nGET / 200 4")
+	Poll(context.Background(), check, metrics)
+	results := collect(metrics)
+	expected := map[string]float64{
+		"nginx: 502s: count":         2,
+		"nginx: request time: count": 3,
+		"nginx: request time: mean":  20,
+		"nginx: request time: p50":   20,
+		"nginx: request time: p99":   30,
+	}
+	for name, value := range expected {
+		if results[name] != value {
+			t.Errorf("Expected %s to be %f, got %+v\n", name, value, results)
+		}
+	}
+
+	// The partial line is finished after a restart.
+	resetLogTailers(filepath.Join(dir, "positions.json"))
+	appendFile(t, path, "0ms\n")
+	Poll(context.Background(), check, metrics)
+	if results := collect(metrics); results["nginx: request time: mean"] != 40 {
+		t.Errorf("Expected partial line to be read after restart, got %+v\n", results)
+	}
+
+	// Truncation
+	os.Truncate(path, 0)
+	appendFile(t, path, "GET / 502 1ms\n")
+	Poll(context.Background(), check, metrics)
+	if results := collect(metrics); results["nginx: 502s: count"] != 1 {
+		t.Errorf("Expected to read truncated file from the start, got %+v\n", results)
+	}
+
+	// Rotation, with a line written to the old file before it's replaced.
+	appendFile(t, path, "GET / 502 1ms\n")
+	os.Rename(path, path+".1")
+	appendFile(t, path, "GET / 502 1ms\nGET / 502 1ms\n")
+	Poll(context.Background(), check, metrics)
+	if results := collect(metrics); results["nginx: 502s: count"] != 3 {
+		t.Errorf("Expected to finish rotated file and read the new one, got %+v\n", results)
+	}
+}
+
+func TestPollLogSameFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nudger")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+	defer resetLogTailers("")
+	resetLogTailers("")
+
+	path := filepath.Join(dir, "access.log")
+	appendFile(t, path, "")
+	errors := Check{ID: "errors", Type: "log", File: path, Patterns: []LogPattern{LogPattern{Regexp: ` 502 `, Metric: "nginx: 502s"}}}
+	requests := Check{ID: "requests", Type: "log", File: path, Patterns: []LogPattern{LogPattern{Regexp: `^GET `, Metric: "nginx: requests"}}}
+	metrics := make(chan Metric, 20)
+	PollCycle(context.Background(), []Check{errors, requests}, metrics)
+	collect(metrics)
+
+	// Each check sees every line, however the polls interleave.
+	appendFile(t, path, "GET / 502 10ms\nGET / 200 20ms\nGET / 502 30ms\n")
+	PollCycle(context.Background(), []Check{errors, requests}, metrics)
+	if results := collect(metrics); results["nginx: 502s: count"] != 2 || results["nginx: requests: count"] != 3 {
+		t.Errorf("Expected both checks to read the whole file, got %+v\n", results)
+	}
+
+	// Tails for checks that are gone are closed.
+	PollCycle(context.Background(), []Check{requests}, metrics)
+	collect(metrics)
+	LogTailers.Lock()
+	_, ok := LogTailers.tails[logTailKey(errors)]
+	LogTailers.Unlock()
+	if ok {
+		t.Errorf("Expected the deleted check's tail to be closed\n")
+	}
+}
+
+func TestPollLogLimitsReads(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nudger")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+	defer resetLogTailers("")
+	resetLogTailers("")
+	defer func(max int64) { maxLogRead = max }(maxLogRead)
+	maxLogRead = 32
+
+	path := filepath.Join(dir, "access.log")
+	appendFile(t, path, "")
+	check := Check{Type: "log", File: path, Patterns: []LogPattern{LogPattern{Regexp: `^GET `, Metric: "requests"}}}
+	metrics := make(chan Metric, 20)
+	Poll(context.Background(), check, metrics)
+	collect(metrics)
+
+	// Ten lines of ten bytes are read 32 bytes at a time, so over four polls.
+	for i := 0; i < 10; i++ {
+		appendFile(t, path, "GET / 200\n")
+	}
+	counts := []float64{}
+	for i := 0; i < 5; i++ {
+		Poll(context.Background(), check, metrics)
+		counts = append(counts, collect(metrics)["requests: count"])
+	}
+	total := 0.0
+	for _, c := range counts {
+		if c > 3 {
+			t.Errorf("Expected at most 3 lines a poll, got %v\n", counts)
+		}
+		total += c
+	}
+	if total != 10 {
+		t.Errorf("Expected every line to be read eventually, got %v\n", counts)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// addressMetric builds a metric for a check that targets a host:port address.
+func addressMetric(check Check, name string, value float64) Metric {
+	return Metric{
+		ApiKey: check.ApiKey,
+		Check:  check.Address + ": " + name,
+		Metric: value,
+		TTL:    400,
+		Tags:   check.Tags,
+	}
+}
+
+// PollTCP opens a TCP connection to a check's address, and emits how long
+// connecting took in milliseconds.
+func PollTCP(ctx context.Context, check Check, metrics chan Metric) {
+	start := time.Now()
+	dialer := net.Dialer{Timeout: time.Second * 5}
+	conn, err := dialer.DialContext(ctx, "tcp", check.Address)
+	if err != nil {
+		Logf(ctx, "[error] PollTCP: %s: dial: %s\n", check.Address, err)
+		return
+	}
+	elapsed := time.Since(start)
+	conn.Close()
+
+	metrics <- addressMetric(check, "connect time", float64(elapsed)/float64(time.Millisecond))
+}
+
+// PollTLS connects to a check's address and performs a TLS handshake. It emits
+// the connect and handshake times in milliseconds, and the number of days
+// until the presented chain expires, i.e. until whichever certificate in it
+// expires soonest.
+//
+// The chain isn't verified before measuring expiry, so a certificate that has
+// already expired is reported with negative days rather than as an error.
+func PollTLS(ctx context.Context, check Check, metrics chan Metric) {
+	host, _, err := net.SplitHostPort(check.Address)
+	if err != nil {
+		Logf(ctx, "[error] PollTLS: %s: bad address: %s\n", check.Address, err)
+		return
+	}
+
+	start := time.Now()
+	dialer := net.Dialer{Timeout: time.Second * 5}
+	conn, err := dialer.DialContext(ctx, "tcp", check.Address)
+	if err != nil {
+		Logf(ctx, "[error] PollTLS: %s: dial: %s\n", check.Address, err)
+		return
+	}
+	defer conn.Close()
+	connected := time.Now()
+
+	client := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true})
+	client.SetDeadline(connected.Add(time.Second * 5))
+	err = client.HandshakeContext(ctx)
+	if err != nil {
+		Logf(ctx, "[error] PollTLS: %s: handshake: %s\n", check.Address, err)
+		return
+	}
+	handshaked := time.Now()
+
+	certs := client.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		Logf(ctx, "[error] PollTLS: %s: no certificates presented\n", check.Address)
+		return
+	}
+	expiry := certs[0].NotAfter
+	for _, cert := range certs[1:] {
+		if cert.NotAfter.Before(expiry) {
+			expiry = cert.NotAfter
+		}
+	}
+
+	metrics <- addressMetric(check, "connect time", float64(connected.Sub(start))/float64(time.Millisecond))
+	metrics <- addressMetric(check, "handshake time", float64(handshaked.Sub(connected))/float64(time.Millisecond))
+	metrics <- addressMetric(check, "days until certificate expiry", expiry.Sub(handshaked).Hours()/24)
+}
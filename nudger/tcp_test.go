@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPollTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Couldn't listen: %s\n", err)
+	}
+	address := listener.Addr().String()
+
+	metrics := make(chan Metric, 10)
+	Poll(context.Background(), Check{Type: "tcp", Address: address}, metrics)
+	results := collect(metrics)
+	if _, ok := results[address+": connect time"]; !ok {
+		t.Errorf("Expected connect time metric, got %+v\n", results)
+	}
+
+	listener.Close()
+	Poll(context.Background(), Check{Type: "tcp", Address: address}, metrics)
+	if len(metrics) != 0 {
+		t.Errorf("Expected no metrics for closed port, got %+v\n", collect(metrics))
+	}
+}
+
+func TestPollTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	address := server.Listener.Addr().String()
+
+	metrics := make(chan Metric, 10)
+	Poll(context.Background(), Check{Type: "tls", Address: address, Tags: []string{"tls"}}, metrics)
+	results := collect(metrics)
+
+	for _, name := range []string{"connect time", "handshake time"} {
+		if _, ok := results[address+": "+name]; !ok {
+			t.Errorf("Expected %q metric, got %+v\n", name, results)
+		}
+	}
+
+	days := results[address+": days until certificate expiry"]
+	expected := server.Certificate().NotAfter.Sub(time.Now()).Hours() / 24
+	if days < expected-1 || days > expected+1 {
+		t.Errorf("Expected about %f days until expiry, got %f\n", expected, days)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"github.com/radalert/layer4/logging"
+	"golang.org/x/net/trace"
+	"strings"
+)
+
+type traceIDKey struct{}
+
+// NewTrace starts a trace, viewable on /debug/requests, and returns a context
+// carrying it. Each trace gets an ID that Logf adds to log lines, so a log
+// line can be matched up with its trace. If ctx already carries a trace, the
+// new trace records its ID as the parent.
+//
+// x/net/trace keeps recent traces in buckets by how long they took, and keeps
+// failed traces separately, so slow and failed traces outlive the many fast
+// ones.
+func NewTrace(ctx context.Context, family string, title string) (context.Context, trace.Trace) {
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := fmt.Sprintf("%x", b)
+
+	tr := trace.New(family, title)
+	tr.LazyPrintf("trace=%s", id)
+	if parent := TraceID(ctx); parent != "" {
+		tr.LazyPrintf("parent=%s", parent)
+	}
+	ctx = trace.NewContext(ctx, tr)
+	return context.WithValue(ctx, traceIDKey{}, id), tr
+}
+
+// TraceID returns the ID of the trace in ctx, or "" if there isn't one.
+func TraceID(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey{}).(string)
+	return id
+}
+
+// Logf logs like log.Printf, with the ID of the trace in ctx as the
+// request_id, along with the fields ctx carries, like the check and source
+// being polled. It records the message in the trace, and messages logged at
+// [error] mark the trace as failed.
+func Logf(ctx context.Context, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	level, component, msg, fields := logging.ParseLine(message)
+	for k, v := range logging.FieldsFrom(ctx) {
+		fields[k] = v
+	}
+	if tr, ok := trace.FromContext(ctx); ok {
+		tr.LazyPrintf("%s", strings.TrimSpace(message))
+		if level == logging.Error {
+			tr.SetError()
+		}
+		fields["request_id"] = TraceID(ctx)
+	}
+	logging.Default.Log(level, component, msg, fields)
+}
+
+// Tracef records an event in the trace in ctx, without logging it.
+func Tracef(ctx context.Context, format string, args ...interface{}) {
+	if tr, ok := trace.FromContext(ctx); ok {
+		tr.LazyPrintf(format, args...)
+	}
+}
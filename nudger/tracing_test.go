@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/radalert/layer4/logging"
+	"strings"
+	"testing"
+)
+
+func TestLogf(t *testing.T) {
+	var buf bytes.Buffer
+	logger, _ := logging.New(&buf, "nudger", "text", logging.Info)
+	defer func(l *logging.Logger) { logging.Default = l }(logging.Default)
+	logging.Default = logger
+
+	ctx, tr := NewTrace(context.Background(), "nudger.Test", "logf")
+	defer tr.Finish()
+	id := TraceID(ctx)
+	if len(id) != 16 {
+		t.Errorf("Expected a 16 character trace ID, got %q\n", id)
+	}
+
+	Logf(ctx, "[error] PollTest: %s: broken\n", "example.org")
+	if !strings.Contains(buf.String(), "[error] request_id="+id+" PollTest: example.org: broken\n") {
+		t.Errorf("Expected trace ID after the log level, got %q\n", buf.String())
+	}
+
+	buf.Reset()
+	ctx = logging.WithFields(context.Background(), logging.Fields{"check": "example.org", "source": "tcp"})
+	Logf(ctx, "[info] PollTest: fine\n")
+	if strings.Contains(buf.String(), "request_id=") || !strings.Contains(buf.String(), "[info] check=example.org source=tcp PollTest: fine\n") {
+		t.Errorf("Expected the context's fields and no trace ID without a trace, got %q\n", buf.String())
+	}
+
+	buf.Reset()
+	Logf(context.Background(), "[debug] PollTest: noisy\n")
+	if buf.Len() != 0 {
+		t.Errorf("Expected debug lines to be filtered, got %q\n", buf.String())
+	}
+}
+
+func TestPollTracesMetrics(t *testing.T) {
+	sources["test"] = func(ctx context.Context, check Check, metrics chan Metric) {
+		metrics <- Metric{Check: "test: value", Metric: 1}
+	}
+	defer delete(sources, "test")
+
+	ctx, tr := NewTrace(context.Background(), "nudger.Test", "cycle")
+	defer tr.Finish()
+
+	metrics := make(chan Metric, 1)
+	Poll(ctx, Check{Type: "test", Name: "test"}, metrics)
+	m := <-metrics
+	if m.trace == "" || m.trace == TraceID(ctx) {
+		t.Errorf("Expected metric to carry the poll's own trace ID, got %q\n", m.trace)
+	}
+}
@@ -0,0 +1,209 @@
+package pacemaker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FakeServer is a Pacemaker for tests, serving the API that Client uses. It
+// records the metrics and feedback submitted to it, and serves the checks and
+// alerts it's given.
+type FakeServer struct {
+	*httptest.Server
+	// ApiKey, if set, is the API key feedback and queries must use.
+	ApiKey string
+
+	mu       sync.Mutex
+	metrics  []Metric
+	feedback []Feedback
+	checks   []CheckStatus
+	alerts   []Alert
+	failures int
+	requests int
+}
+
+// NewFakeServer starts a fake Pacemaker. Close it when you're done.
+func NewFakeServer() *FakeServer {
+	f := &FakeServer{}
+	router := http.NewServeMux()
+	router.HandleFunc("/", f.serveMetric)
+	router.HandleFunc("/feedback", f.serveFeedback)
+	router.HandleFunc("/checks", f.serveChecks)
+	router.HandleFunc("/alerts", f.serveAlerts)
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.requests++
+		failing := f.failures > 0
+		if failing {
+			f.failures--
+		}
+		f.mu.Unlock()
+		if failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		router.ServeHTTP(w, r)
+	}))
+	return f
+}
+
+// Fail makes the next n requests fail with a 503.
+func (f *FakeServer) Fail(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = n
+}
+
+// Requests returns how many requests have been made, including failed ones.
+func (f *FakeServer) Requests() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+// Metrics returns the metrics submitted so far.
+func (f *FakeServer) Metrics() []Metric {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Metric(nil), f.metrics...)
+}
+
+// WaitForMetrics waits up to timeout for n metrics to be submitted, and
+// returns those that were.
+func (f *FakeServer) WaitForMetrics(n int, timeout time.Duration) []Metric {
+	deadline := time.Now().Add(timeout)
+	for {
+		metrics := f.Metrics()
+		if len(metrics) >= n || time.Now().After(deadline) {
+			return metrics
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Feedback returns the feedback submitted so far.
+func (f *FakeServer) Feedback() []Feedback {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]Feedback(nil), f.feedback...)
+}
+
+// AddCheck adds a check for queries to return.
+func (f *FakeServer) AddCheck(check CheckStatus) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.checks = append(f.checks, check)
+}
+
+// AddAlert adds an alert for queries to return.
+func (f *FakeServer) AddAlert(alert Alert) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.alerts = append(f.alerts, alert)
+}
+
+func (f *FakeServer) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if key, _, _ := r.BasicAuth(); f.ApiKey != "" && key != f.ApiKey {
+		http.Error(w, "invalid API key", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func (f *FakeServer) serveMetric(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" || r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	var m Metric
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, fmt.Sprintf("invalid metric: %s", err), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.metrics = append(f.metrics, m)
+	f.mu.Unlock()
+}
+
+func (f *FakeServer) serveFeedback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !f.authorized(w, r) {
+		return
+	}
+	var feedback Feedback
+	if err := json.NewDecoder(r.Body).Decode(&feedback); err != nil {
+		http.Error(w, fmt.Sprintf("invalid feedback: %s", err), http.StatusBadRequest)
+		return
+	}
+	if err := feedback.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.feedback = append(f.feedback, feedback)
+	f.mu.Unlock()
+}
+
+// matches returns whether a check or alert matches the query in r.
+func matches(r *http.Request, check string, org string, state string, tags []string) bool {
+	q := r.URL.Query()
+	if (q.Get("check") != "" && q.Get("check") != check) || (q.Get("org") != "" && q.Get("org") != org) || (q.Get("state") != "" && q.Get("state") != state) {
+		return false
+	}
+	if tag := q.Get("tag"); tag != "" {
+		for _, t := range tags {
+			if t == tag {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func limit(r *http.Request, n int) int {
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 && l < n {
+		return l
+	}
+	return n
+}
+
+func (f *FakeServer) serveChecks(w http.ResponseWriter, r *http.Request) {
+	if !f.authorized(w, r) {
+		return
+	}
+	f.mu.Lock()
+	checks := []CheckStatus{}
+	for _, c := range f.checks {
+		if matches(r, c.Check, c.Org, c.State, c.Tags) {
+			checks = append(checks, c)
+		}
+	}
+	f.mu.Unlock()
+	json.NewEncoder(w).Encode(checks[:limit(r, len(checks))])
+}
+
+func (f *FakeServer) serveAlerts(w http.ResponseWriter, r *http.Request) {
+	if !f.authorized(w, r) {
+		return
+	}
+	f.mu.Lock()
+	alerts := []Alert{}
+	for _, a := range f.alerts {
+		if matches(r, a.Check, a.Org, a.State, a.Tags) {
+			alerts = append(alerts, a)
+		}
+	}
+	f.mu.Unlock()
+	sort.SliceStable(alerts, func(i, j int) bool { return alerts[i].AnomalyStart > alerts[j].AnomalyStart })
+	json.NewEncoder(w).Encode(alerts[:limit(r, len(alerts))])
+}
@@ -0,0 +1,350 @@
+// Package pacemaker is a client for Pacemaker's HTTP API: submitting metrics
+// and feedback on alerts, and querying checks and their alerts.
+//
+// Metrics are POSTed to Pacemaker's URL itself, authenticated by the API key
+// each carries. Everything else is authenticated with the client's API key, as
+// the username of basic auth, like the console's API:
+//
+//	POST /feedback   a Feedback
+//	GET  /checks     CheckStatuses matching a Query
+//	GET  /alerts     Alerts matching a Query, newest first
+//
+// It's vendored into each project that uses it, at
+// _vendor/src/github.com/radalert/layer4/pacemaker. Copy it over again after
+// changing it.
+package pacemaker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/radalert/layer4/secret"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Metric is a value for a check, submitted to Pacemaker as a heartbeat.
+type Metric struct {
+	ApiKey secret.Secret `json:"api_key"`
+	Check  string        `json:"check"`
+	Metric float64       `json:"metric"`
+	TTL    int           `json:"ttl"`
+	Tags   []string      `json:"tags"`
+}
+
+// Alert is what Pacemaker sends receivers like taut when a check's state
+// changes, and what it returns for a check's history.
+type Alert struct {
+	State        string   `json:"state"`
+	Org          string   `json:"org"`
+	Check        string   `json:"check"`
+	AnomalyStart int64    `json:"anomaly_start"`
+	Tags         []string `json:"tags"`
+}
+
+// Feedback is someone's response to a check's alert: a vote of +1 or -1 on
+// whether it should have alerted, or an acknowledgement that they're on it.
+type Feedback struct {
+	Check string `json:"check"`
+	Org   string `json:"org,omitempty"`
+	Vote  int    `json:"vote,omitempty"`
+	Ack   bool   `json:"ack,omitempty"`
+	User  string `json:"user,omitempty"`
+}
+
+// Validate returns an error if f isn't a vote or an acknowledgement for a
+// check.
+func (f Feedback) Validate() error {
+	switch {
+	case f.Check == "":
+		return errors.New("feedback has no check")
+	case f.Vote != 0 && f.Vote != 1 && f.Vote != -1:
+		return fmt.Errorf("vote on %s is %d, expected +1 or -1", f.Check, f.Vote)
+	case f.Vote == 0 && !f.Ack:
+		return fmt.Errorf("feedback on %s is neither a vote nor an acknowledgement", f.Check)
+	}
+	return nil
+}
+
+// CheckStatus is a check's current state in Pacemaker.
+type CheckStatus struct {
+	Check        string   `json:"check"`
+	Org          string   `json:"org"`
+	State        string   `json:"state"`
+	Metric       float64  `json:"metric"`
+	AnomalyStart int64    `json:"anomaly_start,omitempty"`
+	LastAlerted  int64    `json:"last_alerted,omitempty"`
+	Tags         []string `json:"tags,omitempty"`
+}
+
+// Query selects checks or alerts. Empty fields match everything.
+type Query struct {
+	Check string
+	Org   string
+	State string
+	Tag   string
+	Limit int
+}
+
+func (q Query) values() url.Values {
+	values := url.Values{}
+	for name, value := range map[string]string{"check": q.Check, "org": q.Org, "state": q.State, "tag": q.Tag} {
+		if value != "" {
+			values.Set(name, value)
+		}
+	}
+	if q.Limit > 0 {
+		values.Set("limit", strconv.Itoa(q.Limit))
+	}
+	return values
+}
+
+// ErrNotFound is returned for a check Pacemaker doesn't know about.
+var ErrNotFound = errors.New("not found in Pacemaker")
+
+// Error is an error response from Pacemaker.
+type Error struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Pacemaker returned HTTP %d: %s", e.StatusCode, e.Body)
+}
+
+// Temporary is whether the request might work if it's retried.
+func (e *Error) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// Temporary is whether err, returned by a Client, might not happen if the
+// request is made again later: an Error that's Temporary, or a failure to
+// connect to Pacemaker or get its response. Errors like a metric that can't be
+// marshalled, or a 4xx response, will happen every time.
+func Temporary(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Temporary()
+	}
+	var ne net.Error
+	return errors.As(err, &ne) || errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+// maxBody is how much of a response is read.
+const maxBody = 10 << 20
+
+// Client makes requests to Pacemaker. Requests that can't connect, or get a
+// 5xx or 429 response, are retried up to Retries times, waiting Backoff
+// before the first retry and twice as long before each one after, up to
+// MaxBackoff, or for as long as a Retry-After header says. Other failures to
+// get a response, like timeouts, are only retried for GETs, as a POST may
+// already have been applied.
+//
+// It's safe to use from many goroutines, and reuses connections, so make one
+// and share it.
+type Client struct {
+	URL        string
+	ApiKey     secret.Secret
+	HTTP       *http.Client
+	Retries    int
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Trace, if set, is called with the result of each attempt at a request,
+	// e.g. to record it in a trace.
+	Trace func(ctx context.Context, format string, args ...interface{})
+}
+
+// New creates a client for the Pacemaker at url, authenticating with apikey.
+// Clients that only submit metrics don't need an API key.
+func New(url string, apikey secret.Secret) *Client {
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 32,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 5 * time.Second,
+	}
+	return &Client{
+		URL:        strings.TrimRight(url, "/"),
+		ApiKey:     apikey,
+		HTTP:       &http.Client{Timeout: time.Second * 5, Transport: transport},
+		Retries:    2,
+		Backoff:    250 * time.Millisecond,
+		MaxBackoff: 5 * time.Second,
+	}
+}
+
+// SubmitMetric submits a metric.
+func (c *Client) SubmitMetric(ctx context.Context, metric Metric) error {
+	return c.do(ctx, "POST", "", nil, metric, nil)
+}
+
+// SubmitFeedback submits a vote on, or an acknowledgement of, a check's alert.
+func (c *Client) SubmitFeedback(ctx context.Context, feedback Feedback) error {
+	if err := feedback.Validate(); err != nil {
+		return err
+	}
+	return c.do(ctx, "POST", "/feedback", nil, feedback, nil)
+}
+
+// Checks returns the checks matching q.
+func (c *Client) Checks(ctx context.Context, q Query) ([]CheckStatus, error) {
+	checks := []CheckStatus{}
+	err := c.do(ctx, "GET", "/checks", q.values(), nil, &checks)
+	return checks, err
+}
+
+// Check returns the status of check, or ErrNotFound.
+func (c *Client) Check(ctx context.Context, check string) (CheckStatus, error) {
+	checks, err := c.Checks(ctx, Query{Check: check, Limit: 1})
+	if err != nil {
+		return CheckStatus{}, err
+	}
+	if len(checks) == 0 {
+		return CheckStatus{}, fmt.Errorf("check %s %w", check, ErrNotFound)
+	}
+	return checks[0], nil
+}
+
+// Alerts returns the alerts matching q, newest first.
+func (c *Client) Alerts(ctx context.Context, q Query) ([]Alert, error) {
+	alerts := []Alert{}
+	err := c.do(ctx, "GET", "/alerts", q.values(), nil, &alerts)
+	return alerts, err
+}
+
+func (c *Client) tracef(ctx context.Context, format string, args ...interface{}) {
+	if c.Trace != nil {
+		c.Trace(ctx, format, args...)
+	}
+}
+
+// do makes a request, retrying it if it might work next time, and decodes the
+// response's JSON into out.
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, in interface{}, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		body, err = json.Marshal(in)
+		if err != nil {
+			return fmt.Errorf("JSON marshal: %s", err)
+		}
+	}
+	u := c.URL + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		wait, err := c.attempt(ctx, method, u, body, out)
+		if wait < 0 || attempt >= c.Retries {
+			return err
+		}
+		if wait == 0 {
+			// Jitter spreads out retries from clients that failed together.
+			wait = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+			backoff *= 2
+			if backoff > c.MaxBackoff {
+				backoff = c.MaxBackoff
+			}
+		}
+		if wait > c.MaxBackoff {
+			wait = c.MaxBackoff
+		}
+		c.tracef(ctx, "retrying in %s: %s", wait, err)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+	}
+}
+
+// attempt makes a request once. If it fails and is worth retrying, it returns
+// how long to wait first, or 0 to back off as usual. Otherwise, it returns -1.
+func (c *Client) attempt(ctx context.Context, method string, u string, body []byte, out interface{}) (time.Duration, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return -1, fmt.Errorf("new request: %s", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if !c.ApiKey.IsZero() {
+		req.SetBasicAuth(c.ApiKey.Reveal(), "")
+	}
+
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		if ctx.Err() != nil || (method != "GET" && !dialError(err)) {
+			return -1, fmt.Errorf("client do: %w", err)
+		}
+		return 0, fmt.Errorf("client do: %w", err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxBody))
+	if err != nil {
+		return 0, fmt.Errorf("couldn't read body: %w", err)
+	}
+	c.tracef(ctx, "HTTP %d", resp.StatusCode)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		e := &Error{StatusCode: resp.StatusCode, Body: truncate(strings.TrimSpace(string(b)), 512)}
+		if !e.Temporary() {
+			return -1, e
+		}
+		return retryAfter(resp), e
+	}
+	if out != nil && len(b) > 0 {
+		if err := json.Unmarshal(b, out); err != nil {
+			return -1, fmt.Errorf("couldn't decode response: %s", err)
+		}
+	}
+	return -1, nil
+}
+
+// dialError is whether err is from failing to connect, so the request can't
+// have reached Pacemaker.
+func dialError(err error) bool {
+	var op *net.OpError
+	return errors.As(err, &op) && op.Op == "dial"
+}
+
+// retryAfter returns how long a response's Retry-After header says to wait,
+// or 0 if it doesn't say.
+func retryAfter(resp *http.Response) time.Duration {
+	value := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil && time.Until(t) > 0 {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
@@ -0,0 +1,171 @@
+package pacemaker
+
+import (
+	"context"
+	"errors"
+	"github.com/radalert/layer4/secret"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testClient(f *FakeServer, apikey string) *Client {
+	c := New(f.URL, secret.New(apikey))
+	c.Backoff = time.Millisecond
+	return c
+}
+
+func TestSubmitMetric(t *testing.T) {
+	f := NewFakeServer()
+	defer f.Close()
+
+	err := testClient(f, "").SubmitMetric(context.Background(), Metric{ApiKey: secret.New("abc"), Check: "example.org", Metric: 1.5, TTL: 60})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	metrics := f.Metrics()
+	if len(metrics) != 1 || metrics[0].Check != "example.org" || metrics[0].Metric != 1.5 || metrics[0].ApiKey.Reveal() != "abc" {
+		t.Errorf("Expected the metric to be submitted with its API key, got %+v\n", metrics)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	f := NewFakeServer()
+	defer f.Close()
+	c := testClient(f, "")
+
+	f.Fail(2)
+	if err := c.SubmitMetric(context.Background(), Metric{Check: "example.org"}); err != nil {
+		t.Errorf("Expected the metric to be submitted on the third attempt, got %s\n", err)
+	}
+	if f.Requests() != 3 || len(f.Metrics()) != 1 {
+		t.Errorf("Expected 3 requests and 1 metric, got %d and %d\n", f.Requests(), len(f.Metrics()))
+	}
+
+	f.Fail(5)
+	err := c.SubmitMetric(context.Background(), Metric{Check: "example.org"})
+	var e *Error
+	if !errors.As(err, &e) || e.StatusCode != 503 {
+		t.Errorf("Expected a 503 after running out of retries, got %v\n", err)
+	}
+	if f.Requests() != 6 {
+		t.Errorf("Expected 2 retries, got %d requests\n", f.Requests()-3)
+	}
+
+	// Waiting to retry gives up when the context is done.
+	c.Backoff = time.Hour
+	c.MaxBackoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := c.SubmitMetric(ctx, Metric{Check: "example.org"}); err == nil || time.Since(start) > time.Second {
+		t.Errorf("Expected to give up with the context, got %v after %s\n", err, time.Since(start))
+	}
+}
+
+func TestRetriesAfterTimeouts(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer server.Close()
+	c := New(server.URL, secret.New("abc"))
+	c.Backoff = time.Millisecond
+	c.HTTP.Timeout = 20 * time.Millisecond
+
+	// A POST that timed out may have been applied, so isn't retried.
+	if err := c.SubmitMetric(context.Background(), Metric{Check: "example.org"}); err == nil || atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("Expected one attempt at the POST, got %d and %v\n", requests, err)
+	}
+	atomic.StoreInt32(&requests, 0)
+	if _, err := c.Checks(context.Background(), Query{}); err == nil || atomic.LoadInt32(&requests) != 3 {
+		t.Errorf("Expected the GET to be retried twice, got %d attempts and %v\n", requests, err)
+	}
+
+	// Failing to connect is retried, as the POST can't have been applied.
+	server.Close()
+	start := time.Now()
+	c.Backoff = 50 * time.Millisecond
+	if err := c.SubmitMetric(context.Background(), Metric{Check: "example.org"}); err == nil || time.Since(start) < 25*time.Millisecond {
+		t.Errorf("Expected the POST to be retried after failing to connect, got %v after %s\n", err, time.Since(start))
+	}
+}
+
+func TestTemporary(t *testing.T) {
+	f := NewFakeServer()
+	c := testClient(f, "")
+	c.Retries = 0
+	f.Fail(1)
+	if err := c.SubmitMetric(context.Background(), Metric{Check: "example.org"}); !Temporary(err) {
+		t.Errorf("Expected a 503 to be temporary, got %v\n", err)
+	}
+	f.Close()
+	if err := c.SubmitMetric(context.Background(), Metric{Check: "example.org"}); !Temporary(err) {
+		t.Errorf("Expected failing to connect to be temporary, got %v\n", err)
+	}
+
+	if err := c.SubmitMetric(context.Background(), Metric{Check: "example.org", Metric: math.NaN()}); err == nil || Temporary(err) {
+		t.Errorf("Expected a metric that can't be marshalled not to be temporary, got %v\n", err)
+	}
+	if Temporary(&Error{StatusCode: 400}) {
+		t.Errorf("Expected a 400 not to be temporary\n")
+	}
+}
+
+func TestFeedback(t *testing.T) {
+	f := NewFakeServer()
+	f.ApiKey = "r4d4l3rt"
+	defer f.Close()
+
+	err := testClient(f, "r4d4l3rt").SubmitFeedback(context.Background(), Feedback{Check: "example.org", Vote: -1, User: "lindsay"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if feedback := f.Feedback(); len(feedback) != 1 || feedback[0].Vote != -1 || feedback[0].User != "lindsay" {
+		t.Errorf("Expected the vote to be submitted, got %+v\n", feedback)
+	}
+
+	if err := testClient(f, "r4d4l3rt").SubmitFeedback(context.Background(), Feedback{Check: "example.org", Vote: 2}); err == nil {
+		t.Errorf("Expected a vote of 2 to be invalid\n")
+	}
+
+	// Errors that won't go away aren't retried.
+	requests := f.Requests()
+	err = testClient(f, "wrong").SubmitFeedback(context.Background(), Feedback{Check: "example.org", Ack: true})
+	var e *Error
+	if !errors.As(err, &e) || e.StatusCode != 401 || f.Requests() != requests+1 {
+		t.Errorf("Expected one request refused with a 401, got %v after %d requests\n", err, f.Requests()-requests)
+	}
+}
+
+func TestQueries(t *testing.T) {
+	f := NewFakeServer()
+	defer f.Close()
+	c := testClient(f, "")
+	f.AddCheck(CheckStatus{Check: "example.org", Org: "MyCo", State: "CRITICAL", LastAlerted: 1434972584})
+	f.AddCheck(CheckStatus{Check: "example.com", Org: "MyCo", State: "OK"})
+	for _, start := range []int64{100, 300, 200} {
+		f.AddAlert(Alert{Check: "example.org", Org: "MyCo", State: "CRITICAL", AnomalyStart: start})
+	}
+
+	check, err := c.Check(context.Background(), "example.org")
+	if err != nil || check.State != "CRITICAL" || check.LastAlerted != 1434972584 {
+		t.Errorf("Expected example.org's status, got %+v, %v\n", check, err)
+	}
+	if _, err := c.Check(context.Background(), "example.net"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected an unknown check not to be found, got %v\n", err)
+	}
+	checks, err := c.Checks(context.Background(), Query{Org: "MyCo", State: "OK"})
+	if err != nil || len(checks) != 1 || checks[0].Check != "example.com" {
+		t.Errorf("Expected MyCo's OK check, got %+v, %v\n", checks, err)
+	}
+
+	alerts, err := c.Alerts(context.Background(), Query{Check: "example.org", Limit: 2})
+	if err != nil || len(alerts) != 2 || alerts[0].AnomalyStart != 300 || alerts[1].AnomalyStart != 200 {
+		t.Errorf("Expected the 2 newest alerts, got %+v, %v\n", alerts, err)
+	}
+}
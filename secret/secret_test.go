@@ -0,0 +1,81 @@
+package secret
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecretRedacts(t *testing.T) {
+	config := struct {
+		Endpoint string
+		ApiKey   Secret
+	}{"https://example.org", New("hunter2")}
+
+	for _, format := range []string{"%s", "%v", "%+v", "%#v", "%q", "%x", "%d"} {
+		if out := fmt.Sprintf(format, config); strings.Contains(out, "hunter2") || strings.Contains(out, fmt.Sprintf("%x", "hunter2")) {
+			t.Errorf("Expected %s to redact the secret, got %s\n", format, out)
+		}
+	}
+	if out := fmt.Sprint(config.ApiKey); out != "[redacted]" {
+		t.Errorf("Expected [redacted], got %s\n", out)
+	}
+	if config.ApiKey.Reveal() != "hunter2" || !config.ApiKey.Equal("hunter2") || config.ApiKey.Equal("hunter3") {
+		t.Errorf("Expected the value to be kept\n")
+	}
+}
+
+func TestSecretJSON(t *testing.T) {
+	var decoded struct {
+		ApiKey Secret `json:"api_key"`
+	}
+	if err := json.Unmarshal([]byte(`{"api_key": "abc"}`), &decoded); err != nil {
+		t.Fatalf("Unexpected error: %s\n", err)
+	}
+	if decoded.ApiKey.Reveal() != "abc" {
+		t.Errorf("Expected abc, got %q\n", decoded.ApiKey.Reveal())
+	}
+	encoded, _ := json.Marshal(decoded)
+	if string(encoded) != `{"api_key":"abc"}` {
+		t.Errorf("Expected the value to be encoded, got %s\n", encoded)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	os.Unsetenv("SECRET_TEST_KEY")
+	os.Unsetenv("SECRET_TEST_KEY_FILE")
+	if _, err := Load("SECRET_TEST_KEY"); err == nil || !strings.Contains(err.Error(), "SECRET_TEST_KEY isn't set") {
+		t.Errorf("Expected an error for a missing secret, got %v\n", err)
+	}
+	if s, err := Optional("SECRET_TEST_KEY"); err != nil || !s.IsZero() {
+		t.Errorf("Expected an empty optional secret, got %v\n", err)
+	}
+
+	os.Setenv("SECRET_TEST_KEY", "from-env")
+	defer os.Unsetenv("SECRET_TEST_KEY")
+	if s, err := Load("SECRET_TEST_KEY"); err != nil || s.Reveal() != "from-env" {
+		t.Errorf("Expected the secret from the environment, got %q, %v\n", s.Reveal(), err)
+	}
+
+	dir, err := ioutil.TempDir("", "secret")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "key")
+	ioutil.WriteFile(path, []byte("from-file\n"), 0600)
+	os.Setenv("SECRET_TEST_KEY_FILE", path)
+	defer os.Unsetenv("SECRET_TEST_KEY_FILE")
+	if s, err := Load("SECRET_TEST_KEY"); err != nil || s.Reveal() != "from-file" {
+		t.Errorf("Expected the secret from the file, got %q, %v\n", s.Reveal(), err)
+	}
+
+	os.Setenv("SECRET_TEST_KEY_FILE", filepath.Join(dir, "missing"))
+	if _, err := Load("SECRET_TEST_KEY"); err == nil {
+		t.Errorf("Expected an error for a missing file\n")
+	}
+}
@@ -0,0 +1,380 @@
+// Package logging writes levelled, structured logs, as text, logfmt or JSON.
+//
+// Setup makes it the output of the standard log package, so the existing
+// log.Printf("[error] Component: message") calls get a level and a component
+// from their prefixes, and are filtered by level like everything else.
+//
+// It's vendored into each project that uses it, at
+// _vendor/src/github.com/radalert/layer4/logging. Copy it over again after
+// changing it.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is how important a log line is.
+type Level int32
+
+const (
+	Debug Level = iota
+	Info
+	Warn
+	Error
+)
+
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return "debug"
+	case Info:
+		return "info"
+	case Warn:
+		return "warn"
+	}
+	return "error"
+}
+
+// ParseLevel parses a level's name. Panics and fatal errors are errors.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return Debug, nil
+	case "info":
+		return Info, nil
+	case "warn", "warning":
+		return Warn, nil
+	case "error", "panic", "fatal":
+		return Error, nil
+	}
+	return Info, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", s)
+}
+
+// Fields are the context of a log line. The usual ones are component, check,
+// org, source and request_id.
+type Fields map[string]string
+
+// fieldOrder is the order fields are written in by the text and logfmt
+// formats, before any others, which are sorted.
+var fieldOrder = []string{"request_id", "org", "check", "source"}
+
+type fieldsKey struct{}
+
+// WithFields returns a context carrying fields, along with any it already
+// carries, for logging with.
+func WithFields(ctx context.Context, fields Fields) context.Context {
+	merged := Fields{}
+	for k, v := range FieldsFrom(ctx) {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, fieldsKey{}, merged)
+}
+
+// FieldsFrom returns the fields carried by ctx.
+func FieldsFrom(ctx context.Context) Fields {
+	fields, _ := ctx.Value(fieldsKey{}).(Fields)
+	return fields
+}
+
+// repeat tracks how often an error has been logged in the current window.
+type repeat struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+// Logger writes log lines at or above its level. Errors and warnings logged
+// more than Repeats times in Window are suppressed, and the next one logged
+// after the window says how many were.
+type Logger struct {
+	App     string
+	Format  string
+	Repeats int
+	Window  time.Duration
+	Now     func() time.Time
+
+	level int32
+	mu    sync.Mutex
+	out   io.Writer
+	seen  map[string]*repeat
+}
+
+// New creates a logger for app, writing to out in format ("text", "logfmt"
+// or "json").
+func New(out io.Writer, app string, format string, level Level) (*Logger, error) {
+	switch format {
+	case "text", "logfmt", "json":
+	default:
+		return nil, fmt.Errorf("unknown log format %q, expected text, logfmt or json", format)
+	}
+	return &Logger{
+		App:     app,
+		Format:  format,
+		Repeats: 5,
+		Window:  time.Minute,
+		Now:     time.Now,
+		level:   int32(level),
+		out:     out,
+		seen:    map[string]*repeat{},
+	}, nil
+}
+
+// Default is the logger Setup installs. Until then, it writes text to stderr.
+var Default, _ = New(os.Stderr, "", "text", Info)
+
+// Setup installs a logger for app as Default, and as the output of the
+// standard log package.
+func Setup(app string, format string, level string) error {
+	lvl, err := ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	l, err := New(os.Stderr, app, format, lvl)
+	if err != nil {
+		return err
+	}
+	Default = l
+	log.SetFlags(0)
+	log.SetOutput(l)
+	return nil
+}
+
+func (l *Logger) Level() Level {
+	return Level(atomic.LoadInt32(&l.level))
+}
+
+func (l *Logger) SetLevel(level Level) {
+	atomic.StoreInt32(&l.level, int32(level))
+}
+
+// Enabled is whether lines at level are logged.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level()
+}
+
+// Log logs msg from component at level, with fields.
+func (l *Logger) Log(level Level, component string, msg string, fields Fields) {
+	if !l.Enabled(level) {
+		return
+	}
+	msg = strings.TrimRight(msg, "\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.Now()
+	if level >= Warn {
+		suppressed, ok := l.limit(level, component, msg, fields, now)
+		if !ok {
+			return
+		}
+		if suppressed > 0 {
+			merged := Fields{"suppressed": strconv.Itoa(suppressed)}
+			for k, v := range fields {
+				merged[k] = v
+			}
+			fields = merged
+		}
+	}
+	io.WriteString(l.out, l.format(now, level, component, msg, fields))
+}
+
+// limit returns whether a line can be logged, and how many of it were
+// suppressed in the window before.
+func (l *Logger) limit(level Level, component string, msg string, fields Fields, now time.Time) (int, bool) {
+	key := level.String() + "|" + component + "|" + fields["check"] + "|" + msg
+	r, ok := l.seen[key]
+	if !ok || now.Sub(r.start) >= l.Window {
+		if len(l.seen) > 10000 {
+			for k, old := range l.seen {
+				if now.Sub(old.start) >= l.Window {
+					delete(l.seen, k)
+				}
+			}
+		}
+		suppressed := 0
+		if ok {
+			suppressed = r.suppressed
+		}
+		l.seen[key] = &repeat{start: now, count: 1}
+		return suppressed, true
+	}
+	r.count++
+	if r.count > l.Repeats {
+		r.suppressed++
+		return 0, false
+	}
+	return 0, true
+}
+
+func (l *Logger) format(now time.Time, level Level, component string, msg string, fields Fields) string {
+	keys := []string{}
+	for _, k := range fieldOrder {
+		if fields[k] != "" {
+			keys = append(keys, k)
+		}
+	}
+	others := []string{}
+	for k, v := range fields {
+		if v != "" && k != "component" && !contains(fieldOrder, k) {
+			others = append(others, k)
+		}
+	}
+	sort.Strings(others)
+	keys = append(keys, others...)
+
+	switch l.Format {
+	case "json":
+		line := map[string]string{"ts": now.UTC().Format(time.RFC3339Nano), "level": level.String(), "msg": msg}
+		if l.App != "" {
+			line["app"] = l.App
+		}
+		if component != "" {
+			line["component"] = component
+		}
+		for _, k := range keys {
+			line[k] = fields[k]
+		}
+		b, _ := json.Marshal(line)
+		return string(b) + "\n"
+	case "logfmt":
+		var b strings.Builder
+		fmt.Fprintf(&b, "ts=%s level=%s", now.UTC().Format(time.RFC3339Nano), level)
+		if l.App != "" {
+			fmt.Fprintf(&b, " app=%s", logfmtValue(l.App))
+		}
+		if component != "" {
+			fmt.Fprintf(&b, " component=%s", logfmtValue(component))
+		}
+		for _, k := range keys {
+			fmt.Fprintf(&b, " %s=%s", k, logfmtValue(fields[k]))
+		}
+		fmt.Fprintf(&b, " msg=%s\n", logfmtValue(msg))
+		return b.String()
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s [%s] ", now.Format("2006/01/02 15:04:05"), level)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%s=%s ", k, logfmtValue(fields[k]))
+	}
+	if component != "" {
+		b.WriteString(component + ": ")
+	}
+	b.WriteString(msg + "\n")
+	return b.String()
+}
+
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " =\"\t\n") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	linePrefix    = regexp.MustCompile(`^\[([a-z]+)\]:? ?`)
+	lineField     = regexp.MustCompile(`^([a-z_]+)=(\S+) `)
+	lineComponent = regexp.MustCompile(`^([A-Za-z][\w.]*): `)
+)
+
+// ParseLine splits a line in the "[level] key=value Component: message" form
+// into its parts. Lines without a level are info, and trace=<id> is taken as
+// the request_id.
+func ParseLine(line string) (Level, string, string, Fields) {
+	line = strings.TrimRight(line, "\n")
+	level := Info
+	if m := linePrefix.FindStringSubmatch(line); m != nil {
+		if parsed, err := ParseLevel(m[1]); err == nil {
+			level = parsed
+			line = line[len(m[0]):]
+		}
+	}
+	fields := Fields{}
+	for {
+		m := lineField.FindStringSubmatch(line)
+		if m == nil {
+			break
+		}
+		if m[1] == "trace" {
+			m[1] = "request_id"
+		}
+		fields[m[1]] = m[2]
+		line = line[len(m[0]):]
+	}
+	component := ""
+	if m := lineComponent.FindStringSubmatch(line); m != nil {
+		component = m[1]
+		line = line[len(m[0]):]
+	}
+	return level, component, line, fields
+}
+
+// Write logs a line from the standard log package, parsed by ParseLine.
+func (l *Logger) Write(p []byte) (int, error) {
+	level, component, msg, fields := ParseLine(string(p))
+	l.Log(level, component, msg, fields)
+	return len(p), nil
+}
+
+// Handler serves the logger's level, and changes it on a PUT or POST with a
+// level form value or body, e.g. curl -X PUT -d debug. Like the /debug pages,
+// it's only served to requests from localhost.
+func (l *Logger) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err != nil || ip == nil || !ip.IsLoopback() {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		switch r.Method {
+		case "GET", "HEAD":
+		case "PUT", "POST":
+			value := r.URL.Query().Get("level")
+			if value == "" {
+				body, _ := ioutil.ReadAll(io.LimitReader(r.Body, 64))
+				value = string(body)
+			}
+			level, err := ParseLevel(value)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			previous := l.Level()
+			l.SetLevel(level)
+			if level != previous {
+				l.Log(Info, "logging", "level changed from "+previous.String()+" to "+level.String(), nil)
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintln(w, l.Level())
+	})
+}
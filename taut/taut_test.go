@@ -2,8 +2,11 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"github.com/nlopes/slack"
+	"github.com/radalert/layer4/pacemaker"
+	"github.com/radalert/layer4/secret"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -107,7 +110,7 @@ func TestSlackSend(t *testing.T) {
 
 	// Dispatch an alert
 	config := Config{
-		SlackWebhookEndpoint: "http://localhost:3456/services/ABC/123",
+		SlackWebhookEndpoint: secret.New("http://localhost:3456/services/ABC/123"),
 		SlackApi:             api,
 	}
 	alerts := make(chan Alert, 10)
@@ -141,8 +144,33 @@ func TestSlackReceiveVote(t *testing.T) {
 	if contains != true {
 		t.Fatalf("Expected response to include:\n\n%s\n\nGot:\n\n%s", expected, text)
 	}
+}
+
+func TestVotesPassedToPacemaker(t *testing.T) {
+	server := pacemaker.NewFakeServer()
+	server.ApiKey = "r4d4l3rt"
+	defer server.Close()
+	config := Config{Pacemaker: pacemaker.New(server.URL, secret.New("r4d4l3rt"))}
+
+	text, _ := handleCommand(context.Background(), config, "lindsay", "'spoons of doom' -1")
+	if text != "You voted -1 on 'spoons of doom'" {
+		t.Errorf("Expected the vote to be acknowledged, got %q\n", text)
+	}
+	text, _ = handleCommand(context.Background(), config, "lindsay", "ack 'spoons of doom'")
+	if text != "You acknowledged 'spoons of doom'" {
+		t.Errorf("Expected the acknowledgement to be acknowledged, got %q\n", text)
+	}
+
+	feedback := server.Feedback()
+	if len(feedback) != 2 || feedback[0].Vote != -1 || feedback[0].User != "lindsay" || !feedback[1].Ack {
+		t.Fatalf("Expected a vote and an acknowledgement for Pacemaker, got %+v\n", feedback)
+	}
 
-	// TODO(auxesis): test passing votes back to pacemaker
+	config.Pacemaker = pacemaker.New(server.URL, secret.New("wrong"))
+	text, _ = handleCommand(context.Background(), config, "lindsay", "'spoons of doom' +1")
+	if !strings.HasPrefix(text, "Couldn't record your vote") {
+		t.Errorf("Expected the vote to fail, got %q\n", text)
+	}
 }
 
 func TestSlackReceiveHelp(t *testing.T) {